@@ -1,31 +1,228 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"gollama/internal/batch"
+	"gollama/internal/cache"
+	"gollama/internal/cluster"
 	"gollama/internal/config"
+	"gollama/internal/federation"
 	"gollama/internal/handler"
+	"gollama/internal/jobs"
 	"gollama/internal/pool"
 	"gollama/internal/server"
+	"gollama/internal/templates"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+/*
+overrideFlags collects repeated -set key=value flags
+*/
+type overrideFlags []string
+
+func (o *overrideFlags) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *overrideFlags) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
 func main() {
-	// Initialize authentication with credentials from DB/auth.json
-	err := handler.InitAuth("DB/auth.json")
+	configPath := flag.String("config", os.Getenv("GOLLAMA_CONFIG"), "Path to a TOML config file")
+	check := flag.Bool("check", false, "Validate the configuration and exit")
+	var overrides overrideFlags
+	flag.Var(&overrides, "set", "Override a config file setting, e.g. -set pool.max_retries=5 (repeatable)")
+	flag.Parse()
+
+	// Defaults, then the config file, then environment variables, then -set flags
+	cfg, err := config.LoadServerConfig(*configPath, overrides)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *check {
+		log.Printf("Configuration is valid")
+		return
+	}
+
+	// Initialize authentication with the worker credentials file
+	err = handler.InitAuth(cfg.AuthFile, cfg.TokenTTLHours)
 	if err != nil {
 		log.Fatalf("Failed to initialize auth: %v", err)
 	}
 
-	// setup config file (uses .env at root level)
-	cfg := config.LoadServerConfig()
 	p := pool.New(cfg.QueueSize, cfg.ConcurrentWorkers, cfg.MaxRetries)
+	p.SetHedging(float64(cfg.HedgePercentile), float64(cfg.HedgeBudget))
+	p.SetRetryPolicy(time.Duration(cfg.RetryBaseDelayMS)*time.Millisecond,
+		time.Duration(cfg.RetryMaxDelayMS)*time.Millisecond, float64(cfg.RetryBudget))
 
 	p.Start()
 
+	// Deterministic requests (temperature 0 or a seed) are answered from the cache when possible
+	if cfg.CacheEnabled {
+		c, err := cache.New(cfg.CacheSize, time.Duration(cfg.CacheTTLSeconds)*time.Second, cfg.CacheDir)
+		if err != nil {
+			log.Fatalf("Failed to create response cache: %v", err)
+		}
+		c.Start()
+		handler.InitCache(c)
+	}
+
+	// Prompt templates: built-in defaults, overridden by any files in the templates directory
+	reg, err := templates.NewRegistry(cfg.TemplatesDir)
+	if err != nil {
+		log.Fatalf("Failed to load templates: %v", err)
+	}
+
+	// Peer hubs trade overflow with this one
+	var fed *federation.Federation
+	if cfg.FederationConfig != "" {
+		fedCfg, err := federation.LoadConfig(cfg.FederationConfig)
+		if err != nil {
+			log.Fatalf("Failed to load federation config: %v", err)
+		}
+		fed, err = federation.New(fedCfg, p, cfg.FederationLedger)
+		if err != nil {
+			log.Fatalf("Failed to set up federation: %v", err)
+		}
+		p.SetFederation(cfg.SpillAfter, fed)
+		fed.Start()
+	}
+
+	// Async jobs replay requests through the same routes the server registers. With the WAL queue
+	// they survive a restart.
+	var queue pool.Queue
+	var node *cluster.Node
+	if cfg.ClusterBackend != "" {
+		// Hub replicas share workers and async jobs through the cluster instead of a local queue
+		self := cfg.ClusterSelf
+		if self == "" {
+			self = fmt.Sprintf("http://localhost:%d", cfg.Port)
+		}
+		backend, err := cluster.NewBackend(cfg.ClusterBackend, self, cfg.ClusterPeers, cfg.ClusterSecret, cfg.ClusterDir)
+		if err != nil {
+			log.Fatalf("Failed to set up cluster: %v", err)
+		}
+		node = cluster.NewNode(self, backend, p)
+		p.SetReplicator(node)
+		queue = node
+	} else {
+		queue, err = pool.NewQueue(cfg.QueueBackend, cfg.QueueDir)
+		if err != nil {
+			log.Fatalf("Failed to open job queue: %v", err)
+		}
+	}
+	// Interrupts close the queue before exiting, so the hub leaves it (and the cluster) cleanly
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	store := jobs.NewStore(queue, http.DefaultServeMux, time.Duration(cfg.JobRetentionMins)*time.Minute, cfg.MaxAsyncJobs, cfg.WebhookSecret)
+	if cfg.WebhookPrivate {
+		store.AllowPrivateCallbacks()
+	}
+
+	// Batches run through the same routes at low priority
+	batches := batch.NewManager(cfg.BatchDir, http.DefaultServeMux, cfg.BatchConcurrency)
+	batches.SetLimits(cfg.MaxBatchItems, int64(cfg.MaxBatchBytes))
+
 	// Initialize
-	srv := server.New(p, cfg.Port, cfg.DefaultMaxTokens)
+	srv := server.New(p, reg, store, batches, node, fed, cfg.Port, cfg.DefaultMaxTokens)
+	if cfg.TLSCertFile != "" {
+		srv.SetTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
 	srv.Setup()
 
-	if err := srv.Start(); err != nil {
-		log.Fatalf("Server error: %v", err)
+	// SIGHUP re-reads the config file and applies what can change while the hub runs
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		current := cfg
+		for range hup {
+			current = reload(cfg, current, p, reg, batches, fed)
+		}
+	}()
+
+	// Replicas reach each other through the server, so it's listening before the node joins
+	go func() {
+		if err := srv.Start(); err != nil {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+
+	if node != nil {
+		node.OnAdopt(func(job pool.QueuedJob) { store.Resume(job) })
+		err = node.Start()
+		if err != nil {
+			log.Fatalf("Failed to join cluster: %v", err)
+		}
+		if !node.WaitReady(15 * time.Second) {
+			log.Printf("Cluster: not caught up with the other hubs yet, starting anyway")
+		}
+	}
+
+	// Resume unfinished async jobs and batches once the routes they replay through exist
+	store.Start()
+	err = batches.Start()
+	if err != nil {
+		log.Fatalf("Failed to load batches: %v", err)
+	}
+
+	<-stop
+	log.Println("Shutting down hub...")
+	err = queue.Close()
+	if err != nil {
+		log.Printf("Closing job queue: %v", err)
+	}
+}
+
+/*
+reload loads the configuration again and applies the settings that are safe to change while the hub
+runs: worker credentials and token lifetime, retries, hedging, batch limits and federation spill-over.
+Templates are re-read from their directory as well. Other changes are logged as needing a restart,
+compared with the startup config so the warning repeats until the hub is restarted. An invalid
+config is logged and the current one kept.
+*/
+func reload(startup, current *config.ServerConfig, p *pool.Pool, reg *templates.Registry, batches *batch.Manager, fed *federation.Federation) *config.ServerConfig {
+	log.Printf("Reloading configuration")
+	next, err := current.Reload()
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current settings: %v", err)
+		return current
+	}
+
+	err = handler.InitAuth(next.AuthFile, next.TokenTTLHours)
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current settings: %v", err)
+		return current
+	}
+	p.SetMaxRetries(next.MaxRetries)
+	p.SetHedging(float64(next.HedgePercentile), float64(next.HedgeBudget))
+	p.SetRetryPolicy(time.Duration(next.RetryBaseDelayMS)*time.Millisecond,
+		time.Duration(next.RetryMaxDelayMS)*time.Millisecond, float64(next.RetryBudget))
+	batches.SetLimits(next.MaxBatchItems, int64(next.MaxBatchBytes))
+	if fed != nil {
+		p.SetFederation(next.SpillAfter, fed)
+	}
+
+	err = reg.Reload()
+	if err != nil {
+		log.Printf("Config reload: keeping the current templates: %v", err)
+	}
+
+	applied, _ := current.Changes(next)
+	_, restart := startup.Changes(next)
+	if len(applied) > 0 {
+		log.Printf("Config reload applied: %s", strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		log.Printf("Config reload: %s changed; restart the hub to apply", strings.Join(restart, ", "))
 	}
+	return next
 }
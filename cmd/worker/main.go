@@ -2,23 +2,95 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"gollama/internal/config"
 	"gollama/internal/worker"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Auto-connect backoff bounds: the hub may still be starting when volunteers launch their worker
+const (
+	initialConnectBackoff = 1 * time.Second
+	maxConnectBackoff     = 1 * time.Minute
 )
 
 func main() {
+	configPath := flag.String("config", "", "Path to a JSON worker config file")
 	port := flag.Int("port", 9001, "Port number for the worker to run on")
 	llamaPort := flag.Int("llama-port", 8080, "Port number for the llama.cpp instance")
 	serverURL := flag.String("server-url", "http://localhost:9000", "Base URL of the GoLlama server")
+	reverse := flag.Bool("reverse", false, "Dial out to the server over a reverse tunnel (for workers behind NAT)")
+	username := flag.String("username", "", "Username for authenticating with the GoLlama server")
+	password := flag.String("password", "", "Password for authenticating with the GoLlama server")
+	tokenFile := flag.String("token-file", "", "File containing a pre-issued worker JWT (instead of username/password)")
+	advertiseURL := flag.String("advertise-url", "", "Externally reachable URL the server should use to reach this worker")
+	name := flag.String("name", "", "Display name for this worker in server stats")
+	llamaServer := flag.String("llama-server", "", "Path to the llama-server binary; when set the worker launches and supervises it")
+	modelPath := flag.String("model-path", "", "Model file for the worker-launched llama-server")
+	llamaArgs := flag.String("llama-args", "", "Extra arguments for the worker-launched llama-server, e.g. \"-c 4096 -ngl 99\"")
+	maxTokens := flag.Int("max-tokens", 0, "Cap on generated tokens per request, 0 for no cap (default 8192)")
+	maxRequestBytes := flag.Int64("max-request-bytes", 0, "Largest request body accepted from the server in bytes, 0 for no limit (default 4 MiB)")
+	backends := flag.String("backends", "", "Comma-separated llama.cpp backends as port[=model], e.g. 8080=qwen,8081=qwen,8082=llama")
 	flag.Parse()
 
+	cfg, err := config.LoadWorkerConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load worker config: %v", err)
+	}
+
+	// Flags given explicitly on the command line override the config file and environment
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "llama-port":
+			cfg.LlamaPort = *llamaPort
+		case "server-url":
+			cfg.ServerURL = *serverURL
+		case "reverse":
+			cfg.Reverse = *reverse
+		case "username":
+			cfg.Username = *username
+		case "password":
+			cfg.Password = *password
+		case "token-file":
+			cfg.TokenFile = *tokenFile
+		case "advertise-url":
+			cfg.AdvertiseURL = *advertiseURL
+		case "name":
+			cfg.Name = *name
+		case "llama-server":
+			cfg.LlamaServer = *llamaServer
+		case "model-path":
+			cfg.ModelPath = *modelPath
+		case "llama-args":
+			cfg.LlamaArgs = strings.Fields(*llamaArgs)
+		case "max-tokens":
+			cfg.MaxTokens = *maxTokens
+		case "max-request-bytes":
+			cfg.MaxRequestBytes = *maxRequestBytes
+		case "backends":
+			cfg.Backends, err = config.ParseBackends(*backends)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Invalid -backends flag: %v", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid worker config: %v", err)
+	}
+
 	//initialize and setup the worker
-	c := worker.New(*port)
-	c.Setup(*llamaPort, *serverURL)
+	c := worker.New(cfg.Port)
+	c.Setup(cfg)
 
 	// Start worker server first (non-blocking)
 	go func() {
@@ -26,37 +98,65 @@ func main() {
 			log.Fatalf("Worker server error: %v", err)
 		}
 	}()
-	autoConnect(port)
+
+	// Stop any llama-server processes we launched when the worker is interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Shutting down worker...")
+		c.Shutdown()
+		os.Exit(0)
+	}()
+
+	err = c.StartBackends()
+	if err != nil {
+		log.Printf("Failed to start llama-server: %v", err)
+		c.Shutdown()
+		os.Exit(1)
+	}
+	autoConnect(cfg.Port)
 	select {}
 }
 
-func autoConnect(port *int) {
+/*
+autoConnect asks the local worker to register with the GoLlama server, retrying with exponential
+backoff until it succeeds. Credentials come from the worker config, so the request body is empty.
+*/
+func autoConnect(port int) {
 	log.Println("Attempting auto-connect to GoLlama server...")
 
-	// Prepare credentials for authentication
-	credentials := map[string]string{
-		"username": "admin",
-		"password": "password",
-	}
+	backoff := initialConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := connectOnce(port)
+		if err == nil {
+			log.Println("Auto-connect to server successful!")
+			return
+		}
 
-	payload, err := json.Marshal(credentials)
-	if err != nil {
-		log.Fatalf("Auto-connect failed: could not prepare credentials - %v", err)
+		log.Printf("Auto-connect attempt %d failed: %v - retrying in %v", attempt, err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
 	}
+}
 
+func connectOnce(port int) error {
 	resp, err := http.Post(
-		fmt.Sprintf("http://localhost:%d/connect", *port),
+		fmt.Sprintf("http://localhost:%d/connect", port),
 		"application/json",
-		bytes.NewReader(payload),
+		bytes.NewReader(nil),
 	)
 	if err != nil {
-		log.Fatalf("Auto-connect failed: %v - shutting down", err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Auto-connect failed: worker returned status %d - shutting down", resp.StatusCode)
+		return fmt.Errorf("worker returned status %d", resp.StatusCode)
 	}
-
-	log.Println("Auto-connect to server successful!")
+	return nil
 }
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -60,3 +61,12 @@ func OptionalAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// ClaimsFromRequest extracts and validates the bearer token on a request
+func ClaimsFromRequest(r *http.Request) (*Claims, error) {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return nil, fmt.Errorf("missing or malformed Authorization header")
+	}
+	return ValidateToken(parts[1])
+}
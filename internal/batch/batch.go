@@ -0,0 +1,719 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gollama/internal/jobs"
+	"gollama/internal/pool"
+)
+
+// Status is where a batch is in its lifecycle
+type Status string
+
+const (
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Item states reported by /batches/{id}/items
+const (
+	ItemPending   = "pending"
+	ItemRunning   = "running"
+	ItemCompleted = "completed"
+	ItemFailed    = "failed"
+)
+
+// Default limits on uploaded batches (see SetLimits)
+const (
+	MaxItems      = 50000
+	MaxInputBytes = 100 << 20
+)
+
+// Waiting out a 503 for a batch item: backoff between tries is capped at maxUnavailableWait, and
+// after maxUnavailableTotal the item fails with the 503
+const (
+	maxUnavailableWait  = 30 * time.Second
+	maxUnavailableTotal = 10 * time.Minute
+)
+
+// Files kept in each batch's directory
+const (
+	metaFile    = "batch.json"
+	inputFile   = "input.jsonl"
+	resultsFile = "results.jsonl"
+)
+
+/*
+Line is one request in an uploaded batch. Endpoint falls back to the batch's default endpoint.
+*/
+type Line struct {
+	CustomID string          `json:"custom_id,omitempty"`
+	Endpoint string          `json:"endpoint,omitempty"`
+	Body     json.RawMessage `json:"body"`
+}
+
+/*
+Result is one line of a batch's results file. Lines are written as items finish, so they are not in
+input order; Index ties each back to its input line.
+*/
+type Result struct {
+	Index      int             `json:"index"`
+	CustomID   string          `json:"custom_id,omitempty"`
+	Status     string          `json:"status"`
+	StatusCode int             `json:"status_code"`
+	Response   json.RawMessage `json:"response,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+/*
+Counts tallies a batch's items by state
+*/
+type Counts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+/*
+Batch is the metadata persisted in batch.json and returned by the API
+*/
+type Batch struct {
+	ID             string     `json:"id"`
+	IdempotencyKey string     `json:"idempotency_key,omitempty"`
+	Status         Status     `json:"status"`
+	Counts         Counts     `json:"counts"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+/*
+ItemStatus is an item's current state, for tracking progress of individual requests
+*/
+type ItemStatus struct {
+	Index    int    `json:"index"`
+	CustomID string `json:"custom_id,omitempty"`
+	Status   string `json:"status"`
+}
+
+/*
+run is a batch being tracked in memory
+*/
+type run struct {
+	meta    Batch
+	dir     string
+	hash    string // of the input file, to check a reused idempotency key against
+	lines   []Line
+	states  []string
+	results *os.File
+	cancel  context.CancelFunc
+}
+
+/*
+Manager stores batches on disk and works through them in the background at low priority, so
+interactive traffic always goes first. Batches that were running when the hub stopped are resumed
+from their results file on startup.
+*/
+type Manager struct {
+	dir         string
+	handler     http.Handler
+	concurrency int
+
+	mu            sync.Mutex
+	batches       map[string]*run
+	keys          map[string]string // idempotency key -> batch ID
+	maxItems      int
+	maxInputBytes int64
+}
+
+/*
+NewManager creates a manager persisting batches under dir and replaying items through handler
+(the hub's mux), running up to concurrency items of each batch at once
+*/
+func NewManager(dir string, handler http.Handler, concurrency int) *Manager {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Manager{
+		dir:           dir,
+		handler:       handler,
+		concurrency:   concurrency,
+		batches:       make(map[string]*run),
+		keys:          make(map[string]string),
+		maxItems:      MaxItems,
+		maxInputBytes: MaxInputBytes,
+	}
+}
+
+/*
+SetLimits changes how many items and how many bytes of JSONL an uploaded batch may have. Batches
+already accepted keep running whatever their size.
+*/
+func (m *Manager) SetLimits(maxItems int, maxInputBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxItems = maxItems
+	m.maxInputBytes = maxInputBytes
+}
+
+/*
+MaxInputBytes returns the largest batch upload accepted
+*/
+func (m *Manager) MaxInputBytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.maxInputBytes
+}
+
+/*
+Start loads batches from disk and resumes any that didn't finish
+*/
+func (m *Manager) Start() error {
+	err := os.MkdirAll(m.dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("creating batch directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return fmt.Errorf("reading batch directory: %w", err)
+	}
+
+	resumed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		r, err := m.load(filepath.Join(m.dir, entry.Name()))
+		if err != nil {
+			log.Printf("Skipping batch %s: %v", entry.Name(), err)
+			continue
+		}
+
+		m.mu.Lock()
+		m.batches[r.meta.ID] = r
+		if r.meta.IdempotencyKey != "" {
+			m.keys[r.meta.IdempotencyKey] = r.meta.ID
+		}
+		m.mu.Unlock()
+
+		if r.meta.Status == StatusRunning {
+			resumed++
+			m.launch(r)
+		}
+	}
+	log.Printf("Batches: %d loaded from %s, %d resumed", len(entries), m.dir, resumed)
+	return nil
+}
+
+/*
+Create parses an uploaded JSONL batch, persists it and starts running it. If key is set and a batch
+was already created with it, that batch is returned instead, with false; if that batch had
+different items, Create fails with jobs.ErrKeyReused.
+*/
+func (m *Manager) Create(input []byte, defaultEndpoint string, key string) (Batch, bool, error) {
+	if len(key) > jobs.MaxKeyLength {
+		return Batch{}, false, fmt.Errorf("Idempotency-Key is longer than %d characters", jobs.MaxKeyLength)
+	}
+
+	m.mu.Lock()
+	maxItems := m.maxItems
+	m.mu.Unlock()
+	lines, err := parseLines(input, defaultEndpoint, maxItems)
+	if err != nil {
+		return Batch{}, false, err
+	}
+	// items are compared as saved, with the default endpoint filled in
+	encoded := encodeLines(lines)
+	hash := jobs.RequestHash(encoded)
+	if existing, ok, err := m.byKey(key, hash); ok || err != nil {
+		return existing, false, err
+	}
+
+	r := &run{
+		meta: Batch{
+			ID:             jobs.NewID("batch_"),
+			IdempotencyKey: key,
+			Status:         StatusRunning,
+			Counts:         Counts{Total: len(lines)},
+			CreatedAt:      time.Now(),
+		},
+		hash:   hash,
+		lines:  lines,
+		states: make([]string, len(lines)),
+	}
+	r.dir = filepath.Join(m.dir, r.meta.ID)
+	for i := range r.states {
+		r.states[i] = ItemPending
+	}
+
+	err = os.MkdirAll(r.dir, 0o755)
+	if err != nil {
+		return Batch{}, false, fmt.Errorf("creating batch: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(r.dir, inputFile), encoded, 0o644)
+	if err != nil {
+		return Batch{}, false, fmt.Errorf("saving batch input: %w", err)
+	}
+	err = writeMeta(r)
+	if err != nil {
+		return Batch{}, false, err
+	}
+
+	m.mu.Lock()
+	if existing, ok, err := m.lockedByKey(key, hash); ok || err != nil {
+		// the same key was submitted concurrently and that upload got here first
+		m.mu.Unlock()
+		os.RemoveAll(r.dir)
+		return existing, false, err
+	}
+	m.batches[r.meta.ID] = r
+	if key != "" {
+		m.keys[key] = r.meta.ID
+	}
+	m.mu.Unlock()
+
+	m.launch(r)
+	log.Printf("Created batch %s with %d items", r.meta.ID, len(lines))
+	return r.meta, true, nil
+}
+
+/*
+byKey finds the batch created with an idempotency key. It fails with jobs.ErrKeyReused if that
+batch's input doesn't hash to hash.
+*/
+func (m *Manager) byKey(key string, hash string) (Batch, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lockedByKey(key, hash)
+}
+
+/*
+lockedByKey is byKey for callers holding m.mu
+*/
+func (m *Manager) lockedByKey(key string, hash string) (Batch, bool, error) {
+	if key == "" {
+		return Batch{}, false, nil
+	}
+	r, ok := m.batches[m.keys[key]]
+	if !ok {
+		return Batch{}, false, nil
+	}
+	if r.hash != hash {
+		return Batch{}, false, jobs.ErrKeyReused
+	}
+	return r.meta, true, nil
+}
+
+/*
+Get returns a batch's metadata
+*/
+func (m *Manager) Get(id string) (Batch, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.batches[id]
+	if !ok {
+		return Batch{}, false
+	}
+	return r.meta, true
+}
+
+/*
+List returns all batches, newest first
+*/
+func (m *Manager) List() []Batch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]Batch, 0, len(m.batches))
+	for _, r := range m.batches {
+		list = append(list, r.meta)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+/*
+Items returns the state of every item in a batch
+*/
+func (m *Manager) Items(id string) ([]ItemStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.batches[id]
+	if !ok {
+		return nil, false
+	}
+	items := make([]ItemStatus, len(r.lines))
+	for i, line := range r.lines {
+		items[i] = ItemStatus{Index: i, CustomID: line.CustomID, Status: r.states[i]}
+	}
+	return items, true
+}
+
+/*
+ResultsPath returns the results file of a batch for downloading
+*/
+func (m *Manager) ResultsPath(id string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.batches[id]
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(r.dir, resultsFile), true
+}
+
+/*
+Cancel stops a running batch. Items already finished keep their results; the rest stay pending.
+*/
+func (m *Manager) Cancel(id string) (Batch, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.batches[id]
+	if !ok {
+		return Batch{}, false
+	}
+	if r.meta.Status != StatusRunning {
+		return r.meta, true
+	}
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+	now := time.Now()
+	r.meta.Status = StatusCancelled
+	r.meta.CompletedAt = &now
+	for i, state := range r.states {
+		if state == ItemRunning {
+			r.states[i] = ItemPending
+		}
+	}
+	if err := writeMeta(r); err != nil {
+		log.Printf("Batch %s: %v", id, err)
+	}
+	log.Printf("Cancelled batch %s", id)
+	return r.meta, true
+}
+
+/*
+launch works through a batch's pending items in the background
+*/
+func (m *Manager) launch(r *run) {
+	ctx, cancel := context.WithCancel(pool.WithLowPriority(context.Background()))
+
+	m.mu.Lock()
+	r.cancel = cancel
+	pending := make([]int, 0)
+	for i, state := range r.states {
+		if state == ItemPending {
+			pending = append(pending, i)
+		}
+	}
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+
+		work := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < m.concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					m.runItem(ctx, r, i)
+				}
+			}()
+		}
+
+	feed:
+		for _, i := range pending {
+			select {
+			case work <- i:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(work)
+		wg.Wait()
+
+		m.complete(r)
+	}()
+}
+
+/*
+runItem replays one request through the hub and appends its result
+*/
+func (m *Manager) runItem(ctx context.Context, r *run, i int) {
+	m.mu.Lock()
+	r.states[i] = ItemRunning
+	m.mu.Unlock()
+
+	// 503 means no worker can take the item right now (e.g. workers still reconnecting after a
+	// hub restart), so wait and try again rather than failing it. A model no worker ever comes
+	// back for would hold its slot forever, so the wait is capped.
+	line := r.lines[i]
+	wait := time.Second
+	giveUp := time.Now().Add(maxUnavailableTotal)
+	code, body := jobs.Replay(ctx, m.handler, line.Endpoint, line.Body)
+	for code == http.StatusServiceUnavailable && ctx.Err() == nil && time.Now().Before(giveUp) {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		wait = min(wait*2, maxUnavailableWait)
+		code, body = jobs.Replay(ctx, m.handler, line.Endpoint, line.Body)
+	}
+	if ctx.Err() != nil {
+		return // cancelled; the item stays pending
+	}
+
+	result := Result{Index: i, CustomID: line.CustomID, StatusCode: code}
+	trimmed := bytes.TrimSpace(body)
+	if code < 400 && json.Valid(trimmed) {
+		result.Status = ItemCompleted
+		result.Response = json.RawMessage(trimmed)
+	} else {
+		result.Status = ItemFailed
+		result.Error = string(trimmed)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r.meta.Status != StatusRunning {
+		return
+	}
+
+	err := appendResult(r, result)
+	if err != nil {
+		log.Printf("Batch %s: %v", r.meta.ID, err)
+		r.states[i] = ItemPending // rerun it when the batch resumes
+		return
+	}
+	r.states[i] = result.Status
+	if result.Status == ItemCompleted {
+		r.meta.Counts.Completed++
+	} else {
+		r.meta.Counts.Failed++
+	}
+}
+
+/*
+complete marks a batch finished once every item has a result
+*/
+func (m *Manager) complete(r *run) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.results != nil {
+		_ = r.results.Close()
+		r.results = nil
+	}
+	if r.meta.Status != StatusRunning {
+		return
+	}
+
+	now := time.Now()
+	r.meta.Status = StatusCompleted
+	r.meta.CompletedAt = &now
+	err := writeMeta(r)
+	if err != nil {
+		log.Printf("Batch %s: %v", r.meta.ID, err)
+	}
+	log.Printf("Batch %s completed: %d succeeded, %d failed", r.meta.ID, r.meta.Counts.Completed, r.meta.Counts.Failed)
+}
+
+/*
+load reads a batch back from disk. Items with a line in the results file are done; a partial last
+line from a crash is cut off so that item runs again.
+*/
+func (m *Manager) load(dir string) (*run, error) {
+	data, err := os.ReadFile(filepath.Join(dir, metaFile))
+	if err != nil {
+		return nil, err
+	}
+	r := &run{dir: dir}
+	err = json.Unmarshal(data, &r.meta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", metaFile, err)
+	}
+
+	input, err := os.ReadFile(filepath.Join(dir, inputFile))
+	if err != nil {
+		return nil, err
+	}
+	r.lines, err = parseLines(input, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	r.hash = jobs.RequestHash(input)
+
+	r.states = make([]string, len(r.lines))
+	for i := range r.states {
+		r.states[i] = ItemPending
+	}
+	r.meta.Counts = Counts{Total: len(r.lines)}
+
+	err = loadResults(r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+loadResults replays results.jsonl into the run's item states. A last line torn by a crash mid-write
+is cut off the file, so the next result starts on a line of its own instead of being glued to it.
+*/
+func loadResults(r *run) error {
+	path := filepath.Join(r.dir, resultsFile)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var good int64 // length of the file up to its last complete line
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Batches: dropping a torn result line from %s", path)
+				return os.Truncate(path, good)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", resultsFile, err)
+		}
+		good += int64(len(line))
+
+		var result Result
+		if json.Unmarshal(line, &result) != nil || result.Index < 0 || result.Index >= len(r.lines) {
+			continue
+		}
+		if r.states[result.Index] != ItemPending {
+			continue
+		}
+		r.states[result.Index] = result.Status
+		if result.Status == ItemCompleted {
+			r.meta.Counts.Completed++
+		} else {
+			r.meta.Counts.Failed++
+		}
+	}
+}
+
+/*
+parseLines decodes JSONL input, filling in the default endpoint and rejecting endpoints that can't
+run in the background, and more than maxItems lines (0 for no limit)
+*/
+func parseLines(input []byte, defaultEndpoint string, maxItems int) ([]Line, error) {
+	var lines []Line
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	n := 0
+	for scanner.Scan() {
+		n++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var line Line
+		err := json.Unmarshal([]byte(text), &line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid JSON: %v", n, err)
+		}
+		if line.Endpoint == "" {
+			line.Endpoint = defaultEndpoint
+		}
+		if !jobs.EndpointAllowed(line.Endpoint) {
+			return nil, fmt.Errorf("line %d: endpoint %q can't run in a batch", n, line.Endpoint)
+		}
+		if len(line.Body) == 0 {
+			return nil, fmt.Errorf("line %d: body is required", n)
+		}
+
+		lines = append(lines, line)
+		if maxItems > 0 && len(lines) > maxItems {
+			return nil, fmt.Errorf("at most %d items per batch", maxItems)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading input: %v", err)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("batch is empty")
+	}
+	return lines, nil
+}
+
+func encodeLines(lines []Line) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		data, _ := json.Marshal(line)
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+/*
+appendResult writes a result line and syncs it, so a finished item is never run twice after a crash
+*/
+func appendResult(r *run, result Result) error {
+	if r.results == nil {
+		f, err := os.OpenFile(filepath.Join(r.dir, resultsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening results: %w", err)
+		}
+		r.results = f
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = r.results.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("writing result: %w", err)
+	}
+	return r.results.Sync()
+}
+
+/*
+writeMeta atomically replaces batch.json
+*/
+func writeMeta(r *run) error {
+	data, err := json.MarshalIndent(r.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(r.dir, metaFile+".tmp")
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("saving batch: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(r.dir, metaFile))
+}
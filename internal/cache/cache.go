@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sweepInterval is how often expired entries are removed from disk
+const sweepInterval = 10 * time.Minute
+
+/*
+entry is a cached reply. It is also the format of each file in the disk directory.
+*/
+type entry struct {
+	Key     string    `json:"key"`
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+/*
+Stats reports how well the cache is doing, for /stats
+*/
+type Stats struct {
+	Entries int     `json:"entries"`
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+/*
+Cache is an exact-match cache of worker replies: an in-memory LRU, optionally backed by a directory
+so entries survive restarts and outlive LRU eviction. Entries expire after the TTL either way.
+*/
+type Cache struct {
+	capacity int
+	ttl      time.Duration
+	dir      string
+
+	mu    sync.Mutex
+	order *list.List               // most recently used at the front
+	items map[string]*list.Element // values are *entry
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+/*
+New creates a cache holding up to capacity entries in memory. With a non-empty dir, entries are also
+written to disk there.
+*/
+func New(capacity int, ttl time.Duration, dir string) (*Cache, error) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if dir != "" {
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Cache{
+		capacity: capacity,
+		ttl:      ttl,
+		dir:      dir,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}, nil
+}
+
+/*
+Start begins periodically removing expired entries from disk
+*/
+func (c *Cache) Start() {
+	if c.dir != "" {
+		go func() {
+			c.sweep()
+			ticker := time.NewTicker(sweepInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				c.sweep()
+			}
+		}()
+	}
+	log.Printf("Response cache enabled (%d entries, TTL %s, disk %q)", c.capacity, c.ttl, c.dir)
+}
+
+/*
+Key hashes the parts of a normalized request into a cache key
+*/
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+Get returns the cached reply for key, checking memory first and then disk
+*/
+func (c *Cache) Get(key string) (string, bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		if now.Before(e.Expires) {
+			c.order.MoveToFront(el)
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return e.Value, true
+		}
+		c.removeElement(el)
+	}
+	c.mu.Unlock()
+
+	e, ok := c.readDisk(key)
+	if !ok || !now.Before(e.Expires) {
+		c.misses.Add(1)
+		return "", false
+	}
+
+	c.mu.Lock()
+	c.insert(e)
+	c.mu.Unlock()
+	c.hits.Add(1)
+	return e.Value, true
+}
+
+/*
+Put stores a reply under key
+*/
+func (c *Cache) Put(key string, value string) {
+	e := &entry{Key: key, Value: value, Expires: time.Now().Add(c.ttl)}
+
+	c.mu.Lock()
+	c.insert(e)
+	c.mu.Unlock()
+
+	c.writeDisk(e)
+}
+
+/*
+Delete removes an entry from memory and disk
+*/
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	c.mu.Unlock()
+
+	if c.dir != "" {
+		_ = os.Remove(c.path(key))
+	}
+}
+
+/*
+Stats returns the entry count and hit rate since startup
+*/
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	entries := len(c.items)
+	c.mu.Unlock()
+
+	hits := c.hits.Load()
+	misses := c.misses.Load()
+	stats := Stats{Entries: entries, Hits: hits, Misses: misses}
+	if hits+misses > 0 {
+		stats.HitRate = float64(hits) / float64(hits+misses)
+	}
+	return stats
+}
+
+/*
+insert adds or replaces an entry in memory, evicting the least recently used past capacity.
+Evicted entries stay on disk. Callers hold c.mu.
+*/
+func (c *Cache) insert(e *entry) {
+	if el, ok := c.items[e.Key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[e.Key] = c.order.PushFront(e)
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry).Key)
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *Cache) readDisk(key string) (*entry, bool) {
+	if c.dir == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var e entry
+	if json.Unmarshal(data, &e) != nil || e.Key != key {
+		return nil, false
+	}
+	return &e, true
+}
+
+/*
+writeDisk saves an entry via a temp file and rename, so readers never see a partial file
+*/
+func (c *Cache) writeDisk(e *entry) {
+	if c.dir == "" {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(c.dir, e.Key+".*.tmp")
+	if err != nil {
+		log.Printf("Cache: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(e.Key))
+	}
+	if err != nil {
+		log.Printf("Cache: writing entry: %v", err)
+		_ = os.Remove(tmp.Name())
+	}
+}
+
+/*
+sweep deletes expired entries (and temp files left by a crash) from disk
+*/
+func (c *Cache) sweep() {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("Cache: %v", err)
+		return
+	}
+
+	now := time.Now()
+	removed := 0
+	for _, f := range files {
+		name := f.Name()
+		path := filepath.Join(c.dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			// skip temp files young enough to belong to a write in progress
+			info, err := f.Info()
+			if err == nil && now.Sub(info.ModTime()) > time.Minute {
+				_ = os.Remove(path)
+			}
+			continue
+		}
+		key, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			continue
+		}
+		e, ok := c.readDisk(key)
+		if !ok || !now.Before(e.Expires) {
+			_ = os.Remove(path)
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("Cache: removed %d expired entries from disk", removed)
+	}
+}
@@ -0,0 +1,521 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"gollama/internal"
+	"gollama/internal/pool"
+)
+
+// Coordination backends
+const (
+	BackendLocal = "local"
+	BackendRaft  = "raft"
+)
+
+// Replica failover tuning
+const (
+	hubDownAfter  = 30 * time.Second // a hub the leader hasn't heard from this long has its jobs adopted
+	watchInterval = 5 * time.Second
+)
+
+// forwardedHeader marks a request one hub proxied to another, so it's never proxied twice
+const forwardedHeader = "X-Gollama-Forwarded"
+
+// Commands
+const (
+	opNoop         = "noop"
+	opWorkerAdd    = "worker.add"
+	opWorkerRemove = "worker.remove"
+	opJobAdd       = "job.add"
+	opJobFinish    = "job.finish"
+	opJobRemove    = "job.remove"
+	opJobAdopt     = "job.adopt"
+)
+
+/*
+Command is one change to the state the hubs share. Every hub applies the same commands in the
+same order.
+  - Hub: the hub that owns a job being added, or the hub whose jobs are being adopted
+  - To: the hub adopting them
+*/
+type Command struct {
+	Op     string          `json:"op"`
+	Worker *WorkerRecord   `json:"worker,omitempty"`
+	Job    *pool.QueuedJob `json:"job,omitempty"`
+	ID     string          `json:"id,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Hub    string          `json:"hub,omitempty"`
+	To     string          `json:"to,omitempty"`
+}
+
+/*
+WorkerRecord is a worker registration as shared between hubs
+*/
+type WorkerRecord struct {
+	URL    string               `json:"url"`
+	Name   string               `json:"name"`
+	Models []internal.ModelInfo `json:"models,omitempty"`
+	Token  string               `json:"token"`
+}
+
+/*
+FSM is the state a Backend replicates. Apply must be deterministic: every hub applies the same
+commands and has to end up in the same state.
+*/
+type FSM interface {
+	Apply(cmd Command)
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+/*
+Backend replicates commands between hubs. Propose returns once the command has been committed and
+applied on this hub.
+*/
+type Backend interface {
+	Start(fsm FSM) error
+	Propose(cmd Command) error
+	Status() Status
+	// Handler serves the backend's routes under /cluster/, or is nil if it has none
+	Handler() http.Handler
+	Close() error
+}
+
+/*
+Status is a backend's view of the cluster. Ready means this hub has caught up with the cluster's
+state. Peers is only filled in on the leader.
+*/
+type Status struct {
+	ID     string       `json:"id"`
+	Role   string       `json:"role"`
+	Leader string       `json:"leader,omitempty"`
+	Term   int64        `json:"term,omitempty"`
+	Ready  bool         `json:"ready"`
+	Peers  []PeerStatus `json:"peers,omitempty"`
+}
+
+/*
+PeerStatus is when the leader last heard from another hub
+*/
+type PeerStatus struct {
+	ID          string     `json:"id"`
+	Up          bool       `json:"up"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+/*
+NewBackend creates the named coordination backend. self is the URL other hubs reach this one at.
+*/
+func NewBackend(kind string, self string, peers []string, secret string, dir string) (Backend, error) {
+	switch kind {
+	case BackendLocal:
+		return NewLocal(self), nil
+	case BackendRaft:
+		if secret == "" {
+			return nil, fmt.Errorf("the raft backend needs CLUSTER_SECRET so hubs can authenticate each other")
+		}
+		return NewRaft(self, peers, secret, dir), nil
+	default:
+		return nil, fmt.Errorf("unknown cluster backend %q (use %s or %s)", kind, BackendLocal, BackendRaft)
+	}
+}
+
+/*
+Node is this hub's copy of the state shared by all hub replicas: registered workers, and async jobs
+with the hub that runs each one. Worker registrations are applied to the local pool as they commit,
+so a worker that registers with any hub can be dispatched to from all of them. Node is the pool's
+Replicator and the job store's Queue.
+*/
+type Node struct {
+	id      string
+	backend Backend
+	pool    *pool.Pool
+
+	mu      sync.Mutex
+	workers map[string]WorkerRecord
+	jobs    *pool.MemoryQueue
+	owners  map[string]string // job ID -> hub running it
+	onAdopt func(pool.QueuedJob)
+}
+
+/*
+NewNode creates this hub's node. id is the URL other hubs reach this one at.
+*/
+func NewNode(id string, backend Backend, p *pool.Pool) *Node {
+	return &Node{
+		id:      id,
+		backend: backend,
+		pool:    p,
+		workers: make(map[string]WorkerRecord),
+		jobs:    pool.NewMemoryQueue(),
+		owners:  make(map[string]string),
+	}
+}
+
+/*
+OnAdopt sets what to do with jobs this hub takes over from a hub that went down: run them
+*/
+func (n *Node) OnAdopt(fn func(pool.QueuedJob)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.onAdopt = fn
+}
+
+/*
+Start joins the cluster and begins watching for hubs that go down
+*/
+func (n *Node) Start() error {
+	err := n.backend.Start(n)
+	if err != nil {
+		return err
+	}
+	go n.watchHubs()
+	return nil
+}
+
+/*
+WaitReady blocks until this hub has caught up with the cluster, or the timeout passes
+*/
+func (n *Node) WaitReady(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if n.backend.Status().Ready {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+/*
+Status returns the backend's view of the cluster
+*/
+func (n *Node) Status() Status {
+	return n.backend.Status()
+}
+
+/*
+Handler serves the backend's routes under /cluster/, and this hub's view of the cluster at /cluster
+*/
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if h := n.backend.Handler(); h != nil {
+		mux.Handle("/cluster/", h)
+	}
+	mux.HandleFunc("/cluster", func(w http.ResponseWriter, r *http.Request) {
+		n.mu.Lock()
+		workers, jobs := len(n.workers), len(n.owners)
+		n.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"node":    n.backend.Status(),
+			"workers": workers,
+			"jobs":    jobs,
+		})
+	})
+	return mux
+}
+
+/*
+ForwardJob sends requests for an async job to the hub running it, so any hub can answer for any job.
+If that hub can't be reached, the request is served here.
+*/
+func (n *Node) ForwardJob(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n.mu.Lock()
+		owner := n.owners[r.PathValue("id")]
+		n.mu.Unlock()
+
+		if owner == "" || owner == n.id || r.Header.Get(forwardedHeader) != "" {
+			next(w, r)
+			return
+		}
+		target, err := url.Parse(owner)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Forwarding job request to %s failed: %v", owner, err)
+			r.Header.Del(forwardedHeader)
+			next(w, r)
+		}
+		r.Header.Set(forwardedHeader, n.id)
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+/*
+ReplicateWorker registers a worker on every hub
+*/
+func (n *Node) ReplicateWorker(url string, name string, models []internal.ModelInfo, token string) error {
+	return n.backend.Propose(Command{
+		Op:     opWorkerAdd,
+		Worker: &WorkerRecord{URL: url, Name: name, Models: models, Token: token},
+	})
+}
+
+/*
+ReplicateRemoval removes a worker from every hub
+*/
+func (n *Node) ReplicateRemoval(url string) error {
+	return n.backend.Propose(Command{Op: opWorkerRemove, ID: url})
+}
+
+/*
+Add stores a job as owned by this hub; see pool.Queue
+*/
+func (n *Node) Add(job pool.QueuedJob) (pool.QueuedJob, bool, error) {
+	if job.Key != "" {
+		if existing, ok := n.jobs.Lookup(job.Key); ok {
+			return existing, false, nil
+		}
+	}
+
+	err := n.backend.Propose(Command{Op: opJobAdd, Job: &job, Hub: n.id})
+	if err != nil {
+		return pool.QueuedJob{}, false, err
+	}
+
+	// another hub may have added a job with the same key first; the log decided which one counts
+	if stored, ok := n.jobs.Get(job.ID); ok {
+		return stored, true, nil
+	}
+	if existing, ok := n.jobs.Lookup(job.Key); ok {
+		return existing, false, nil
+	}
+	return pool.QueuedJob{}, false, fmt.Errorf("job %s was not stored", job.ID)
+}
+
+func (n *Node) Finish(id string, data json.RawMessage) error {
+	return n.backend.Propose(Command{Op: opJobFinish, ID: id, Data: data})
+}
+
+func (n *Node) Remove(id string) error {
+	return n.backend.Propose(Command{Op: opJobRemove, ID: id})
+}
+
+/*
+Jobs returns the jobs this hub runs. Jobs on other hubs are theirs to restore.
+*/
+func (n *Node) Jobs() []pool.QueuedJob {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var jobs []pool.QueuedJob
+	for _, job := range n.jobs.Jobs() {
+		if n.owners[job.ID] == n.id {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+func (n *Node) Close() error {
+	return n.backend.Close()
+}
+
+/*
+Apply makes a committed command take effect on this hub
+*/
+func (n *Node) Apply(cmd Command) {
+	n.mu.Lock()
+	var adopted []pool.QueuedJob
+
+	switch cmd.Op {
+	case opWorkerAdd:
+		if cmd.Worker != nil {
+			n.workers[cmd.Worker.URL] = *cmd.Worker
+			defer n.addToPool(*cmd.Worker)
+		}
+	case opWorkerRemove:
+		delete(n.workers, cmd.ID)
+		defer n.pool.RemoveWorker(cmd.ID)
+	case opJobAdd:
+		if cmd.Job != nil {
+			if _, created, _ := n.jobs.Add(*cmd.Job); created {
+				n.owners[cmd.Job.ID] = cmd.Hub
+			}
+		}
+	case opJobFinish:
+		_ = n.jobs.Finish(cmd.ID, cmd.Data)
+	case opJobRemove:
+		_ = n.jobs.Remove(cmd.ID)
+		delete(n.owners, cmd.ID)
+	case opJobAdopt:
+		for _, job := range n.jobs.Jobs() {
+			if n.owners[job.ID] != cmd.Hub || job.Done {
+				continue
+			}
+			n.owners[job.ID] = cmd.To
+			if cmd.To == n.id {
+				adopted = append(adopted, job)
+			}
+		}
+		if len(adopted) > 0 {
+			log.Printf("Adopted %d async jobs from %s", len(adopted), cmd.Hub)
+		}
+	}
+
+	onAdopt := n.onAdopt
+	n.mu.Unlock()
+
+	// run outside the apply path: the job store may be waiting on a proposal of its own
+	if onAdopt != nil {
+		for _, job := range adopted {
+			go onAdopt(job)
+		}
+	}
+}
+
+/*
+nodeSnapshot is the shared state as a backend stores it in place of the commands that built it
+*/
+type nodeSnapshot struct {
+	Workers []WorkerRecord    `json:"workers"`
+	Jobs    []pool.QueuedJob  `json:"jobs"`
+	Owners  map[string]string `json:"owners"`
+}
+
+func (n *Node) Snapshot() ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	snap := nodeSnapshot{Jobs: n.jobs.Jobs(), Owners: n.owners}
+	for _, worker := range n.workers {
+		snap.Workers = append(snap.Workers, worker)
+	}
+	return json.Marshal(snap)
+}
+
+/*
+Restore replaces the shared state with a snapshot. Workers in it are added to the pool; workers the
+pool already has are left alone.
+*/
+func (n *Node) Restore(data []byte) error {
+	var snap nodeSnapshot
+	err := json.Unmarshal(data, &snap)
+	if err != nil {
+		return fmt.Errorf("reading cluster snapshot: %w", err)
+	}
+
+	n.mu.Lock()
+	n.workers = make(map[string]WorkerRecord)
+	for _, worker := range snap.Workers {
+		n.workers[worker.URL] = worker
+	}
+	for _, job := range n.jobs.Jobs() {
+		_ = n.jobs.Remove(job.ID)
+	}
+	for _, job := range snap.Jobs {
+		_, _, _ = n.jobs.Add(job)
+	}
+	n.owners = snap.Owners
+	if n.owners == nil {
+		n.owners = make(map[string]string)
+	}
+	n.mu.Unlock()
+
+	for _, worker := range snap.Workers {
+		n.addToPool(worker)
+	}
+	return nil
+}
+
+func (n *Node) addToPool(worker WorkerRecord) {
+	n.pool.AddWorker(worker.URL, worker.Name, worker.Models)
+	n.pool.SetWorkerToken(worker.URL, worker.Token)
+}
+
+/*
+watchHubs runs on every hub but only acts on the leader: when another hub has been unreachable for
+hubDownAfter, the leader takes over its unfinished async jobs
+*/
+func (n *Node) watchHubs() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		status := n.backend.Status()
+		if status.Role != roleLeader {
+			continue
+		}
+		for _, peer := range status.Peers {
+			if peer.Up || !n.hasUnfinishedJobs(peer.ID) {
+				continue
+			}
+			log.Printf("Hub %s is down, taking over its async jobs", peer.ID)
+			err := n.backend.Propose(Command{Op: opJobAdopt, Hub: peer.ID, To: n.id})
+			if err != nil {
+				log.Printf("Failed to adopt jobs from %s: %v", peer.ID, err)
+			}
+		}
+	}
+}
+
+func (n *Node) hasUnfinishedJobs(hub string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, job := range n.jobs.Jobs() {
+		if n.owners[job.ID] == hub && !job.Done {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Local is a Backend for a single hub: commands apply as soon as they're proposed. It keeps nothing
+on disk.
+*/
+type Local struct {
+	id  string
+	mu  sync.Mutex
+	fsm FSM
+}
+
+/*
+NewLocal creates a single-hub backend
+*/
+func NewLocal(id string) *Local {
+	return &Local{id: id}
+}
+
+func (l *Local) Start(fsm FSM) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fsm = fsm
+	return nil
+}
+
+func (l *Local) Propose(cmd Command) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fsm == nil {
+		return fmt.Errorf("cluster backend not started")
+	}
+	l.fsm.Apply(cmd)
+	return nil
+}
+
+func (l *Local) Status() Status {
+	return Status{ID: l.id, Role: roleLeader, Leader: l.id, Ready: true}
+}
+
+func (l *Local) Handler() http.Handler {
+	return nil
+}
+
+func (l *Local) Close() error {
+	return nil
+}
@@ -0,0 +1,1208 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Raft roles
+const (
+	roleFollower  = "follower"
+	roleCandidate = "candidate"
+	roleLeader    = "leader"
+)
+
+// Raft timing and limits
+const (
+	heartbeatInterval  = 200 * time.Millisecond
+	minElectionTimeout = time.Second // randomised up to twice this
+	rpcTimeout         = time.Second
+	proposeTimeout     = 10 * time.Second
+	maxAppendEntries   = 500 // entries per append request
+)
+
+// snapshotEvery is how many applied entries go between snapshots; tests lower it
+var snapshotEvery int64 = 1000
+
+// Files in the raft directory
+const (
+	raftStateFile    = "raft-state.json"
+	raftLogFile      = "raft-log.jsonl"
+	raftSnapshotFile = "raft-snapshot.json"
+)
+
+/*
+entry is one command in the replicated log
+*/
+type entry struct {
+	Index int64   `json:"index"`
+	Term  int64   `json:"term"`
+	Cmd   Command `json:"cmd"`
+}
+
+/*
+waiter is a Propose waiting for its entry to be applied. It succeeds if the entry applied at index
+is from the term it was proposed in.
+*/
+type waiter struct {
+	term int64
+	done chan error
+}
+
+// Why a Propose didn't see its command commit
+var (
+	errLeaderChanged = errors.New("cluster leader changed before the command committed")
+	// a snapshot replaced the entry before this hub saw which command committed there; it may or
+	// may not have been this one, so the caller has to retry
+	errCommitUnknown = errors.New("cluster installed a snapshot before the command was seen to commit, retry")
+)
+
+/*
+Raft is an embedded Raft backend: hubs elect a leader among themselves, the leader orders every
+command in a log, and a command commits once most hubs have stored it. Hubs talk to each other over
+HTTP under /cluster/, authenticated with a shared secret. The membership is fixed: every hub is
+started with the same list of peers.
+
+The term, vote, log and latest snapshot are kept in dir, so a restarted hub rejoins with its state.
+*/
+type Raft struct {
+	id     string
+	peers  []string // every other hub
+	secret string
+	dir    string
+	client *http.Client
+
+	applyMu sync.Mutex // held while the FSM changes; taken before mu
+	fsm     FSM
+
+	mu          sync.Mutex
+	term        int64
+	votedFor    string
+	log         []entry // entries after the snapshot
+	snapIndex   int64
+	snapTerm    int64
+	commitIndex int64
+	lastApplied int64
+	logFile     *os.File
+
+	role      string
+	leader    string
+	deadline  time.Time // election timeout
+	readyAt   int64     // on the leader, index of its first entry this term; on a follower, the leader's commit index
+	heardTerm int64     // last term a follower heard from its leader
+
+	nextIndex   map[string]int64
+	matchIndex  map[string]int64
+	lastContact map[string]time.Time
+	inflight    map[string]bool
+	waiters     map[int64][]waiter
+
+	applyCh chan struct{}
+	stop    chan struct{}
+}
+
+/*
+NewRaft creates a Raft backend. peers may include self; it's skipped.
+*/
+func NewRaft(self string, peers []string, secret string, dir string) *Raft {
+	r := &Raft{
+		id:          self,
+		secret:      secret,
+		dir:         dir,
+		client:      &http.Client{Timeout: rpcTimeout},
+		role:        roleFollower,
+		nextIndex:   make(map[string]int64),
+		matchIndex:  make(map[string]int64),
+		lastContact: make(map[string]time.Time),
+		inflight:    make(map[string]bool),
+		waiters:     make(map[int64][]waiter),
+		applyCh:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	for _, peer := range peers {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer != "" && peer != self {
+			r.peers = append(r.peers, peer)
+		}
+	}
+	return r
+}
+
+/*
+Start loads the hub's saved state into fsm and begins taking part in elections
+*/
+func (r *Raft) Start(fsm FSM) error {
+	r.fsm = fsm
+	err := os.MkdirAll(r.dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("creating cluster directory: %w", err)
+	}
+	err = r.load()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.resetDeadline()
+	r.mu.Unlock()
+
+	go r.tick()
+	go r.applyLoop()
+	log.Printf("Cluster: raft node %s started with %d peers (term %d, %d log entries)", r.id, len(r.peers), r.term, len(r.log))
+	return nil
+}
+
+/*
+Propose commits a command and waits until this hub has applied it. A follower hands the command to
+the leader.
+*/
+func (r *Raft) Propose(cmd Command) error {
+	r.mu.Lock()
+	if r.role == roleLeader {
+		index, term, err := r.appendLocked(cmd)
+		if err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		done := r.waitLocked(index, term)
+		r.mu.Unlock()
+		r.broadcast()
+		return r.await(done)
+	}
+	leader := r.leader
+	r.mu.Unlock()
+
+	if leader == "" {
+		return fmt.Errorf("no cluster leader elected")
+	}
+	var resp proposeResponse
+	err := r.call(leader, "/cluster/propose", cmd, &resp, proposeTimeout)
+	if err != nil {
+		return fmt.Errorf("proposing to leader %s: %w", leader, err)
+	}
+	err = r.wait(resp.Index, resp.Term)
+	if errors.Is(err, errCommitUnknown) {
+		// the leader only answers once the command has committed, so a snapshot covering it
+		// includes it
+		return nil
+	}
+	return err
+}
+
+func (r *Raft) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := Status{
+		ID:     r.id,
+		Role:   r.role,
+		Leader: r.leader,
+		Term:   r.term,
+		Ready:  r.readyLocked(),
+	}
+	if r.role == roleLeader {
+		for _, peer := range r.peers {
+			contact := r.lastContact[peer]
+			status.Peers = append(status.Peers, PeerStatus{
+				ID:          peer,
+				Up:          time.Since(contact) < hubDownAfter,
+				LastContact: &contact,
+			})
+		}
+	}
+	return status
+}
+
+func (r *Raft) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster/vote", r.authorized(r.handleVote))
+	mux.HandleFunc("/cluster/append", r.authorized(r.handleAppend))
+	mux.HandleFunc("/cluster/snapshot", r.authorized(r.handleSnapshot))
+	mux.HandleFunc("/cluster/propose", r.authorized(r.handleProposal))
+	return mux
+}
+
+func (r *Raft) Close() error {
+	close(r.stop)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.logFile != nil {
+		return r.logFile.Close()
+	}
+	return nil
+}
+
+/*
+tick drives elections and heartbeats
+*/
+func (r *Raft) tick() {
+	ticker := time.NewTicker(heartbeatInterval / 4)
+	defer ticker.Stop()
+	lastHeartbeat := time.Time{}
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			role, expired := r.role, now.After(r.deadline)
+			r.mu.Unlock()
+
+			if role == roleLeader {
+				if now.Sub(lastHeartbeat) >= heartbeatInterval {
+					lastHeartbeat = now
+					r.broadcast()
+				}
+			} else if expired {
+				r.campaign()
+			}
+		}
+	}
+}
+
+func (r *Raft) resetDeadline() {
+	timeout := minElectionTimeout + rand.N(minElectionTimeout)
+	r.deadline = time.Now().Add(timeout)
+}
+
+/*
+Elections
+*/
+
+type voteRequest struct {
+	Term         int64  `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex int64  `json:"last_log_index"`
+	LastLogTerm  int64  `json:"last_log_term"`
+}
+
+type voteResponse struct {
+	Term    int64 `json:"term"`
+	Granted bool  `json:"granted"`
+}
+
+/*
+campaign starts an election for the next term
+*/
+func (r *Raft) campaign() {
+	r.mu.Lock()
+	r.term++
+	r.role = roleCandidate
+	r.leader = ""
+	r.votedFor = r.id
+	r.resetDeadline()
+	err := r.saveState()
+	if err != nil {
+		log.Printf("Cluster: %v", err)
+	}
+	req := voteRequest{Term: r.term, Candidate: r.id, LastLogIndex: r.lastIndex(), LastLogTerm: r.lastTerm()}
+	r.mu.Unlock()
+
+	votes := 1
+	var votesMu sync.Mutex
+	won := func() {
+		votesMu.Lock()
+		defer votesMu.Unlock()
+		votes++
+		if votes == r.quorum() {
+			r.lead(req.Term)
+		}
+	}
+	if r.quorum() == 1 {
+		r.lead(req.Term)
+		return
+	}
+
+	for _, peer := range r.peers {
+		go func(peer string) {
+			var resp voteResponse
+			err := r.call(peer, "/cluster/vote", req, &resp, rpcTimeout)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			if resp.Term > r.term {
+				r.stepDown(resp.Term)
+			}
+			r.mu.Unlock()
+			if resp.Granted {
+				won()
+			}
+		}(peer)
+	}
+}
+
+/*
+lead makes this hub the leader for term, if it's still campaigning in it
+*/
+func (r *Raft) lead(term int64) {
+	r.mu.Lock()
+	if r.role != roleCandidate || r.term != term {
+		r.mu.Unlock()
+		return
+	}
+	r.role = roleLeader
+	r.leader = r.id
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+		r.lastContact[peer] = time.Now() // peers get hubDownAfter from now to check in
+	}
+
+	// an entry from this term lets earlier entries commit, and marks when the leader is caught up
+	index, _, err := r.appendLocked(Command{Op: opNoop})
+	if err != nil {
+		log.Printf("Cluster: %v", err)
+	}
+	r.readyAt = index
+	r.mu.Unlock()
+
+	log.Printf("Cluster: %s elected leader for term %d", r.id, term)
+	r.broadcast()
+}
+
+/*
+stepDown returns to following, moving to a newer term if one was seen. Callers hold r.mu.
+*/
+func (r *Raft) stepDown(term int64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		err := r.saveState()
+		if err != nil {
+			log.Printf("Cluster: %v", err)
+		}
+	}
+	if r.role == roleLeader {
+		log.Printf("Cluster: %s is no longer leader (term %d)", r.id, r.term)
+	}
+	r.role = roleFollower
+	r.resetDeadline()
+}
+
+func (r *Raft) handleVote(w http.ResponseWriter, req *http.Request) {
+	var vote voteRequest
+	err := json.NewDecoder(req.Body).Decode(&vote)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	if vote.Term > r.term {
+		r.stepDown(vote.Term)
+	}
+	upToDate := vote.LastLogTerm > r.lastTerm() ||
+		(vote.LastLogTerm == r.lastTerm() && vote.LastLogIndex >= r.lastIndex())
+	granted := vote.Term == r.term && upToDate && (r.votedFor == "" || r.votedFor == vote.Candidate)
+	if granted {
+		r.votedFor = vote.Candidate
+		err = r.saveState()
+		if err != nil {
+			log.Printf("Cluster: %v", err)
+			granted = false
+		}
+		r.resetDeadline()
+	}
+	resp := voteResponse{Term: r.term, Granted: granted}
+	r.mu.Unlock()
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+/*
+Replication
+*/
+
+type appendRequest struct {
+	Term         int64   `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex int64   `json:"prev_log_index"`
+	PrevLogTerm  int64   `json:"prev_log_term"`
+	Entries      []entry `json:"entries,omitempty"`
+	LeaderCommit int64   `json:"leader_commit"`
+}
+
+type appendResponse struct {
+	Term      int64 `json:"term"`
+	Success   bool  `json:"success"`
+	LastIndex int64 `json:"last_index"` // where the leader should look next when Success is false
+}
+
+type snapshotRequest struct {
+	Term   int64           `json:"term"`
+	Leader string          `json:"leader"`
+	Index  int64           `json:"index"`
+	Of     int64           `json:"of_term"`
+	Data   json.RawMessage `json:"data"`
+}
+
+/*
+broadcast sends every peer the entries it's missing, or a heartbeat if it has them all
+*/
+func (r *Raft) broadcast() {
+	if len(r.peers) == 0 {
+		r.mu.Lock()
+		r.advanceCommit()
+		r.mu.Unlock()
+		return
+	}
+	for _, peer := range r.peers {
+		go r.replicate(peer)
+	}
+}
+
+func (r *Raft) replicate(peer string) {
+	r.mu.Lock()
+	if r.role != roleLeader || r.inflight[peer] {
+		r.mu.Unlock()
+		return
+	}
+	r.inflight[peer] = true
+	defer func() {
+		r.mu.Lock()
+		r.inflight[peer] = false
+		r.mu.Unlock()
+	}()
+
+	term := r.term
+	next := r.nextIndex[peer]
+	if next <= r.snapIndex {
+		r.mu.Unlock()
+		r.sendSnapshot(peer, term)
+		return
+	}
+
+	req := appendRequest{
+		Term:         term,
+		Leader:       r.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.termAt(next - 1),
+		LeaderCommit: r.commitIndex,
+	}
+	for i := next; i <= r.lastIndex() && len(req.Entries) < maxAppendEntries; i++ {
+		req.Entries = append(req.Entries, r.entryAt(i))
+	}
+	r.mu.Unlock()
+
+	var resp appendResponse
+	err := r.call(peer, "/cluster/append", req, &resp, rpcTimeout)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resp.Term > r.term {
+		r.stepDown(resp.Term)
+		return
+	}
+	if r.role != roleLeader || r.term != term {
+		return
+	}
+	r.lastContact[peer] = time.Now()
+	if resp.Success {
+		match := req.PrevLogIndex + int64(len(req.Entries))
+		r.matchIndex[peer] = max(r.matchIndex[peer], match)
+		r.nextIndex[peer] = r.matchIndex[peer] + 1
+		r.advanceCommit()
+		return
+	}
+	r.nextIndex[peer] = max(1, min(next-1, resp.LastIndex+1))
+}
+
+func (r *Raft) sendSnapshot(peer string, term int64) {
+	data, err := os.ReadFile(filepath.Join(r.dir, raftSnapshotFile))
+	if err != nil {
+		log.Printf("Cluster: reading snapshot for %s: %v", peer, err)
+		return
+	}
+	var saved snapshotFile
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		log.Printf("Cluster: reading snapshot for %s: %v", peer, err)
+		return
+	}
+
+	req := snapshotRequest{Term: term, Leader: r.id, Index: saved.Index, Of: saved.Term, Data: saved.Data}
+	var resp appendResponse
+	err = r.call(peer, "/cluster/snapshot", req, &resp, proposeTimeout)
+	if err != nil {
+		log.Printf("Cluster: sending snapshot to %s: %v", peer, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resp.Term > r.term {
+		r.stepDown(resp.Term)
+		return
+	}
+	if r.role != roleLeader || r.term != term {
+		return
+	}
+	r.lastContact[peer] = time.Now()
+	r.matchIndex[peer] = max(r.matchIndex[peer], saved.Index)
+	r.nextIndex[peer] = r.matchIndex[peer] + 1
+}
+
+/*
+advanceCommit commits the newest entry from this term that most hubs have stored. Callers hold r.mu.
+*/
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if r.termAt(n) != r.term {
+			break
+		}
+		count := 1
+		for _, peer := range r.peers {
+			if r.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.commitIndex = n
+			r.signalApply()
+			return
+		}
+	}
+}
+
+func (r *Raft) handleAppend(w http.ResponseWriter, req *http.Request) {
+	var msg appendRequest
+	err := json.NewDecoder(req.Body).Decode(&msg)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp := appendResponse{Term: r.term}
+	if msg.Term < r.term {
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if msg.Term > r.term || r.role != roleFollower {
+		r.stepDown(msg.Term)
+	}
+	r.resetDeadline()
+	r.leader = msg.Leader
+	resp.Term = r.term
+
+	// the log must hold the entry the new ones follow
+	if msg.PrevLogIndex > r.lastIndex() {
+		resp.LastIndex = r.lastIndex()
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if msg.PrevLogIndex > r.snapIndex && r.termAt(msg.PrevLogIndex) != msg.PrevLogTerm {
+		resp.LastIndex = msg.PrevLogIndex - 1
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	var added []entry
+	rewrite := false
+	for _, e := range msg.Entries {
+		if e.Index <= r.snapIndex {
+			continue
+		}
+		if e.Index <= r.lastIndex() {
+			if r.termAt(e.Index) == e.Term {
+				continue
+			}
+			// a conflicting entry was never committed; drop it and everything after
+			r.log = r.log[:e.Index-r.snapIndex-1]
+			rewrite = true
+		}
+		r.log = append(r.log, e)
+		added = append(added, e)
+	}
+	if rewrite {
+		err = r.rewriteLog()
+	} else {
+		err = r.appendLog(added...)
+	}
+	if err != nil {
+		log.Printf("Cluster: %v", err)
+		resp.LastIndex = msg.PrevLogIndex
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	last := msg.PrevLogIndex + int64(len(msg.Entries))
+	if msg.LeaderCommit > r.commitIndex {
+		r.commitIndex = min(msg.LeaderCommit, last)
+		r.signalApply()
+	}
+	r.heardTerm = r.term
+	r.readyAt = msg.LeaderCommit
+
+	resp.Success = true
+	resp.LastIndex = r.lastIndex()
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (r *Raft) handleSnapshot(w http.ResponseWriter, req *http.Request) {
+	var snap snapshotRequest
+	err := json.NewDecoder(req.Body).Decode(&snap)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := appendResponse{Term: r.term}
+	if snap.Term < r.term {
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if snap.Term > r.term || r.role != roleFollower {
+		r.stepDown(snap.Term)
+	}
+	r.resetDeadline()
+	r.leader = snap.Leader
+	resp.Term = r.term
+
+	if snap.Index > r.snapIndex {
+		err = r.fsm.Restore(snap.Data)
+		if err == nil {
+			err = r.saveSnapshot(snap.Index, snap.Of, snap.Data)
+		}
+		if err != nil {
+			log.Printf("Cluster: installing snapshot: %v", err)
+			http.Error(w, "Installing snapshot failed", http.StatusInternalServerError)
+			return
+		}
+
+		// keep entries after the snapshot only if the log agrees with it
+		if snap.Index < r.lastIndex() && r.termAt(snap.Index) == snap.Of {
+			r.log = r.log[snap.Index-r.snapIndex:]
+		} else {
+			r.log = nil
+		}
+		r.snapIndex, r.snapTerm = snap.Index, snap.Of
+		r.commitIndex = max(r.commitIndex, snap.Index)
+		r.lastApplied = snap.Index
+		r.notify(snap.Index)
+		err = r.rewriteLog()
+		if err != nil {
+			log.Printf("Cluster: %v", err)
+		}
+		log.Printf("Cluster: installed snapshot at index %d from %s", snap.Index, snap.Leader)
+	}
+	r.heardTerm = r.term
+	r.readyAt = snap.Index
+
+	resp.Success = true
+	resp.LastIndex = r.lastIndex()
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+/*
+Proposals
+*/
+
+type proposeResponse struct {
+	Index int64 `json:"index"`
+	Term  int64 `json:"term"`
+}
+
+/*
+handleProposal commits a command for a follower. It answers once the command has been applied here,
+with the entry's position so the follower can wait for it too.
+*/
+func (r *Raft) handleProposal(w http.ResponseWriter, req *http.Request) {
+	var cmd Command
+	err := json.NewDecoder(req.Body).Decode(&cmd)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	if r.role != roleLeader {
+		r.mu.Unlock()
+		http.Error(w, "Not the cluster leader", http.StatusMisdirectedRequest)
+		return
+	}
+	index, term, err := r.appendLocked(cmd)
+	if err != nil {
+		r.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	done := r.waitLocked(index, term)
+	r.mu.Unlock()
+
+	r.broadcast()
+	err = r.await(done)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(proposeResponse{Index: index, Term: term})
+}
+
+/*
+appendLocked adds a command to the leader's log. Callers hold r.mu.
+*/
+func (r *Raft) appendLocked(cmd Command) (int64, int64, error) {
+	e := entry{Index: r.lastIndex() + 1, Term: r.term, Cmd: cmd}
+	err := r.appendLog(e)
+	if err != nil {
+		return 0, 0, err
+	}
+	r.log = append(r.log, e)
+	return e.Index, e.Term, nil
+}
+
+/*
+wait blocks until the entry at index is applied here, failing if a different entry took its place or
+a snapshot covered it before it could be checked
+*/
+func (r *Raft) wait(index int64, term int64) error {
+	r.mu.Lock()
+	done := r.waitLocked(index, term)
+	r.mu.Unlock()
+	return r.await(done)
+}
+
+/*
+waitLocked registers a waiter for the entry at index. The leader registers in the same critical
+section as it appends, so the entry can't be applied and compacted away unseen. Callers hold r.mu.
+*/
+func (r *Raft) waitLocked(index int64, term int64) chan error {
+	done := make(chan error, 1)
+	if r.lastApplied >= index {
+		done <- r.outcome(index, term)
+		return done
+	}
+	r.waiters[index] = append(r.waiters[index], waiter{term: term, done: done})
+	return done
+}
+
+func (r *Raft) await(done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(proposeTimeout):
+		return fmt.Errorf("timed out waiting for the cluster to commit")
+	}
+}
+
+/*
+notify wakes the waiters for applied entries up to index. Callers hold r.mu.
+*/
+func (r *Raft) notify(index int64) {
+	for i, waiters := range r.waiters {
+		if i > index {
+			continue
+		}
+		for _, w := range waiters {
+			w.done <- r.outcome(i, w.term)
+		}
+		delete(r.waiters, i)
+	}
+}
+
+/*
+outcome reports whether the applied entry at index is the one proposed in term. Once a snapshot
+covers index the entry is gone and there's no telling. Callers hold r.mu.
+*/
+func (r *Raft) outcome(index int64, term int64) error {
+	switch {
+	case index <= r.snapIndex:
+		return errCommitUnknown
+	case r.termAt(index) != term:
+		return errLeaderChanged
+	}
+	return nil
+}
+
+/*
+Applying
+*/
+
+func (r *Raft) signalApply() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+/*
+applyLoop feeds committed entries to the FSM in order, and snapshots it every snapshotEvery entries
+*/
+func (r *Raft) applyLoop() {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.applyCh:
+		}
+		for r.applyNext() {
+		}
+	}
+}
+
+func (r *Raft) applyNext() bool {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.Lock()
+	if r.lastApplied >= r.commitIndex {
+		r.mu.Unlock()
+		return false
+	}
+	e := r.entryAt(r.lastApplied + 1)
+	r.mu.Unlock()
+
+	r.fsm.Apply(e.Cmd)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastApplied = e.Index
+	r.notify(e.Index)
+
+	if r.lastApplied-r.snapIndex >= snapshotEvery {
+		err := r.compact()
+		if err != nil {
+			log.Printf("Cluster: %v", err)
+		}
+	}
+	return true
+}
+
+/*
+compact snapshots the FSM and drops the log entries it covers. Callers hold applyMu and r.mu.
+*/
+func (r *Raft) compact() error {
+	data, err := r.fsm.Snapshot()
+	if err != nil {
+		return fmt.Errorf("snapshotting cluster state: %w", err)
+	}
+	index, term := r.lastApplied, r.termAt(r.lastApplied)
+	err = r.saveSnapshot(index, term, data)
+	if err != nil {
+		return err
+	}
+	r.log = r.log[index-r.snapIndex:]
+	r.snapIndex, r.snapTerm = index, term
+	return r.rewriteLog()
+}
+
+/*
+Log helpers. Callers hold r.mu.
+*/
+
+func (r *Raft) lastIndex() int64 {
+	return r.snapIndex + int64(len(r.log))
+}
+
+func (r *Raft) lastTerm() int64 {
+	return r.termAt(r.lastIndex())
+}
+
+func (r *Raft) termAt(index int64) int64 {
+	if index == r.snapIndex {
+		return r.snapTerm
+	}
+	if index < r.snapIndex || index > r.lastIndex() {
+		return 0
+	}
+	return r.log[index-r.snapIndex-1].Term
+}
+
+func (r *Raft) entryAt(index int64) entry {
+	return r.log[index-r.snapIndex-1]
+}
+
+func (r *Raft) quorum() int {
+	return (len(r.peers)+1)/2 + 1
+}
+
+func (r *Raft) readyLocked() bool {
+	switch r.role {
+	case roleLeader:
+		return r.lastApplied >= r.readyAt
+	case roleFollower:
+		return r.heardTerm == r.term && r.lastApplied >= r.readyAt
+	default:
+		return false
+	}
+}
+
+/*
+Transport
+*/
+
+/*
+authorized only lets through requests carrying the cluster secret
+*/
+func (r *Raft) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(r.secret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, req)
+	}
+}
+
+/*
+call POSTs a request to another hub and decodes its JSON reply
+*/
+func (r *Raft) call(peer string, path string, req interface{}, resp interface{}, timeout time.Duration) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest("POST", peer+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+r.secret)
+
+	client := r.client
+	if timeout != rpcTimeout {
+		client = &http.Client{Transport: r.client.Transport, Timeout: timeout}
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 512))
+		return fmt.Errorf("%s returned %d: %s", peer, httpResp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+/*
+Persistence. Callers hold r.mu (or own r exclusively, as load does).
+*/
+
+type stateFile struct {
+	Term     int64  `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+type snapshotFile struct {
+	Index int64           `json:"index"`
+	Term  int64           `json:"term"`
+	Data  json.RawMessage `json:"data"`
+}
+
+/*
+load restores the term, vote, snapshot and log from disk
+*/
+func (r *Raft) load() error {
+	var state stateFile
+	err := readJSON(filepath.Join(r.dir, raftStateFile), &state)
+	if err != nil {
+		return err
+	}
+	r.term, r.votedFor = state.Term, state.VotedFor
+
+	var snap snapshotFile
+	err = readJSON(filepath.Join(r.dir, raftSnapshotFile), &snap)
+	if err != nil {
+		return err
+	}
+	if snap.Index > 0 {
+		err = r.fsm.Restore(snap.Data)
+		if err != nil {
+			return err
+		}
+		r.snapIndex, r.snapTerm = snap.Index, snap.Term
+		r.commitIndex, r.lastApplied = snap.Index, snap.Index
+	}
+
+	err = r.readLog()
+	if err != nil {
+		return err
+	}
+	return r.rewriteLog()
+}
+
+/*
+readLog reads the log entries after the snapshot. It stops at a line that can't be parsed (the tail
+of a write cut off by a crash) or that doesn't follow on from the one before.
+*/
+func (r *Raft) readLog() error {
+	f, err := os.Open(filepath.Join(r.dir, raftLogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening raft log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e entry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			log.Printf("Cluster: ignoring unreadable raft log entry after index %d", r.lastIndex())
+			return nil
+		}
+		if e.Index <= r.snapIndex {
+			continue
+		}
+		if e.Index != r.lastIndex()+1 {
+			log.Printf("Cluster: ignoring raft log entries from index %d", e.Index)
+			return nil
+		}
+		r.log = append(r.log, e)
+	}
+	return scanner.Err()
+}
+
+/*
+appendLog writes entries to the end of the log file and syncs it
+*/
+func (r *Raft) appendLog(entries ...entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encoding raft log entry: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	_, err := r.logFile.Write(buf.Bytes())
+	if err == nil {
+		err = r.logFile.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("writing raft log: %w", err)
+	}
+	return nil
+}
+
+/*
+rewriteLog replaces the log file with the entries in memory, then reopens it for appending
+*/
+func (r *Raft) rewriteLog() error {
+	var buf bytes.Buffer
+	for _, e := range r.log {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encoding raft log entry: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	path := filepath.Join(r.dir, raftLogFile)
+	err := writeAtomic(path, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("rewriting raft log: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("reopening raft log: %w", err)
+	}
+	if r.logFile != nil {
+		r.logFile.Close()
+	}
+	r.logFile = file
+	return nil
+}
+
+func (r *Raft) saveState() error {
+	data, _ := json.Marshal(stateFile{Term: r.term, VotedFor: r.votedFor})
+	err := writeAtomic(filepath.Join(r.dir, raftStateFile), data)
+	if err != nil {
+		return fmt.Errorf("saving raft state: %w", err)
+	}
+	return nil
+}
+
+func (r *Raft) saveSnapshot(index int64, term int64, data []byte) error {
+	encoded, err := json.Marshal(snapshotFile{Index: index, Term: term, Data: data})
+	if err != nil {
+		return fmt.Errorf("encoding raft snapshot: %w", err)
+	}
+	err = writeAtomic(filepath.Join(r.dir, raftSnapshotFile), encoded)
+	if err != nil {
+		return fmt.Errorf("saving raft snapshot: %w", err)
+	}
+	return nil
+}
+
+/*
+writeAtomic writes a file beside path and renames it over path, so a crash leaves one or the other
+intact
+*/
+func writeAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+/*
+readJSON decodes a file, leaving v as it is if the file doesn't exist
+*/
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+testFSM records the IDs of the commands applied to it, in order
+*/
+type testFSM struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+func (f *testFSM) Apply(cmd Command) {
+	if cmd.Op == opNoop {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = append(f.applied, cmd.ID)
+}
+
+func (f *testFSM) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.Marshal(f.applied)
+}
+
+func (f *testFSM) Restore(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = nil
+	return json.Unmarshal(data, &f.applied)
+}
+
+func (f *testFSM) IDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.applied)
+}
+
+/*
+network carries requests between the hubs of a test cluster, and can cut the link between any two
+*/
+type network struct {
+	mu  sync.Mutex
+	cut map[[2]string]bool
+}
+
+/*
+isolate cuts a hub off from every other, or reconnects it
+*/
+func (n *network) isolate(id string, nodes []*testNode, cut bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, other := range nodes {
+		if other.id != id {
+			n.cut[[2]string{id, other.id}] = cut
+			n.cut[[2]string{other.id, id}] = cut
+		}
+	}
+}
+
+/*
+link is one hub's end of the network
+*/
+type link struct {
+	net  *network
+	from string
+}
+
+func (l link) RoundTrip(req *http.Request) (*http.Response, error) {
+	l.net.mu.Lock()
+	cut := l.net.cut[[2]string{l.from, "http://" + req.URL.Host}]
+	l.net.mu.Unlock()
+	if cut {
+		return nil, fmt.Errorf("partitioned from %s", req.URL.Host)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+type testNode struct {
+	id   string
+	raft *Raft
+	fsm  *testFSM
+}
+
+/*
+startCluster starts n raft hubs in this process, talking over HTTP through net
+*/
+func startCluster(t *testing.T, n int) ([]*testNode, *network) {
+	t.Helper()
+	net := &network{cut: make(map[[2]string]bool)}
+
+	var servers []*httptest.Server
+	var handlers []*http.Handler
+	var peers []string
+	for range n {
+		h := new(http.Handler)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			(*h).ServeHTTP(w, req)
+		}))
+		servers = append(servers, srv)
+		handlers = append(handlers, h)
+		peers = append(peers, srv.URL)
+	}
+
+	var nodes []*testNode
+	for i, srv := range servers {
+		r := NewRaft(srv.URL, peers, "secret", t.TempDir())
+		r.client.Transport = link{net: net, from: srv.URL}
+		*handlers[i] = r.Handler()
+		node := &testNode{id: srv.URL, raft: r, fsm: &testFSM{}}
+		err := r.Start(node.fsm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	t.Cleanup(func() {
+		for i, node := range nodes {
+			_ = node.raft.Close()
+			servers[i].Close()
+		}
+	})
+	return nodes, net
+}
+
+/*
+waitFor polls cond until it holds, failing the test after timeout
+*/
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+/*
+leaderAmong waits until exactly one of nodes leads and every one of them follows it
+*/
+func leaderAmong(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	var leader *testNode
+	waitFor(t, 10*time.Second, "a leader", func() bool {
+		leader = nil
+		for _, node := range nodes {
+			status := node.raft.Status()
+			if status.Role == roleLeader {
+				if leader != nil {
+					return false
+				}
+				leader = node
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, node := range nodes {
+			if node.raft.Status().Leader != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+func without(nodes []*testNode, skip *testNode) []*testNode {
+	var rest []*testNode
+	for _, node := range nodes {
+		if node != skip {
+			rest = append(rest, node)
+		}
+	}
+	return rest
+}
+
+/*
+converged waits until every node has applied exactly want
+*/
+func converged(t *testing.T, nodes []*testNode, want []string) {
+	t.Helper()
+	waitFor(t, 10*time.Second, "the hubs to converge", func() bool {
+		for _, node := range nodes {
+			if !slices.Equal(node.fsm.IDs(), want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRaftReplicatesFromLeaderAndFollowers(t *testing.T) {
+	nodes, _ := startCluster(t, 3)
+	leader := leaderAmong(t, nodes)
+	follower := without(nodes, leader)[0]
+
+	err := leader.raft.Propose(Command{Op: opJobRemove, ID: "a"})
+	if err != nil {
+		t.Fatalf("leader propose: %v", err)
+	}
+	err = follower.raft.Propose(Command{Op: opJobRemove, ID: "b"})
+	if err != nil {
+		t.Fatalf("follower propose: %v", err)
+	}
+	converged(t, nodes, []string{"a", "b"})
+}
+
+func TestRaftMinorityCannotCommit(t *testing.T) {
+	nodes, net := startCluster(t, 3)
+	leader := leaderAmong(t, nodes)
+	rest := without(nodes, leader)
+
+	net.isolate(leader.id, nodes, true)
+	newLeader := leaderAmong(t, rest)
+	if newLeader.raft.Status().Term <= leader.raft.Status().Term {
+		t.Fatalf("new leader's term %d isn't past the old one's %d", newLeader.raft.Status().Term, leader.raft.Status().Term)
+	}
+
+	// the majority side carries on
+	err := rest[0].raft.Propose(Command{Op: opJobRemove, ID: "majority"})
+	if err != nil {
+		t.Fatalf("majority propose: %v", err)
+	}
+	converged(t, rest, []string{"majority"})
+	if ids := leader.fsm.IDs(); len(ids) != 0 {
+		t.Fatalf("isolated hub applied %v", ids)
+	}
+
+	// once healed, the old leader follows the new one and catches up
+	net.isolate(leader.id, nodes, false)
+	waitFor(t, 10*time.Second, "the old leader to follow", func() bool {
+		status := leader.raft.Status()
+		return status.Role == roleFollower && status.Leader == newLeader.id
+	})
+	converged(t, nodes, []string{"majority"})
+}
+
+func TestRaftLeaderChangeMidProposal(t *testing.T) {
+	nodes, net := startCluster(t, 3)
+	leader := leaderAmong(t, nodes)
+	rest := without(nodes, leader)
+
+	// the isolated leader appends the command but can't commit it
+	net.isolate(leader.id, nodes, true)
+	result := make(chan error, 1)
+	go func() { result <- leader.raft.Propose(Command{Op: opJobRemove, ID: "lost"}) }()
+
+	leaderAmong(t, rest)
+	err := rest[0].raft.Propose(Command{Op: opJobRemove, ID: "kept"})
+	if err != nil {
+		t.Fatalf("majority propose: %v", err)
+	}
+	net.isolate(leader.id, nodes, false)
+
+	// the new leader's entries replace the uncommitted one, and the proposal says so
+	select {
+	case err := <-result:
+		if !errors.Is(err, errLeaderChanged) {
+			t.Fatalf("propose on the deposed leader returned %v, want %v", err, errLeaderChanged)
+		}
+	case <-time.After(2 * proposeTimeout):
+		t.Fatal("propose on the deposed leader never returned")
+	}
+	converged(t, nodes, []string{"kept"})
+}
+
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	saved := snapshotEvery
+	t.Cleanup(func() { snapshotEvery = saved }) // after the cluster stops
+	snapshotEvery = 5
+
+	nodes, net := startCluster(t, 3)
+	leader := leaderAmong(t, nodes)
+	rest := without(nodes, leader)
+
+	net.isolate(leader.id, nodes, true)
+	result := make(chan error, 1)
+	go func() { result <- leader.raft.Propose(Command{Op: opJobRemove, ID: "lost"}) }()
+
+	// the majority commits well past the old leader's entry and compacts its log
+	newLeader := leaderAmong(t, rest)
+	var want []string
+	for i := range 3 * snapshotEvery {
+		id := fmt.Sprintf("job-%d", i)
+		err := newLeader.raft.Propose(Command{Op: opJobRemove, ID: id})
+		if err != nil {
+			t.Fatalf("propose %s: %v", id, err)
+		}
+		want = append(want, id)
+	}
+	newLeader.raft.mu.Lock()
+	snapIndex := newLeader.raft.snapIndex
+	newLeader.raft.mu.Unlock()
+	if snapIndex == 0 {
+		t.Fatal("the new leader never took a snapshot")
+	}
+
+	// the old leader can only catch up from the snapshot, which hides what became of its entry
+	net.isolate(leader.id, nodes, false)
+	select {
+	case err := <-result:
+		if !errors.Is(err, errCommitUnknown) {
+			t.Fatalf("propose covered by a snapshot returned %v, want %v", err, errCommitUnknown)
+		}
+	case <-time.After(2 * proposeTimeout):
+		t.Fatal("propose on the deposed leader never returned")
+	}
+	converged(t, nodes, want)
+}
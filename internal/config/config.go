@@ -1,33 +1,412 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 )
 
 /*
-ServerConfig holds configuration for the GoLlama server
+ServerConfig holds configuration for the GoLlama server. Values are layered: defaults, then the
+optional TOML config file, then environment variables, then -set flags (see serverSettings).
 */
 type ServerConfig struct {
 	Port              int
+	DefaultMaxTokens  int
+	TLSCertFile       string
+	TLSKeyFile        string
+	AuthFile          string
+	TokenTTLHours     int
 	QueueSize         int
 	ConcurrentWorkers int
 	MaxRetries        int
-	DefaultMaxTokens  int
+	HedgePercentile   int
+	HedgeBudget       int
+	RetryBaseDelayMS  int
+	RetryMaxDelayMS   int
+	RetryBudget       int
+	TemplatesDir      string
+	JobRetentionMins  int
+	MaxAsyncJobs      int
+	BatchConcurrency  int
+	MaxBatchItems     int
+	MaxBatchBytes     int
+	WebhookSecret     string
+	WebhookPrivate    bool
+	QueueBackend      string
+	QueueDir          string
+	BatchDir          string
+	CacheEnabled      bool
+	CacheSize         int
+	CacheTTLSeconds   int
+	CacheDir          string
+	ClusterBackend    string
+	ClusterSelf       string
+	ClusterPeers      []string
+	ClusterSecret     string
+	ClusterDir        string
+	FederationConfig  string
+	FederationLedger  string
+	SpillAfter        int
+
+	path      string   // config file the values came from, if any
+	overrides []string // key=value pairs from -set
 }
 
 /*
-LoadServerConfig loads server configuration from environment variables with defaults
+setting is one server option: its key in the config file and for -set, the environment variable
+overriding it, and the ServerConfig field it fills. Reloadable settings take effect on SIGHUP;
+changing any other one needs a restart.
 */
-func LoadServerConfig() *ServerConfig {
+type setting struct {
+	key        string
+	env        string
+	reloadable bool
+	field      func(c *ServerConfig) interface{}
+}
+
+var serverSettings = []setting{
+	{"server.port", "GOLLAMA_PORT", false, func(c *ServerConfig) interface{} { return &c.Port }},
+	{"server.default_max_tokens", "DEFAULT_MAX_TOKENS", false, func(c *ServerConfig) interface{} { return &c.DefaultMaxTokens }},
+	{"tls.cert_file", "TLS_CERT_FILE", false, func(c *ServerConfig) interface{} { return &c.TLSCertFile }},
+	{"tls.key_file", "TLS_KEY_FILE", false, func(c *ServerConfig) interface{} { return &c.TLSKeyFile }},
+	{"auth.credentials_file", "AUTH_FILE", true, func(c *ServerConfig) interface{} { return &c.AuthFile }},
+	{"auth.token_ttl_hours", "TOKEN_TTL_HOURS", true, func(c *ServerConfig) interface{} { return &c.TokenTTLHours }},
+	{"pool.queue_size", "QUEUE_SIZE", false, func(c *ServerConfig) interface{} { return &c.QueueSize }},
+	{"pool.concurrent_workers", "CONCURRENT_WORKERS", false, func(c *ServerConfig) interface{} { return &c.ConcurrentWorkers }},
+	{"pool.max_retries", "MAX_RETRIES", true, func(c *ServerConfig) interface{} { return &c.MaxRetries }},
+	{"pool.hedge_percentile", "HEDGE_PERCENTILE", true, func(c *ServerConfig) interface{} { return &c.HedgePercentile }},
+	{"pool.hedge_budget_percent", "HEDGE_BUDGET_PERCENT", true, func(c *ServerConfig) interface{} { return &c.HedgeBudget }},
+	{"pool.retry_base_delay_ms", "RETRY_BASE_DELAY_MS", true, func(c *ServerConfig) interface{} { return &c.RetryBaseDelayMS }},
+	{"pool.retry_max_delay_ms", "RETRY_MAX_DELAY_MS", true, func(c *ServerConfig) interface{} { return &c.RetryMaxDelayMS }},
+	{"pool.retry_budget_percent", "RETRY_BUDGET_PERCENT", true, func(c *ServerConfig) interface{} { return &c.RetryBudget }},
+	{"templates.dir", "TEMPLATES_DIR", false, func(c *ServerConfig) interface{} { return &c.TemplatesDir }},
+	{"limits.job_retention_minutes", "JOB_RETENTION_MINUTES", false, func(c *ServerConfig) interface{} { return &c.JobRetentionMins }},
+	{"limits.max_async_jobs", "MAX_ASYNC_JOBS", false, func(c *ServerConfig) interface{} { return &c.MaxAsyncJobs }},
+	{"limits.batch_concurrency", "BATCH_CONCURRENCY", false, func(c *ServerConfig) interface{} { return &c.BatchConcurrency }},
+	{"limits.max_batch_items", "MAX_BATCH_ITEMS", true, func(c *ServerConfig) interface{} { return &c.MaxBatchItems }},
+	{"limits.max_batch_bytes", "MAX_BATCH_BYTES", true, func(c *ServerConfig) interface{} { return &c.MaxBatchBytes }},
+	{"jobs.webhook_secret", "WEBHOOK_SECRET", false, func(c *ServerConfig) interface{} { return &c.WebhookSecret }},
+	{"jobs.webhook_allow_private", "WEBHOOK_ALLOW_PRIVATE", false, func(c *ServerConfig) interface{} { return &c.WebhookPrivate }},
+	{"jobs.queue_backend", "QUEUE_BACKEND", false, func(c *ServerConfig) interface{} { return &c.QueueBackend }},
+	{"jobs.queue_dir", "QUEUE_DIR", false, func(c *ServerConfig) interface{} { return &c.QueueDir }},
+	{"jobs.batch_dir", "BATCH_DIR", false, func(c *ServerConfig) interface{} { return &c.BatchDir }},
+	{"cache.enabled", "CACHE_ENABLED", false, func(c *ServerConfig) interface{} { return &c.CacheEnabled }},
+	{"cache.size", "CACHE_SIZE", false, func(c *ServerConfig) interface{} { return &c.CacheSize }},
+	{"cache.ttl_seconds", "CACHE_TTL_SECONDS", false, func(c *ServerConfig) interface{} { return &c.CacheTTLSeconds }},
+	{"cache.dir", "CACHE_DIR", false, func(c *ServerConfig) interface{} { return &c.CacheDir }},
+	{"cluster.backend", "CLUSTER_BACKEND", false, func(c *ServerConfig) interface{} { return &c.ClusterBackend }},
+	{"cluster.self", "CLUSTER_SELF", false, func(c *ServerConfig) interface{} { return &c.ClusterSelf }},
+	{"cluster.peers", "CLUSTER_PEERS", false, func(c *ServerConfig) interface{} { return &c.ClusterPeers }},
+	{"cluster.secret", "CLUSTER_SECRET", false, func(c *ServerConfig) interface{} { return &c.ClusterSecret }},
+	{"cluster.dir", "CLUSTER_DIR", false, func(c *ServerConfig) interface{} { return &c.ClusterDir }},
+	{"federation.config", "FEDERATION_CONFIG", false, func(c *ServerConfig) interface{} { return &c.FederationConfig }},
+	{"federation.ledger", "FEDERATION_LEDGER", false, func(c *ServerConfig) interface{} { return &c.FederationLedger }},
+	{"federation.spill_after", "FEDERATION_SPILL_AFTER", true, func(c *ServerConfig) interface{} { return &c.SpillAfter }},
+}
+
+/*
+defaultServerConfig returns the settings used when neither the config file, the environment nor a
+flag gives one
+*/
+func defaultServerConfig() *ServerConfig {
 	return &ServerConfig{
-		Port:              getEnvInt("GOLLAMA_PORT", 9000),
-		QueueSize:         getEnvInt("QUEUE_SIZE", 5000),
-		ConcurrentWorkers: getEnvInt("CONCURRENT_WORKERS", 10),
-		MaxRetries:        getEnvInt("MAX_RETRIES", 3),
-		DefaultMaxTokens:  getEnvInt("DEFAULT_MAX_TOKENS", 100),
+		Port:              9000,
+		DefaultMaxTokens:  100,
+		AuthFile:          "DB/auth.json",
+		TokenTTLHours:     24,
+		QueueSize:         5000,
+		ConcurrentWorkers: 10,
+		MaxRetries:        3,
+		HedgePercentile:   0,
+		HedgeBudget:       5,
+		RetryBaseDelayMS:  200,
+		RetryMaxDelayMS:   5000,
+		RetryBudget:       20,
+		TemplatesDir:      "templates",
+		JobRetentionMins:  60,
+		MaxAsyncJobs:      64,
+		BatchConcurrency:  4,
+		MaxBatchItems:     50000,
+		MaxBatchBytes:     100 << 20,
+		QueueBackend:      "memory",
+		QueueDir:          "DB/queue",
+		BatchDir:          "DB/batches",
+		CacheEnabled:      true,
+		CacheSize:         1000,
+		CacheTTLSeconds:   3600,
+		ClusterDir:        "DB/cluster",
+		FederationLedger:  "DB/federation-ledger.json",
+		SpillAfter:        4,
+	}
+}
+
+/*
+LoadServerConfig builds the server configuration from defaults, the TOML file at path (skipped when
+empty), environment variables and overrides of the form "pool.max_retries=5", then validates it.
+Unknown keys and values that don't parse are errors rather than falling back to a default.
+*/
+func LoadServerConfig(path string, overrides []string) (*ServerConfig, error) {
+	cfg := defaultServerConfig()
+	cfg.path = path
+	cfg.overrides = overrides
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		entries, err := parseTOML(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, entry := range entries {
+			s, ok := findSetting(entry.key)
+			if !ok {
+				return nil, fmt.Errorf("%s: line %d: unknown setting %s", path, entry.line, entry.key)
+			}
+			err = s.setValue(cfg, entry.value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: line %d: %s: %w", path, entry.line, entry.key, err)
+			}
+		}
+	}
+
+	for _, s := range serverSettings {
+		if value := os.Getenv(s.env); value != "" {
+			err := s.setString(cfg, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, override := range overrides {
+		key, value, found := strings.Cut(override, "=")
+		s, ok := findSetting(strings.TrimSpace(key))
+		if !found || !ok {
+			return nil, fmt.Errorf("invalid override %q: expected a known setting as key=value", override)
+		}
+		err := s.setString(cfg, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.key, err)
+		}
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+/*
+Reload loads the configuration again from the same file and overrides, picking up edits to the
+file and the current environment
+*/
+func (c *ServerConfig) Reload() (*ServerConfig, error) {
+	return LoadServerConfig(c.path, c.overrides)
+}
+
+/*
+Path returns the config file the settings were read from, or "" when there is none
+*/
+func (c *ServerConfig) Path() string {
+	return c.path
+}
+
+/*
+Validate checks that every setting is in range and that files the hub needs at startup exist
+*/
+func (c *ServerConfig) Validate() error {
+	minimums := []struct {
+		key   string
+		value int
+		min   int
+	}{
+		{"server.port", c.Port, 1},
+		{"server.default_max_tokens", c.DefaultMaxTokens, 1},
+		{"auth.token_ttl_hours", c.TokenTTLHours, 1},
+		{"pool.queue_size", c.QueueSize, 1},
+		{"pool.concurrent_workers", c.ConcurrentWorkers, 1},
+		{"pool.max_retries", c.MaxRetries, 0},
+		{"pool.hedge_percentile", c.HedgePercentile, 0},
+		{"pool.hedge_budget_percent", c.HedgeBudget, 0},
+		{"pool.retry_base_delay_ms", c.RetryBaseDelayMS, 0},
+		{"pool.retry_max_delay_ms", c.RetryMaxDelayMS, 0},
+		{"pool.retry_budget_percent", c.RetryBudget, 0},
+		{"limits.job_retention_minutes", c.JobRetentionMins, 1},
+		{"limits.max_async_jobs", c.MaxAsyncJobs, 1},
+		{"limits.batch_concurrency", c.BatchConcurrency, 1},
+		{"limits.max_batch_items", c.MaxBatchItems, 1},
+		{"limits.max_batch_bytes", c.MaxBatchBytes, 1},
+		{"cache.size", c.CacheSize, 1},
+		{"cache.ttl_seconds", c.CacheTTLSeconds, 0},
+		{"federation.spill_after", c.SpillAfter, 0},
+	}
+	for _, m := range minimums {
+		if m.value < m.min {
+			return fmt.Errorf("%s must be at least %d, got %d", m.key, m.min, m.value)
+		}
+	}
+	if c.Port > 65535 {
+		return fmt.Errorf("server.port must be at most 65535, got %d", c.Port)
+	}
+	if c.HedgePercentile > 99 {
+		return fmt.Errorf("pool.hedge_percentile must be between 0 (off) and 99, got %d", c.HedgePercentile)
+	}
+	if c.HedgeBudget > 100 || c.RetryBudget > 100 {
+		return fmt.Errorf("pool.hedge_budget_percent and pool.retry_budget_percent must be at most 100")
+	}
+	if c.RetryMaxDelayMS < c.RetryBaseDelayMS {
+		return fmt.Errorf("pool.retry_max_delay_ms (%d) is less than pool.retry_base_delay_ms (%d)", c.RetryMaxDelayMS, c.RetryBaseDelayMS)
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.AuthFile == "" {
+		return fmt.Errorf("auth.credentials_file must be set")
+	}
+	files := []struct{ key, path string }{
+		{"tls.cert_file", c.TLSCertFile},
+		{"tls.key_file", c.TLSKeyFile},
+		{"auth.credentials_file", c.AuthFile},
+		{"federation.config", c.FederationConfig},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			return fmt.Errorf("%s: %w", f.key, err)
+		}
+	}
+
+	switch c.QueueBackend {
+	case "memory", "wal":
+	default:
+		return fmt.Errorf("jobs.queue_backend must be memory or wal, got %q", c.QueueBackend)
+	}
+	switch c.ClusterBackend {
+	case "", "local":
+	case "raft":
+		if c.ClusterSecret == "" {
+			return fmt.Errorf("cluster.secret must be set for the raft backend")
+		}
+	default:
+		return fmt.Errorf("cluster.backend must be local or raft, got %q", c.ClusterBackend)
+	}
+	if c.ClusterSelf != "" && !strings.HasPrefix(c.ClusterSelf, "http://") && !strings.HasPrefix(c.ClusterSelf, "https://") {
+		return fmt.Errorf("cluster.self must start with http:// or https://: %s", c.ClusterSelf)
+	}
+	return nil
+}
+
+/*
+Changes compares c with a newly loaded next and returns the keys of the settings that differ, split
+into those a reload applies and those that only take effect after a restart
+*/
+func (c *ServerConfig) Changes(next *ServerConfig) (reloadable []string, restart []string) {
+	for _, s := range serverSettings {
+		if reflect.DeepEqual(s.field(c), s.field(next)) {
+			continue
+		}
+		if s.reloadable {
+			reloadable = append(reloadable, s.key)
+		} else {
+			restart = append(restart, s.key)
+		}
+	}
+	return reloadable, restart
+}
+
+/*
+findSetting looks a setting up by its config file key
+*/
+func findSetting(key string) (setting, bool) {
+	for _, s := range serverSettings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+/*
+setValue stores a value parsed from the config file, checking it has the setting's type
+*/
+func (s setting) setValue(c *ServerConfig, value interface{}) error {
+	switch field := s.field(c).(type) {
+	case *int:
+		n, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("expected an integer")
+		}
+		*field = int(n)
+	case *string:
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string")
+		}
+		*field = str
+	case *bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("expected true or false")
+		}
+		*field = b
+	case *[]string:
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected an array of strings")
+		}
+		list := make([]string, 0, len(items))
+		for _, item := range items {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected an array of strings")
+			}
+			list = append(list, str)
+		}
+		*field = list
 	}
+	return nil
+}
+
+/*
+setString stores a value given as text, from an environment variable or -set. Lists are
+comma-separated.
+*/
+func (s setting) setString(c *ServerConfig, value string) error {
+	switch field := s.field(c).(type) {
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field = n
+	case *string:
+		*field = value
+	case *bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*field = b
+	case *[]string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field = list
+	}
+	return nil
 }
 
 /*
@@ -42,3 +421,26 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+/*
+getEnvString retrieves a string from environment variables or returns default
+*/
+func getEnvString(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+/*
+getEnvBool retrieves a boolean from environment variables or returns default
+*/
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+		log.Printf("Warning: Invalid value for %s, using default %v", key, defaultValue)
+	}
+	return defaultValue
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+tomlEntry is one key from a config file, named "table.key". value is a string, int64, bool or
+[]interface{} of those; line is where it was set, for error messages.
+*/
+type tomlEntry struct {
+	key   string
+	value interface{}
+	line  int
+}
+
+/*
+parseTOML parses the subset of TOML the hub's config file uses: [table] headers, and keys holding
+strings, integers, booleans or arrays of them. Entries come back in file order. Anything outside
+that subset, and any key or table given twice, is an error naming the line.
+*/
+func parseTOML(data string) ([]tomlEntry, error) {
+	var entries []tomlEntry
+	seen := make(map[string]bool)
+	tables := make(map[string]bool)
+	table := ""
+
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header %q", n, line)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if !isBareKey(name) {
+				return nil, fmt.Errorf("line %d: invalid table name %q", n, name)
+			}
+			if tables[name] {
+				return nil, fmt.Errorf("line %d: table [%s] defined twice", n, name)
+			}
+			tables[name] = true
+			table = name
+			continue
+		}
+
+		key, raw, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		raw = strings.TrimSpace(raw)
+		if !found || !isBareKey(key) {
+			return nil, fmt.Errorf("line %d: expected key = value, got %q", n, line)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: %s set twice", n, key)
+		}
+		seen[key] = true
+
+		// An array may carry on over the following lines until its brackets balance
+		for strings.HasPrefix(raw, "[") && !arrayClosed(raw) && i+1 < len(lines) {
+			i++
+			raw += " " + strings.TrimSpace(stripComment(lines[i]))
+		}
+
+		value, rest, err := parseTOMLValue(raw)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = fmt.Errorf("unexpected %q after value", strings.TrimSpace(rest))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", n, key, err)
+		}
+		entries = append(entries, tomlEntry{key: key, value: value, line: n})
+	}
+	return entries, nil
+}
+
+/*
+parseTOMLValue parses the value at the start of s and returns what follows it
+*/
+func parseTOMLValue(s string) (interface{}, string, error) {
+	switch {
+	case s == "":
+		return nil, "", fmt.Errorf("missing value")
+	case s[0] == '"':
+		return parseBasicString(s)
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case s[0] == '[':
+		return parseArray(s)
+	}
+
+	end := strings.IndexAny(s, ", ]\t")
+	if end < 0 {
+		end = len(s)
+	}
+	token, rest := s[:end], s[end:]
+	switch token {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	if strings.HasPrefix(token, "_") || strings.HasSuffix(token, "_") || strings.Contains(token, "__") {
+		return nil, "", fmt.Errorf("invalid value %q", token)
+	}
+	number, err := strconv.ParseInt(strings.ReplaceAll(token, "_", ""), 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid value %q (strings need quotes)", token)
+	}
+	return number, rest, nil
+}
+
+/*
+parseBasicString parses a double-quoted string with TOML's escapes
+*/
+func parseBasicString(s string) (interface{}, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), s[i+1:], nil
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		case i+1 >= len(s):
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+
+		i++
+		switch s[i] {
+		case '"', '\\':
+			b.WriteByte(s[i])
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'u':
+			if i+4 >= len(s) {
+				return nil, "", fmt.Errorf("invalid \\u escape")
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid \\u escape")
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			return nil, "", fmt.Errorf("invalid escape \\%c", s[i])
+		}
+	}
+	return nil, "", fmt.Errorf("unterminated string")
+}
+
+/*
+parseArray parses a bracketed, comma-separated list of values. A trailing comma is allowed.
+*/
+func parseArray(s string) (interface{}, string, error) {
+	items := []interface{}{}
+	rest := strings.TrimSpace(s[1:])
+	for {
+		if strings.HasPrefix(rest, "]") {
+			return items, rest[1:], nil
+		}
+		item, after, err := parseTOMLValue(rest)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, nested := item.([]interface{}); nested {
+			return nil, "", fmt.Errorf("nested arrays are not supported")
+		}
+		items = append(items, item)
+
+		rest = strings.TrimSpace(after)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, "", fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+/*
+stripComment drops a # comment from a line, leaving # inside strings alone
+*/
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && c == '#':
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return line
+}
+
+/*
+arrayClosed reports whether every [ in s outside strings has its ]
+*/
+func arrayClosed(s string) bool {
+	depth := 0
+	s = stripComment(s)
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+/*
+isBareKey reports whether s is a TOML bare key: letters, digits, _ and -
+*/
+func isBareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
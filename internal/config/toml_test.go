@@ -0,0 +1,119 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []tomlEntry
+	}{
+		{"empty", "", nil},
+		{"comments and blank lines", "# hub\n\n   # indented\n", nil},
+		{"top-level key", "port = 9000", []tomlEntry{{"port", int64(9000), 1}}},
+		{"table", "[server]\nport = 9000", []tomlEntry{{"server.port", int64(9000), 2}}},
+		{"table header spacing", "[ server ]\nport=1", []tomlEntry{{"server.port", int64(1), 2}}},
+		{"underscored integer", "[a]\nn = 1_000", []tomlEntry{{"a.n", int64(1000), 2}}},
+		{"negative integer", "[a]\nn = -5", []tomlEntry{{"a.n", int64(-5), 2}}},
+		{"booleans", "[a]\nx = true\ny = false", []tomlEntry{{"a.x", true, 2}, {"a.y", false, 3}}},
+		{"basic string", `[a]` + "\n" + `s = "hub one"`, []tomlEntry{{"a.s", "hub one", 2}}},
+		{"escapes", `s = "a\"b\\c\n\t\u00e9"`, []tomlEntry{{"s", "a\"b\\c\n\té", 1}}},
+		{"literal string", `s = 'C:\dir'`, []tomlEntry{{"s", `C:\dir`, 1}}},
+		{"hash inside string", `s = "a#b" # comment`, []tomlEntry{{"s", "a#b", 1}}},
+		{"trailing comment", "n = 3 # three", []tomlEntry{{"n", int64(3), 1}}},
+		{"empty array", "l = []", []tomlEntry{{"l", []interface{}{}, 1}}},
+		{"array", `l = ["a", 'b', 3, true]`, []tomlEntry{{"l", []interface{}{"a", "b", int64(3), true}, 1}}},
+		{"multi-line array", "l = [\n  \"a\", # first\n  \"b\",\n]\nn = 1", []tomlEntry{
+			{"l", []interface{}{"a", "b"}, 1},
+			{"n", int64(1), 5},
+		}},
+		{"bracket inside string in array", "l = [\"]\", \"[\"]", []tomlEntry{{"l", []interface{}{"]", "["}, 1}}},
+		{"CRLF line endings", "[a]\r\nn = 1\r\n", []tomlEntry{{"a.n", int64(1), 2}}},
+		{"dashes in keys", "[my-table]\nmy-key = 1", []tomlEntry{{"my-table.my-key", int64(1), 2}}},
+		{"same key in two tables", "[a]\nn = 1\n[b]\nn = 2", []tomlEntry{{"a.n", int64(1), 2}, {"b.n", int64(2), 4}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML(tt.data)
+			if err != nil {
+				t.Fatalf("parseTOML: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"array of tables", "[[workers]]", `line 1: invalid table header "[[workers]]"`},
+		{"unclosed header", "\n[server", `line 2: invalid table header "[server"`},
+		{"dotted table", "[a.b]", `line 1: invalid table name "a.b"`},
+		{"quoted table", `["a"]`, `line 1: invalid table name "\"a\""`},
+		{"table twice", "[a]\n[b]\n[a]", "line 3: table [a] defined twice"},
+		{"no equals", "[a]\nport 9000", `line 2: expected key = value, got "port 9000"`},
+		{"dotted key", "a.b = 1", `line 1: expected key = value, got "a.b = 1"`},
+		{"empty key", "= 1", `line 1: expected key = value, got "= 1"`},
+		{"key twice", "[a]\nn = 1\n\nn = 2", "line 4: a.n set twice"},
+		{"missing value", "[a]\nn =", "line 2: a.n: missing value"},
+		{"bare string", "s = hello", `line 1: s: invalid value "hello" (strings need quotes)`},
+		{"float", "n = 1.5", `line 1: n: invalid value "1.5" (strings need quotes)`},
+		{"misplaced underscore", "n = 1__0", `line 1: n: invalid value "1__0"`},
+		{"unterminated string", `s = "abc`, "line 1: s: unterminated string"},
+		{"unterminated literal", `s = 'abc`, "line 1: s: unterminated string"},
+		{"bad escape", `s = "a\qb"`, `line 1: s: invalid escape \q`},
+		{"bad unicode escape", `s = "\u00zz"`, `line 1: s: invalid \u escape`},
+		{"junk after value", `s = "a" "b"`, `line 1: s: unexpected "\"b\"" after value`},
+		{"nested array", "l = [[1]]", "line 1: l: nested arrays are not supported"},
+		{"missing comma", "l = [1 2]", "line 1: l: expected , or ] in array"},
+		{"unclosed array", "l = [1,\n2", "line 1: l: expected , or ] in array"},
+		{"inline table", "t = {a = 1}", `line 1: t: invalid value "{a" (strings need quotes)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML(tt.data)
+			if err == nil {
+				t.Fatalf("parseTOML accepted %q", tt.data)
+			}
+			if err.Error() != tt.want {
+				t.Fatalf("error %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadServerConfigNamesTheLine(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"unknown setting", "[pool]\nmax_retries = 2\nmax_retry = 3", "line 3: unknown setting pool.max_retry"},
+		{"wrong type", "[server]\n\nport = \"9000\"", "line 3: server.port: expected an integer"},
+		{"syntax", "[server\n", "line 1: invalid table header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "gollama.toml")
+			err := os.WriteFile(path, []byte(tt.data), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = LoadServerConfig(path, nil)
+			if err == nil || !strings.Contains(err.Error(), path+": "+tt.want) {
+				t.Fatalf("error %v, want it to contain %q", err, path+": "+tt.want)
+			}
+		})
+	}
+}
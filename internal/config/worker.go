@@ -0,0 +1,184 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+WorkerConfig holds configuration for a GoLlama worker. Values are layered: defaults, then the optional
+JSON config file, then environment variables, then command-line flags (applied by cmd/worker).
+*/
+type WorkerConfig struct {
+	Port             int             `json:"port"`
+	LlamaPort        int             `json:"llama_port"`
+	ServerURL        string          `json:"server_url"`
+	Reverse          bool            `json:"reverse"`
+	Username         string          `json:"username"`
+	Password         string          `json:"password"`
+	TokenFile        string          `json:"token_file"`        // pre-issued JWT used instead of username/password
+	AdvertiseURL     string          `json:"advertise_url"`     // externally reachable URL the hub should call
+	Name             string          `json:"name"`              // display name shown in hub stats
+	Backends         []BackendConfig `json:"backends"`          // multiple llama.cpp instances; overrides LlamaPort
+	LlamaServer      string          `json:"llama_server"`      // llama-server binary; when set the worker launches backends itself
+	ModelPath        string          `json:"model_path"`        // model for the single LlamaPort backend in managed mode
+	LlamaArgs        []string        `json:"llama_args"`        // extra llama-server arguments for the single backend
+	AllowedEndpoints []string        `json:"allowed_endpoints"` // llama.cpp routes the hub may call; empty uses the built-in allowlist
+	MaxRequestBytes  int64           `json:"max_request_bytes"` // largest request body accepted on /execute (0 = unlimited)
+	MaxTokens        int             `json:"max_tokens"`        // generation length cap applied to every request (0 = unlimited)
+}
+
+/*
+BackendConfig describes one local llama.cpp instance fronted by the worker. Model may be left empty,
+in which case the worker asks llama.cpp which model it loaded.
+*/
+type BackendConfig struct {
+	Port      int      `json:"port"`
+	Model     string   `json:"model"`
+	ModelPath string   `json:"model_path"` // launch llama-server with this model (needs LlamaServer)
+	Args      []string `json:"args"`
+}
+
+/*
+LoadWorkerConfig builds the worker configuration from defaults, an optional JSON file and environment variables
+*/
+func LoadWorkerConfig(path string) (*WorkerConfig, error) {
+	cfg := &WorkerConfig{
+		Port:            9001,
+		LlamaPort:       8080,
+		ServerURL:       "http://localhost:9000",
+		MaxRequestBytes: 4 << 20,
+		MaxTokens:       8192,
+	}
+
+	if path != "" {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read worker config file: %w", err)
+		}
+		err = json.Unmarshal(file, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse worker config file: %w", err)
+		}
+	}
+
+	cfg.Port = getEnvInt("WORKER_PORT", cfg.Port)
+	cfg.LlamaPort = getEnvInt("LLAMA_PORT", cfg.LlamaPort)
+	cfg.ServerURL = getEnvString("GOLLAMA_SERVER_URL", cfg.ServerURL)
+	cfg.Reverse = getEnvBool("WORKER_REVERSE", cfg.Reverse)
+	cfg.Username = getEnvString("WORKER_USERNAME", cfg.Username)
+	cfg.Password = getEnvString("WORKER_PASSWORD", cfg.Password)
+	cfg.TokenFile = getEnvString("WORKER_TOKEN_FILE", cfg.TokenFile)
+	cfg.AdvertiseURL = getEnvString("WORKER_ADVERTISE_URL", cfg.AdvertiseURL)
+	cfg.Name = getEnvString("WORKER_NAME", cfg.Name)
+	cfg.LlamaServer = getEnvString("LLAMA_SERVER", cfg.LlamaServer)
+	cfg.ModelPath = getEnvString("LLAMA_MODEL_PATH", cfg.ModelPath)
+	cfg.MaxRequestBytes = int64(getEnvInt("WORKER_MAX_REQUEST_BYTES", int(cfg.MaxRequestBytes)))
+	cfg.MaxTokens = getEnvInt("WORKER_MAX_TOKENS", cfg.MaxTokens)
+	if value := os.Getenv("WORKER_ALLOWED_ENDPOINTS"); value != "" {
+		cfg.AllowedEndpoints = strings.Split(value, ",")
+	}
+	if value := os.Getenv("LLAMA_ARGS"); value != "" {
+		cfg.LlamaArgs = strings.Fields(value)
+	}
+	if value := os.Getenv("WORKER_BACKENDS"); value != "" {
+		backends, err := ParseBackends(value)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Backends = backends
+	}
+
+	return cfg, nil
+}
+
+/*
+Validate checks that the worker has enough information to authenticate with the hub
+*/
+func (c *WorkerConfig) Validate() error {
+	if c.TokenFile == "" && (c.Username == "" || c.Password == "") {
+		return fmt.Errorf("either a token file or both username and password must be configured")
+	}
+	for _, b := range c.BackendList() {
+		if b.Port <= 0 {
+			return fmt.Errorf("invalid backend port %d", b.Port)
+		}
+		if b.ModelPath != "" && c.LlamaServer == "" {
+			return fmt.Errorf("backend on port %d has a model path but no llama-server binary is configured", b.Port)
+		}
+	}
+	for _, e := range c.AllowedEndpoints {
+		if !strings.HasPrefix(e, "/") {
+			return fmt.Errorf("allowed endpoint must start with /: %s", e)
+		}
+	}
+	if c.LlamaServer != "" {
+		if _, err := os.Stat(c.LlamaServer); err != nil {
+			return fmt.Errorf("llama-server binary not found: %w", err)
+		}
+	}
+	if c.AdvertiseURL != "" && !strings.HasPrefix(c.AdvertiseURL, "http://") && !strings.HasPrefix(c.AdvertiseURL, "https://") {
+		return fmt.Errorf("advertise URL must start with http:// or https://: %s", c.AdvertiseURL)
+	}
+	return nil
+}
+
+/*
+BackendList returns the configured backends, falling back to the single LlamaPort backend
+*/
+func (c *WorkerConfig) BackendList() []BackendConfig {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+	return []BackendConfig{{Port: c.LlamaPort, ModelPath: c.ModelPath, Args: c.LlamaArgs}}
+}
+
+/*
+ParseBackends parses a backend list of the form "8080=qwen,8081=qwen,8082=llama". The model part
+is optional ("8080,8081") and is then discovered from llama.cpp.
+*/
+func ParseBackends(value string) ([]BackendConfig, error) {
+	var backends []BackendConfig
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		portStr, model, _ := strings.Cut(entry, "=")
+		port, err := strconv.Atoi(strings.TrimSpace(portStr))
+		if err != nil || port <= 0 {
+			return nil, fmt.Errorf("invalid backend port in %q", entry)
+		}
+		backends = append(backends, BackendConfig{Port: port, Model: strings.TrimSpace(model)})
+	}
+	return backends, nil
+}
+
+/*
+WorkerID returns the identifier the worker registers under, preferring the configured display name
+*/
+func (c *WorkerConfig) WorkerID() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return fmt.Sprintf("worker-%d", c.Port)
+}
+
+/*
+ReadToken loads the pre-issued JWT from the configured token file
+*/
+func (c *WorkerConfig) ReadToken() (string, error) {
+	data, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", c.TokenFile)
+	}
+	return token, nil
+}
@@ -0,0 +1,510 @@
+package federation
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gollama/internal"
+	"gollama/internal/pool"
+	"gollama/internal/worker"
+)
+
+// Trust levels. A fully trusted peer's jobs compete with local traffic; a limited one's only use
+// spare capacity.
+const (
+	TrustFull    = "full"
+	TrustLimited = "limited"
+)
+
+// Federation tuning
+const (
+	refreshInterval = 30 * time.Second // how often peers are asked which models they serve
+	saveInterval    = 30 * time.Second // how often the ledger is written when it has changed
+	minSecretLength = 16
+	defaultInbound  = 4 // a peer's jobs running here at once, when its config doesn't say
+)
+
+/*
+PeerConfig is one peer hub as configured in the federation file. Both hubs configure the same
+secret for each other: it authenticates requests in both directions.
+  - Send: spill our overflow to this peer
+  - Accept: run this peer's overflow here
+  - MaxOutbound: most of our jobs running on the peer at once
+  - MaxInbound, RequestsPerMinute: quotas on the peer's jobs here (0 for no rate limit)
+  - CreditLimit: how many credits the peer may use here beyond what it has run for us (0 for no limit)
+*/
+type PeerConfig struct {
+	Name              string `json:"name"`
+	URL               string `json:"url"`
+	Secret            string `json:"secret"`
+	Send              bool   `json:"send"`
+	Accept            bool   `json:"accept"`
+	Trust             string `json:"trust,omitempty"`
+	MaxOutbound       int    `json:"max_outbound,omitempty"`
+	MaxInbound        int    `json:"max_inbound,omitempty"`
+	RequestsPerMinute int    `json:"requests_per_minute,omitempty"`
+	CreditLimit       int64  `json:"credit_limit,omitempty"`
+}
+
+/*
+Config is the federation file
+*/
+type Config struct {
+	Peers []PeerConfig `json:"peers"`
+}
+
+/*
+LoadConfig reads and validates a federation file. Unknown fields are errors, so a misspelt quota
+isn't silently ignored.
+*/
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading federation config: %w", err)
+	}
+
+	var cfg Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parsing federation config %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	secrets := make(map[string]bool)
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		peer.URL = strings.TrimRight(peer.URL, "/")
+		if peer.Trust == "" {
+			peer.Trust = TrustLimited
+		}
+		if peer.MaxInbound == 0 {
+			peer.MaxInbound = defaultInbound
+		}
+
+		err := validatePeer(*peer)
+		if err == nil && names[peer.Name] {
+			err = fmt.Errorf("name is used by another peer")
+		}
+		if err == nil && secrets[peer.Secret] {
+			err = fmt.Errorf("secret is used by another peer; each peer needs its own")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("federation config %s: peer %d (%s): %w", path, i+1, peer.Name, err)
+		}
+		names[peer.Name] = true
+		secrets[peer.Secret] = true
+	}
+	return &cfg, nil
+}
+
+func validatePeer(peer PeerConfig) error {
+	if peer.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(peer.Secret) < minSecretLength {
+		return fmt.Errorf("secret must be at least %d characters", minSecretLength)
+	}
+	if !peer.Send && !peer.Accept {
+		return fmt.Errorf("neither send nor accept is set")
+	}
+	if peer.Send {
+		u, err := url.Parse(peer.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url must be an http or https URL to send to the peer")
+		}
+	}
+	if peer.Trust != TrustFull && peer.Trust != TrustLimited {
+		return fmt.Errorf("trust must be %q or %q", TrustFull, TrustLimited)
+	}
+	if peer.MaxOutbound < 0 || peer.MaxInbound < 0 || peer.RequestsPerMinute < 0 || peer.CreditLimit < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	return nil
+}
+
+/*
+Account is what two hubs have done for each other. Credits are tokens processed (prompt and
+generated), or 1 for a response that doesn't report usage.
+*/
+type Account struct {
+	JobsServed   int64 `json:"jobs_served"`    // the peer's jobs run here
+	JobsConsumed int64 `json:"jobs_consumed"`  // our jobs run on the peer
+	Earned       int64 `json:"credits_earned"` // credits for jobs served
+	Spent        int64 `json:"credits_spent"`  // credits for jobs consumed
+}
+
+/*
+Peer is a configured peer hub and its running totals
+*/
+type Peer struct {
+	PeerConfig
+
+	inflight   int
+	tokens     float64 // rate limit bucket
+	refilled   time.Time
+	rejected   int64
+	lastSeen   time.Time // last time it told us its models
+	modelCount int
+	account    Account
+}
+
+/*
+Trusted reports whether the peer's jobs run alongside local traffic rather than behind it
+*/
+func (p *Peer) Trusted() bool {
+	return p.Trust == TrustFull
+}
+
+/*
+PeerStatus is a peer's entry in GET /federation. Balance is credits earned minus credits spent:
+positive when the peer has used more of this hub than it has given.
+*/
+type PeerStatus struct {
+	Name     string     `json:"name"`
+	URL      string     `json:"url,omitempty"`
+	Send     bool       `json:"send"`
+	Accept   bool       `json:"accept"`
+	Trust    string     `json:"trust"`
+	Models   int        `json:"models"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Inflight int        `json:"inflight"`
+	Rejected int64      `json:"rejected"`
+	Balance  int64      `json:"balance"`
+	Account
+}
+
+/*
+Federation lets this hub trade overflow with peer hubs. Peers we send to join the pool as overflow
+members (see pool.AddPeer) advertising the models their own workers serve. Peers we accept from
+call our /execute like a hub calls a worker, within their quotas and credit limit. Every job either
+way is recorded in a ledger kept on disk.
+*/
+type Federation struct {
+	pool       *pool.Pool
+	ledgerPath string
+	client     *http.Client
+
+	mu    sync.Mutex
+	peers []*Peer
+	byURL map[string]*Peer
+	dirty bool
+}
+
+/*
+New sets up federation with the configured peers, restoring their accounts from the ledger file
+*/
+func New(cfg *Config, p *pool.Pool, ledgerPath string) (*Federation, error) {
+	f := &Federation{
+		pool:       p,
+		ledgerPath: ledgerPath,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		byURL:      make(map[string]*Peer),
+	}
+
+	ledger := make(map[string]Account)
+	data, err := os.ReadFile(ledgerPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading federation ledger: %w", err)
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &ledger)
+		if err != nil {
+			return nil, fmt.Errorf("reading federation ledger %s: %w", ledgerPath, err)
+		}
+	}
+
+	for _, peerCfg := range cfg.Peers {
+		peer := &Peer{
+			PeerConfig: peerCfg,
+			tokens:     float64(peerCfg.RequestsPerMinute),
+			refilled:   time.Now(),
+			account:    ledger[peerCfg.Name],
+		}
+		f.peers = append(f.peers, peer)
+		if peer.Send {
+			f.byURL[peer.URL] = peer
+		}
+	}
+	return f, nil
+}
+
+/*
+Start begins refreshing the models peers serve and saving the ledger
+*/
+func (f *Federation) Start() {
+	go func() {
+		f.refresh()
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			f.refresh()
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(saveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			f.save()
+		}
+	}()
+	log.Printf("Federation enabled with %d peer hubs", len(f.peers))
+}
+
+/*
+Authenticate returns the peer a request comes from, or nil. Only peers we accept jobs from can
+authenticate.
+*/
+func (f *Federation) Authenticate(r *http.Request) *Peer {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+	var match *Peer
+	for _, peer := range f.peers {
+		// compare against every peer so the time taken doesn't reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(peer.Secret)) == 1 && peer.Accept {
+			match = peer
+		}
+	}
+	return match
+}
+
+/*
+Admit checks a peer's job against its quotas and credit limit. If it's let in, release must be
+called once it's done.
+*/
+func (f *Federation) Admit(peer *Peer) (func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.admit(peer)
+	if err != nil {
+		peer.rejected++
+		return nil, err
+	}
+	peer.inflight++
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		peer.inflight--
+	}, nil
+}
+
+/*
+admit is Admit's checks. Callers hold f.mu.
+*/
+func (f *Federation) admit(peer *Peer) error {
+	if peer.inflight >= peer.MaxInbound {
+		return fmt.Errorf("peer %s already has %d jobs running here", peer.Name, peer.inflight)
+	}
+	if peer.CreditLimit > 0 && peer.account.Earned-peer.account.Spent >= peer.CreditLimit {
+		return fmt.Errorf("peer %s is over its credit limit of %d", peer.Name, peer.CreditLimit)
+	}
+	if peer.RequestsPerMinute > 0 {
+		now := time.Now()
+		rate := float64(peer.RequestsPerMinute) / time.Minute.Seconds()
+		peer.tokens = min(float64(peer.RequestsPerMinute), peer.tokens+now.Sub(peer.refilled).Seconds()*rate)
+		peer.refilled = now
+		if peer.tokens < 1 {
+			return fmt.Errorf("peer %s is over its limit of %d requests per minute", peer.Name, peer.RequestsPerMinute)
+		}
+		peer.tokens--
+	}
+	return nil
+}
+
+/*
+Served credits a peer for a job of theirs this hub ran
+*/
+func (f *Federation) Served(peer *Peer, response []byte) {
+	cost := Cost(response)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peer.account.JobsServed++
+	peer.account.Earned += cost
+	f.dirty = true
+}
+
+/*
+Consumed charges a job a peer ran for this hub; see pool.PeerLedger
+*/
+func (f *Federation) Consumed(peerURL string, response []byte) {
+	cost := Cost(response)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peer, ok := f.byURL[peerURL]
+	if !ok {
+		return
+	}
+	peer.account.JobsConsumed++
+	peer.account.Spent += cost
+	f.dirty = true
+}
+
+/*
+Status returns every peer's settings, activity and account
+*/
+func (f *Federation) Status() []PeerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	statuses := make([]PeerStatus, 0, len(f.peers))
+	for _, peer := range f.peers {
+		status := PeerStatus{
+			Name:     peer.Name,
+			URL:      peer.URL,
+			Send:     peer.Send,
+			Accept:   peer.Accept,
+			Trust:    peer.Trust,
+			Models:   peer.modelCount,
+			Inflight: peer.inflight,
+			Rejected: peer.rejected,
+			Balance:  peer.account.Earned - peer.account.Spent,
+			Account:  peer.account,
+		}
+		if !peer.lastSeen.IsZero() {
+			seen := peer.lastSeen
+			status.LastSeen = &seen
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+/*
+Cost is the credits a job's llama.cpp response is worth: the tokens it processed, or 1 if it doesn't
+say. Both hubs price a job from the same response, so their ledgers agree.
+*/
+func Cost(response []byte) int64 {
+	var resp struct {
+		Usage struct {
+			PromptTokens     int64 `json:"prompt_tokens"`
+			CompletionTokens int64 `json:"completion_tokens"`
+			TotalTokens      int64 `json:"total_tokens"`
+		} `json:"usage"`
+		TokensEvaluated int64 `json:"tokens_evaluated"` // llama.cpp's native /completion
+		TokensPredicted int64 `json:"tokens_predicted"`
+	}
+	if json.Unmarshal(response, &resp) != nil {
+		return 1
+	}
+	cost := resp.Usage.TotalTokens
+	if cost == 0 {
+		cost = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+	}
+	if cost == 0 {
+		cost = resp.TokensEvaluated + resp.TokensPredicted
+	}
+	return max(cost, 1)
+}
+
+/*
+EndpointAllowed reports whether a peer may run a llama.cpp endpoint here. It's the set a worker
+allows by default.
+*/
+func EndpointAllowed(endpoint string) bool {
+	return slices.Contains(worker.DefaultAllowedEndpoints, endpoint)
+}
+
+/*
+refresh asks each peer we send to which models it serves, and updates its place in the pool. A peer
+that serves nothing is taken out; one that can't be reached keeps the models it last reported, and
+its circuit breaker keeps it out of rotation while it's down.
+*/
+func (f *Federation) refresh() {
+	for _, peer := range f.peers {
+		if !peer.Send {
+			continue
+		}
+		models, err := f.fetchModels(peer)
+		if err != nil {
+			log.Printf("Federation: couldn't reach peer %s: %v", peer.Name, err)
+			continue
+		}
+
+		f.mu.Lock()
+		peer.lastSeen = time.Now()
+		peer.modelCount = len(models)
+		f.mu.Unlock()
+
+		if len(models) == 0 {
+			f.pool.RemovePeer(peer.URL)
+			continue
+		}
+		f.pool.AddPeer(peer.URL, "peer "+peer.Name, models, peer.Secret, peer.MaxOutbound)
+	}
+}
+
+func (f *Federation) fetchModels(peer *Peer) ([]internal.ModelInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, peer.URL+"/federation/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+peer.Secret)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Models []internal.ModelInfo `json:"models"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid models response: %w", err)
+	}
+	return body.Models, nil
+}
+
+/*
+save writes the ledger if it has changed. It's written beside the old one and renamed over it, so a
+crash leaves one or the other intact.
+*/
+func (f *Federation) save() {
+	f.mu.Lock()
+	if !f.dirty {
+		f.mu.Unlock()
+		return
+	}
+	ledger := make(map[string]Account, len(f.peers))
+	for _, peer := range f.peers {
+		ledger[peer.Name] = peer.account
+	}
+	f.dirty = false
+	f.mu.Unlock()
+
+	data, _ := json.MarshalIndent(ledger, "", "  ") // an Account always encodes
+	err := os.MkdirAll(filepath.Dir(f.ledgerPath), 0o755)
+	if err == nil {
+		tmpPath := f.ledgerPath + ".tmp"
+		err = os.WriteFile(tmpPath, data, 0o644)
+		if err == nil {
+			err = os.Rename(tmpPath, f.ledgerPath)
+		}
+	}
+	if err != nil {
+		log.Printf("Federation: saving ledger failed: %v", err)
+		f.mu.Lock()
+		f.dirty = true
+		f.mu.Unlock()
+	}
+}
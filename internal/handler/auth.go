@@ -4,18 +4,30 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
 
 	"gollama/internal/auth"
 )
 
-// Global credential store (initialized in main)
-var credStore *auth.CredentialStore
+// Global credential store and worker token lifetime (initialized in main, replaced on reload)
+var (
+	authMu        sync.RWMutex
+	credStore     *auth.CredentialStore
+	tokenTTLHours = 24
+)
 
-// InitAuth initializes the credential store
-func InitAuth(credentialFilePath string) error {
-	var err error
-	credStore, err = auth.NewCredentialStore(credentialFilePath)
-	return err
+// InitAuth initializes the credential store and sets how long issued tokens last. Called again on
+// a config reload; if the file doesn't load, the credentials already in use stay in effect.
+func InitAuth(credentialFilePath string, ttlHours int) error {
+	store, err := auth.NewCredentialStore(credentialFilePath)
+	if err != nil {
+		return err
+	}
+	authMu.Lock()
+	defer authMu.Unlock()
+	credStore = store
+	tokenTTLHours = ttlHours
+	return nil
 }
 
 // HandleGetToken issues a JWT token for a worker with valid credentials
@@ -46,18 +58,22 @@ func HandleGetToken() http.HandlerFunc {
 			return
 		}
 
+		authMu.RLock()
+		store, ttlHours := credStore, tokenTTLHours
+		authMu.RUnlock()
+
 		// Validate credentials
-		if !credStore.ValidateCredentials(req.Username, req.Password) {
+		if !store.ValidateCredentials(req.Username, req.Password) {
 			log.Printf("Authentication failed for worker: %s", req.WorkerID)
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
 
 		// Get user info
-		user, _ := credStore.GetUser(req.Username)
+		user, _ := store.GetUser(req.Username)
 
 		// Generate token
-		token, err := auth.GenerateToken(req.WorkerID, req.URL, req.Username, user.Email, 24)
+		token, err := auth.GenerateToken(req.WorkerID, req.URL, req.Username, user.Email, ttlHours)
 		if err != nil {
 			log.Printf("Token generation failed: %v", err)
 			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
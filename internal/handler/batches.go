@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"gollama/internal/batch"
+	"gollama/internal/jobs"
+)
+
+// HandleBatches creates a batch from an uploaded JSONL file (POST) or lists batches (GET). Like /jobs,
+// a POST with an Idempotency-Key already used returns the original batch with 200, or 422 if it
+// had different items.
+func HandleBatches(m *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(m.List())
+			return
+		case "POST":
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		input, err := io.ReadAll(http.MaxBytesReader(w, r.Body, m.MaxInputBytes()))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Batch file too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		b, created, err := m.Create(input, r.URL.Query().Get("endpoint"), r.Header.Get("Idempotency-Key"))
+		if errors.Is(err, jobs.ErrKeyReused) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/batches/"+b.ID)
+		if created {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		_ = json.NewEncoder(w).Encode(b)
+	}
+}
+
+// HandleBatch returns a batch's status and counts (GET) or cancels it (DELETE)
+func HandleBatch(m *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var b batch.Batch
+		var ok bool
+		switch r.Method {
+		case "GET":
+			b, ok = m.Get(id)
+		case "DELETE":
+			b, ok = m.Cancel(id)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !ok {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(b)
+	}
+}
+
+// HandleBatchItems returns the state of each item in a batch
+func HandleBatchItems(m *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		items, ok := m.Items(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(items)
+	}
+}
+
+// HandleBatchResults downloads a batch's results as JSONL, one line per finished item
+func HandleBatchResults(m *batch.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := r.PathValue("id")
+		path, ok := m.ResultsPath(id)
+		if !ok {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+
+		// No results file yet just means nothing has finished
+		f, err := os.Open(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Error reading results", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.jsonl"`)
+		if f != nil {
+			defer f.Close()
+			_, _ = io.Copy(w, f)
+		}
+	}
+}
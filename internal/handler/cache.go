@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"gollama/internal"
+	"gollama/internal/cache"
+)
+
+// Global response cache (initialized in main); nil disables caching
+var responseCache *cache.Cache
+
+// InitCache sets the cache consulted before jobs are submitted to the pool
+func InitCache(c *cache.Cache) {
+	responseCache = c
+}
+
+/*
+cacheKey returns the key for a job whose reply is deterministic: temperature 0 or a fixed seed.
+Other jobs can't be cached, since the same request legitimately gets different replies. A negative
+seed is llama.cpp's "pick a random seed", so it doesn't count.
+*/
+func cacheKey(job internal.WorkerJob) (string, bool) {
+	if len(job.Body) == 0 {
+		req := job.Request
+		deterministic := (req.Temperature != nil && *req.Temperature == 0) || (req.Seed != nil && *req.Seed >= 0)
+		if !deterministic {
+			return "", false
+		}
+		data, err := json.Marshal(req)
+		if err != nil {
+			return "", false
+		}
+		return cache.Key(job.Endpoint, job.Capability, string(data)), true
+	}
+
+	// re-encoding the decoded body sorts its keys, so field order doesn't change the key
+	var body map[string]interface{}
+	if json.Unmarshal(job.Body, &body) != nil {
+		return "", false
+	}
+	temperature, hasTemperature := body["temperature"].(float64)
+	seed, hasSeed := body["seed"].(float64)
+	deterministic := (hasTemperature && temperature == 0) || (hasSeed && seed >= 0)
+	if !deterministic {
+		return "", false
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", false
+	}
+	return cache.Key(job.Endpoint, job.Capability, job.Request.Model, string(data)), true
+}
+
+/*
+cacheStatus counts a request's cache lookups so TrackCache can report them in the X-Cache header
+*/
+type cacheStatus struct {
+	mu     sync.Mutex
+	hits   int
+	misses int
+}
+
+type cacheStatusKey struct{}
+
+/*
+recordCacheLookup notes a lookup against the request that made it, if TrackCache is tracking it
+*/
+func recordCacheLookup(ctx context.Context, hit bool) {
+	status, ok := ctx.Value(cacheStatusKey{}).(*cacheStatus)
+	if !ok {
+		return
+	}
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	if hit {
+		status.hits++
+	} else {
+		status.misses++
+	}
+}
+
+// TrackCache sets X-Cache to HIT when every worker reply came from the cache, or MISS when any didn't.
+// Requests that weren't cacheable get no header.
+func TrackCache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := &cacheStatus{}
+		ctx := context.WithValue(r.Context(), cacheStatusKey{}, status)
+		next(&cacheHeaderWriter{ResponseWriter: w, status: status}, r.WithContext(ctx))
+	}
+}
+
+/*
+cacheHeaderWriter adds X-Cache just before the response headers go out
+*/
+type cacheHeaderWriter struct {
+	http.ResponseWriter
+	status      *cacheStatus
+	wroteHeader bool
+}
+
+func (w *cacheHeaderWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status.mu.Lock()
+		switch {
+		case w.status.misses > 0:
+			w.Header().Set("X-Cache", "MISS")
+		case w.status.hits > 0:
+			w.Header().Set("X-Cache", "HIT")
+		}
+		w.status.mu.Unlock()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gollama/internal"
+	"gollama/internal/cache"
+	"gollama/internal/pool"
+	"gollama/internal/templates"
+)
+
+/*
+fakeWorker answers /execute with each of replies in turn as the chat content, repeating the last
+one, and counts its calls
+*/
+func fakeWorker(t *testing.T, replies ...string) (*pool.Pool, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		content := replies[min(n, len(replies))-1]
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": content}}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	p := pool.New(10, 2, 3)
+	p.SetRetryPolicy(time.Millisecond, time.Millisecond, 0)
+	p.AddWorker(srv.URL, "fake", []internal.ModelInfo{{Name: "m", Slots: 1}})
+	p.Start()
+	return p, &calls
+}
+
+/*
+withCache turns the response cache on for the duration of a test
+*/
+func withCache(t *testing.T) {
+	t.Helper()
+	c, err := cache.New(100, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitCache(c)
+	t.Cleanup(func() { InitCache(nil) })
+}
+
+func TestInvalidReplyRetryMissesCache(t *testing.T) {
+	withCache(t)
+	p, calls := fakeWorker(t, "not json", `{"ok": true}`)
+
+	zero := 0.0
+	req := internal.LlamaRequest{Model: "m", Temperature: &zero, Messages: []internal.Message{{Role: "user", Content: "hi"}}}
+	validate := func(reply string) error {
+		var v map[string]interface{}
+		return json.Unmarshal([]byte(reply), &v)
+	}
+
+	// an unchecked request caches whatever the worker said
+	reply := submitAndWait(context.Background(), p, req, 3, nil)
+	if reply != "not json" || calls.Load() != 1 {
+		t.Fatalf("first reply %q after %d calls", reply, calls.Load())
+	}
+
+	// the same request with a check must not be served the cached bad reply
+	reply = submitAndWait(context.Background(), p, req, 3, validate)
+	if reply != `{"ok": true}` {
+		t.Fatalf("checked reply = %q, want the worker's valid reply", reply)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("worker called %d times, want 2", calls.Load())
+	}
+
+	// and now the valid reply is what's cached
+	reply = submitAndWait(context.Background(), p, req, 3, validate)
+	if reply != `{"ok": true}` || calls.Load() != 2 {
+		t.Fatalf("cached reply %q after %d calls", reply, calls.Load())
+	}
+}
+
+func TestSentimentInvalidOutputNotCached(t *testing.T) {
+	withCache(t)
+	valid := `{"label": "positive", "confidence": 0.9, "rationale": "It says it is great."}`
+	p, calls := fakeWorker(t, `{"label": "ecstatic"}`, valid)
+	reg, err := templates.NewRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sentReq := internal.SentimentRequest{Model: "m", Text: "This is great"}
+	result := analyzeSentiment(context.Background(), p, reg, sentReq, sentReq.Text)
+	if result.Error != "" || result.Label != "positive" {
+		t.Fatalf("result = %+v, want positive", result)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("worker called %d times, want 2 (the invalid reply retried)", calls.Load())
+	}
+
+	result = analyzeSentiment(context.Background(), p, reg, sentReq, sentReq.Text)
+	if result.Label != "positive" || calls.Load() != 2 {
+		t.Fatalf("repeat got %+v after %d calls, want the cached valid reply", result, calls.Load())
+	}
+}
+
+func TestCacheKeyDeterministic(t *testing.T) {
+	zero, warm := 0.0, 0.7
+	seed, random := 42, -1
+	tests := []struct {
+		name string
+		job  internal.WorkerJob
+		want bool
+	}{
+		{"temperature 0", internal.WorkerJob{Request: internal.LlamaRequest{Model: "m", Temperature: &zero}}, true},
+		{"fixed seed", internal.WorkerJob{Request: internal.LlamaRequest{Model: "m", Temperature: &warm, Seed: &seed}}, true},
+		{"random seed", internal.WorkerJob{Request: internal.LlamaRequest{Model: "m", Temperature: &warm, Seed: &random}}, false},
+		{"sampled", internal.WorkerJob{Request: internal.LlamaRequest{Model: "m", Temperature: &warm}}, false},
+		{"body temperature 0", internal.WorkerJob{Body: json.RawMessage(`{"temperature": 0}`)}, true},
+		{"body fixed seed", internal.WorkerJob{Body: json.RawMessage(`{"seed": 0}`)}, true},
+		{"body random seed", internal.WorkerJob{Body: json.RawMessage(`{"seed": -1}`)}, false},
+		{"body sampled", internal.WorkerJob{Body: json.RawMessage(`{"temperature": 0.7}`)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := cacheKey(tt.job)
+			if ok != tt.want {
+				t.Fatalf("cacheable = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
 
 	"gollama/internal"
 	"gollama/internal/pool"
+	"gollama/internal/schema"
 )
 
 // HandleChat processes chat requests from clients
@@ -20,6 +23,8 @@ func HandleChat(p *pool.Pool, defaultMaxTokens int) http.HandlerFunc {
 			return
 		}
 
+		ctx := r.Context()
+
 		var chatReq internal.ChatRequest
 		err := json.NewDecoder(r.Body).Decode(&chatReq)
 		if err != nil {
@@ -27,39 +32,146 @@ func HandleChat(p *pool.Pool, defaultMaxTokens int) http.HandlerFunc {
 			return
 		}
 
+		messages := chatReq.Messages
+		switch {
+		case chatReq.Message != "" && len(messages) > 0:
+			http.Error(w, "Send either message or messages, not both", http.StatusBadRequest)
+			return
+		case chatReq.Message != "":
+			messages = []internal.Message{{Role: "user", Content: chatReq.Message}}
+		case len(messages) == 0:
+			http.Error(w, "Message or messages field is required", http.StatusBadRequest)
+			return
+		}
+
+		err = checkMessages(messages)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tools, err := checkTools(chatReq.Tools)
+		if err == nil {
+			err = checkToolChoice(chatReq.ToolChoice, tools)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		check, err := checkResponseFormat(chatReq.ResponseFormat, chatReq.Grammar)
+		if err == nil && len(chatReq.Tools) > 0 && (chatReq.ResponseFormat != nil || chatReq.Grammar != "") {
+			err = fmt.Errorf("tools can't be combined with response_format or grammar")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if chatReq.MaxTokens < 0 {
+			http.Error(w, "max_tokens must not be negative", http.StatusBadRequest)
+			return
+		}
+
 		if p.GetWorkerCount() == 0 {
 			http.Error(w, "No workers available", http.StatusServiceUnavailable)
 			return
 		}
 
-		log.Printf("Received message: %s", chatReq.Message)
-
-		llamaReq := internal.LlamaRequest{
-			Messages: []internal.Message{
-				{Role: "user", Content: chatReq.Message},
-			},
-			MaxTokens: defaultMaxTokens,
+		if !p.HasWorkerFor(chatReq.Model, "") {
+			http.Error(w, "No workers serve model "+chatReq.Model, http.StatusServiceUnavailable)
+			return
 		}
 
-		replyCh := make(chan string)
+		log.Printf("Received message: %s", messages[len(messages)-1].Content)
 
-		job := internal.WorkerJob{
-			Request:    llamaReq,
-			ReplyCh:    replyCh,
-			WorkerURL:  p.GetWorker(),
-			RetryCount: 0,
-			MaxRetries: p.GetMaxRetries(),
+		llamaReq := internal.LlamaRequest{
+			Model:          chatReq.Model,
+			Messages:       messages,
+			MaxTokens:      defaultMaxTokens,
+			Tools:          chatReq.Tools,
+			ToolChoice:     chatReq.ToolChoice,
+			ResponseFormat: chatReq.ResponseFormat,
+			Grammar:        chatReq.Grammar,
+			Temperature:    chatReq.Temperature,
+			Seed:           chatReq.Seed,
+			CachePrompt:    promptCaching(chatReq.CachePrompt),
+			IDSlot:         chatReq.IDSlot,
+		}
+		if chatReq.MaxTokens > 0 {
+			llamaReq.MaxTokens = chatReq.MaxTokens
 		}
-		log.Printf("Job assigned to worker: %s", job.WorkerURL)
 
-		p.SubmitJob(job)
-		reply := <-replyCh //must wait for reply from the job reply channel
+		chatResp := runChat(ctx, p, llamaReq, tools, check)
 
 		elapsed := time.Since(startTime)
 		log.Printf("Request completed in %v", elapsed)
 
-		chatResp := internal.ChatResponse{Reply: reply}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(chatResp)
 	}
 }
+
+/*
+runChat sends the conversation to a worker and returns the assistant's reply and any tool calls.
+Replies with invalid tool calls or output that doesn't match the requested format are retried on
+another worker. Failures come back in Reply as an error string, as /chat has always done.
+*/
+func runChat(ctx context.Context, p *pool.Pool, llamaReq internal.LlamaRequest, tools map[string]*schema.Schema, check outputCheck) internal.ChatResponse {
+	body, err := json.Marshal(llamaReq)
+	if err != nil {
+		return internal.ChatResponse{Reply: fmt.Sprintf("Error marshaling request: %v", err)}
+	}
+
+	reply := waitForJob(ctx, p, internal.WorkerJob{
+		Request:    internal.LlamaRequest{Model: llamaReq.Model},
+		Endpoint:   "/v1/chat/completions",
+		Body:       body,
+		Prefixes:   pool.MessageKeys(llamaReq.Messages),
+		MaxRetries: p.GetMaxRetries(),
+		Validate: func(reply string) error {
+			_, err := parseChatReply(reply, tools, check)
+			return err
+		},
+	})
+	if pool.IsError(reply) {
+		return internal.ChatResponse{Reply: reply}
+	}
+
+	chatResp, err := parseChatReply(reply, tools, check)
+	if err != nil {
+		return internal.ChatResponse{Reply: fmt.Sprintf("Error: %v", err)}
+	}
+	return chatResp
+}
+
+/*
+parseChatReply extracts the first choice from llama.cpp's chat response and checks its tool calls,
+or its content against the requested format
+*/
+func parseChatReply(reply string, tools map[string]*schema.Schema, check outputCheck) (internal.ChatResponse, error) {
+	var llamaResp internal.LlamaResponse
+	err := json.Unmarshal([]byte(reply), &llamaResp)
+	if err != nil {
+		return internal.ChatResponse{}, fmt.Errorf("parsing response: %v", err)
+	}
+	if len(llamaResp.Choices) == 0 {
+		return internal.ChatResponse{}, fmt.Errorf("no choices in response")
+	}
+
+	choice := llamaResp.Choices[0]
+	if len(choice.Message.ToolCalls) > 0 {
+		err = checkToolCalls(choice.Message.ToolCalls, tools)
+	} else {
+		err = check.verify(choice.Message.Content)
+	}
+	if err != nil {
+		return internal.ChatResponse{}, err
+	}
+
+	return internal.ChatResponse{
+		Reply:        choice.Message.Content,
+		ToolCalls:    choice.Message.ToolCalls,
+		FinishReason: choice.FinishReason,
+	}, nil
+}
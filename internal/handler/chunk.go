@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// charsPerToken is a rough average for English text with llama-family tokenizers
+const charsPerToken = 4
+
+/*
+estimateTokens approximates how many tokens a string will use without calling a tokenizer
+*/
+func estimateTokens(s string) int {
+	return (utf8.RuneCountInString(s) + charsPerToken - 1) / charsPerToken
+}
+
+/*
+splitByTokenBudget cuts text into chunks of roughly chunkTokens tokens, each overlapping the previous
+one by about overlapTokens so sentences spanning a boundary aren't lost. Cuts prefer paragraph breaks,
+then sentence ends, then whitespace.
+*/
+func splitByTokenBudget(text string, chunkTokens int, overlapTokens int) []string {
+	runes := []rune(text)
+	chunkChars := chunkTokens * charsPerToken
+	overlapChars := overlapTokens * charsPerToken
+	if overlapChars >= chunkChars/2 {
+		overlapChars = chunkChars / 4 // keep chunks making forward progress
+	}
+
+	if len(runes) <= chunkChars {
+		return []string{text}
+	}
+
+	var chunks []string
+	start := 0
+	for start < len(runes) {
+		end := start + chunkChars
+		if end >= len(runes) {
+			chunks = append(chunks, strings.TrimSpace(string(runes[start:])))
+			break
+		}
+
+		end = findBoundary(runes, start+chunkChars/2, end)
+		chunks = append(chunks, strings.TrimSpace(string(runes[start:end])))
+
+		next := end - overlapChars
+		// start the overlap on a word boundary rather than mid-word
+		for next > start && next < end && !isSpace(runes[next-1]) {
+			next--
+		}
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+	return chunks
+}
+
+/*
+findBoundary returns the best cut position in runes[lo:hi], searching backwards from hi
+*/
+func findBoundary(runes []rune, lo int, hi int) int {
+	for i := hi; i > lo; i-- {
+		if runes[i-1] == '\n' && i >= 2 && runes[i-2] == '\n' {
+			return i
+		}
+	}
+	for i := hi; i > lo; i-- {
+		if (runes[i-1] == '.' || runes[i-1] == '!' || runes[i-1] == '?') && i < len(runes) && isSpace(runes[i]) {
+			return i
+		}
+	}
+	for i := hi; i > lo; i-- {
+		if isSpace(runes[i-1]) {
+			return i
+		}
+	}
+	return hi
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\n' || r == '\t' || r == '\r'
+}
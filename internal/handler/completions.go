@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"gollama/internal"
+	"gollama/internal/pool"
+)
+
+// Limits on the per-request sampling options we forward
+const (
+	maxStopSequences = 16
+	maxNProbs        = 20
+)
+
+// HandleCompletions serves raw text completion in the OpenAI format. Requests with a suffix are
+// fill-in-the-middle and run on llama.cpp's /infill, with the result converted back to the same format.
+func HandleCompletions(p *pool.Pool, defaultMaxTokens int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx := r.Context()
+
+		var compReq internal.CompletionRequest
+		err := json.NewDecoder(r.Body).Decode(&compReq)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		if compReq.Prompt == "" {
+			http.Error(w, "Prompt field is required", http.StatusBadRequest)
+			return
+		}
+
+		err = checkSampling(compReq.MaxTokens, compReq.Stop, compReq.NProbs, compReq.Stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if compReq.MaxTokens == 0 {
+			compReq.MaxTokens = defaultMaxTokens
+		}
+		compReq.CachePrompt = promptCaching(compReq.CachePrompt)
+
+		if !p.HasWorkerFor(compReq.Model, "") {
+			http.Error(w, noWorkersMessage(compReq.Model), http.StatusServiceUnavailable)
+			return
+		}
+
+		if compReq.Suffix != "" {
+			log.Printf("Received fill-in-the-middle completion (%d prefix, %d suffix chars)", len(compReq.Prompt), len(compReq.Suffix))
+			reply, status := runInfill(ctx, p, internal.InfillRequest{
+				Model:       compReq.Model,
+				InputPrefix: compReq.Prompt,
+				InputSuffix: compReq.Suffix,
+				NPredict:    compReq.MaxTokens,
+				Temperature: compReq.Temperature,
+				TopP:        compReq.TopP,
+				TopK:        compReq.TopK,
+				Seed:        compReq.Seed,
+				Stop:        compReq.Stop,
+				NProbs:      compReq.NProbs,
+				CachePrompt: compReq.CachePrompt,
+				IDSlot:      compReq.IDSlot,
+			})
+			if status != http.StatusOK {
+				http.Error(w, reply, status)
+				return
+			}
+
+			completion, err := infillAsCompletion(reply, compReq.Model)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(completion)
+			return
+		}
+
+		log.Printf("Received completion request for prompt: %s...", truncate(compReq.Prompt, 50))
+
+		body, err := json.Marshal(compReq)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		reply := submitRawAndWait(ctx, p, "/v1/completions", compReq.Model, "", body, pool.PromptKeys(compReq.Prompt), p.GetMaxRetries())
+		if pool.IsError(reply) {
+			http.Error(w, reply, errorStatus(reply))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(reply))
+	}
+}
+
+// HandleInfill forwards llama.cpp-format fill-in-the-middle requests. The worker's model must have
+// FIM tokens (most code models do).
+func HandleInfill(p *pool.Pool, defaultMaxTokens int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx := r.Context()
+
+		var infillReq internal.InfillRequest
+		err := json.NewDecoder(r.Body).Decode(&infillReq)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		if infillReq.InputPrefix == "" && infillReq.InputSuffix == "" {
+			http.Error(w, "input_prefix or input_suffix is required", http.StatusBadRequest)
+			return
+		}
+
+		err = checkSampling(infillReq.NPredict, infillReq.Stop, infillReq.NProbs, infillReq.Stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if infillReq.NPredict == 0 {
+			infillReq.NPredict = defaultMaxTokens
+		}
+		infillReq.CachePrompt = promptCaching(infillReq.CachePrompt)
+
+		if !p.HasWorkerFor(infillReq.Model, "") {
+			http.Error(w, noWorkersMessage(infillReq.Model), http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Printf("Received infill request (%d prefix, %d suffix chars, %d extra files)",
+			len(infillReq.InputPrefix), len(infillReq.InputSuffix), len(infillReq.InputExtra))
+
+		reply, status := runInfill(ctx, p, infillReq)
+		if status != http.StatusOK {
+			http.Error(w, reply, status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(reply))
+	}
+}
+
+/*
+runInfill sends an infill request through the pool and returns llama.cpp's response, or an error
+message with the status to report it with
+*/
+func runInfill(ctx context.Context, p *pool.Pool, infillReq internal.InfillRequest) (string, int) {
+	body, err := json.Marshal(infillReq)
+	if err != nil {
+		return "Bad request", http.StatusBadRequest
+	}
+
+	// llama.cpp's FIM prompt opens with the extra files, then the prefix
+	var prompt strings.Builder
+	for _, chunk := range infillReq.InputExtra {
+		prompt.WriteString(chunk.Filename)
+		prompt.WriteString(chunk.Text)
+	}
+	prompt.WriteString(infillReq.InputPrefix)
+
+	reply := submitRawAndWait(ctx, p, "/infill", infillReq.Model, "", body, pool.PromptKeys(prompt.String()), p.GetMaxRetries())
+	if pool.IsError(reply) {
+		return reply, errorStatus(reply)
+	}
+	return reply, http.StatusOK
+}
+
+/*
+checkSampling validates the generation options shared by completions and infill. Streaming isn't
+supported because replies travel through the job queue as a whole.
+*/
+func checkSampling(maxTokens int, stop internal.StopList, nProbs int, stream bool) error {
+	if stream {
+		return fmt.Errorf("Streaming is not supported")
+	}
+	if maxTokens < 0 {
+		return fmt.Errorf("max_tokens must not be negative")
+	}
+	if len(stop) > maxStopSequences {
+		return fmt.Errorf("At most %d stop sequences", maxStopSequences)
+	}
+	if nProbs < 0 || nProbs > maxNProbs {
+		return fmt.Errorf("n_probs must be between 0 and %d", maxNProbs)
+	}
+	return nil
+}
+
+/*
+infillAsCompletion converts llama.cpp's native /infill response to the OpenAI completion format, so
+/v1/completions clients get the same shape whether or not they sent a suffix
+*/
+func infillAsCompletion(reply string, model string) (map[string]interface{}, error) {
+	var infill struct {
+		Content         string          `json:"content"`
+		Model           string          `json:"model"`
+		StoppedLimit    bool            `json:"stopped_limit"`
+		TokensEvaluated int             `json:"tokens_evaluated"`
+		TokensPredicted int             `json:"tokens_predicted"`
+		Probabilities   json.RawMessage `json:"completion_probabilities,omitempty"`
+	}
+	err := json.Unmarshal([]byte(reply), &infill)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing infill response: %v", err)
+	}
+
+	if model == "" {
+		model = infill.Model
+	}
+	finishReason := "stop"
+	if infill.StoppedLimit {
+		finishReason = "length"
+	}
+
+	choice := map[string]interface{}{
+		"text":          infill.Content,
+		"index":         0,
+		"finish_reason": finishReason,
+	}
+	if len(infill.Probabilities) > 0 {
+		choice["logprobs"] = infill.Probabilities
+	}
+
+	return map[string]interface{}{
+		"object":  "text_completion",
+		"model":   model,
+		"choices": []interface{}{choice},
+		"usage": map[string]int{
+			"prompt_tokens":     infill.TokensEvaluated,
+			"completion_tokens": infill.TokensPredicted,
+			"total_tokens":      infill.TokensEvaluated + infill.TokensPredicted,
+		},
+	}, nil
+}
+
+/*
+noWorkersMessage explains a 503 for requests that may have asked for a specific model
+*/
+func noWorkersMessage(model string) string {
+	if model != "" {
+		return "No workers serve model " + model
+	}
+	return "No workers available"
+}
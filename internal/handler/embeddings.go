@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"gollama/internal"
+	"gollama/internal/pool"
+)
+
+// Limits for /v1/embeddings. Large inputs are split into batches spread across the capable workers.
+const (
+	maxEmbeddingInputs = 2048
+	embeddingBatchSize = 32
+)
+
+// HandleEmbeddings returns OpenAI-format embeddings, routed only to workers whose backends have
+// embeddings enabled
+func HandleEmbeddings(p *pool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx := r.Context()
+
+		var embReq internal.EmbeddingRequest
+		err := json.NewDecoder(r.Body).Decode(&embReq)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		inputs, err := embeddingInputs(embReq.Input)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !p.HasWorkerFor(embReq.Model, pool.CapabilityEmbeddings) {
+			msg := "No workers with embeddings enabled"
+			if embReq.Model != "" {
+				msg = fmt.Sprintf("No workers serve embeddings for model %s", embReq.Model)
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Printf("Received embeddings request for %d inputs", len(inputs))
+
+		batches := (len(inputs) + embeddingBatchSize - 1) / embeddingBatchSize
+		results := make([]*internal.EmbeddingResponse, batches)
+		errs := make([]error, batches)
+		var wg sync.WaitGroup
+		for i := 0; i < batches; i++ {
+			start := i * embeddingBatchSize
+			end := min(start+embeddingBatchSize, len(inputs))
+			wg.Add(1)
+			go func(i int, batch []string) {
+				defer wg.Done()
+				results[i], errs[i] = embedBatch(ctx, p, embReq.Model, batch)
+			}(i, inputs[start:end])
+		}
+		wg.Wait()
+
+		embResp := internal.EmbeddingResponse{Object: "list", Model: embReq.Model}
+		for i, result := range results {
+			if errs[i] != nil {
+				http.Error(w, errs[i].Error(), errorStatus(errs[i].Error()))
+				return
+			}
+			for _, d := range result.Data {
+				d.Object = "embedding"
+				d.Index += i * embeddingBatchSize
+				embResp.Data = append(embResp.Data, d)
+			}
+			embResp.Usage.PromptTokens += result.Usage.PromptTokens
+			embResp.Usage.TotalTokens += result.Usage.TotalTokens
+			if embResp.Model == "" {
+				embResp.Model = result.Model
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(embResp)
+	}
+}
+
+/*
+embeddingInputs accepts the OpenAI input forms we support: one string or an array of strings
+*/
+func embeddingInputs(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("Input field is required")
+	}
+
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		if single == "" {
+			return nil, fmt.Errorf("Input must not be empty")
+		}
+		return []string{single}, nil
+	}
+
+	var inputs []string
+	if json.Unmarshal(raw, &inputs) != nil {
+		return nil, fmt.Errorf("Input must be a string or an array of strings")
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("Input must not be empty")
+	}
+	if len(inputs) > maxEmbeddingInputs {
+		return nil, fmt.Errorf("At most %d inputs per request", maxEmbeddingInputs)
+	}
+	for _, input := range inputs {
+		if input == "" {
+			return nil, fmt.Errorf("Inputs must not be empty strings")
+		}
+	}
+	return inputs, nil
+}
+
+/*
+embedBatch sends one batch to an embedding-capable worker and checks it got a vector per input
+*/
+func embedBatch(ctx context.Context, p *pool.Pool, model string, batch []string) (*internal.EmbeddingResponse, error) {
+	body, err := json.Marshal(internal.EmbeddingRequest{Input: mustJSON(batch), Model: model})
+	if err != nil {
+		return nil, err
+	}
+
+	reply := submitRawAndWait(ctx, p, "/v1/embeddings", model, pool.CapabilityEmbeddings, body, nil, p.GetMaxRetries())
+	if pool.IsError(reply) {
+		return nil, fmt.Errorf("%s", reply)
+	}
+
+	var result internal.EmbeddingResponse
+	err = json.Unmarshal([]byte(reply), &result)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing embeddings: %v", err)
+	}
+	if len(result.Data) != len(batch) {
+		return nil, fmt.Errorf("Worker error: got %d embeddings for %d inputs", len(result.Data), len(batch))
+	}
+	return &result, nil
+}
+
+// mustJSON encodes values that can't fail to marshal, like string slices
+func mustJSON(v interface{}) json.RawMessage {
+	data, _ := json.Marshal(v)
+	return data
+}
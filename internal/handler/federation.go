@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gollama/internal"
+	"gollama/internal/federation"
+	"gollama/internal/pool"
+)
+
+// HandlePeerExecute runs a job a peer hub spilled over to this one. It speaks a worker's /execute
+// protocol, so to the peer this hub is one more pool member. Jobs only run on local workers: they
+// never hop on to a third hub.
+func HandlePeerExecute(p *pool.Pool, fed *federation.Federation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		peer := fed.Authenticate(r)
+		if peer == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var executeReq struct {
+			Endpoint string          `json:"endpoint"`
+			Body     json.RawMessage `json:"body"`
+			Affinity string          `json:"affinity"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&executeReq)
+		if err != nil || len(executeReq.Body) == 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if !federation.EndpointAllowed(executeReq.Endpoint) {
+			http.Error(w, "Endpoint not allowed: "+executeReq.Endpoint, http.StatusBadRequest)
+			return
+		}
+
+		var model struct {
+			Model string `json:"model"`
+		}
+		_ = json.Unmarshal(executeReq.Body, &model)
+		capability := ""
+		if executeReq.Endpoint == "/v1/embeddings" || executeReq.Endpoint == "/embedding" || executeReq.Endpoint == "/embeddings" {
+			capability = pool.CapabilityEmbeddings
+		}
+		if !p.HasLocalWorkerFor(model.Model, capability) {
+			// like a worker without the model: the peer tries elsewhere
+			http.Error(w, "No local worker serves model "+model.Model, http.StatusNotFound)
+			return
+		}
+
+		release, err := fed.Admit(peer)
+		if err != nil {
+			log.Printf("Federation: refused job from peer %s: %v", peer.Name, err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		ctx := r.Context()
+		if !peer.Trusted() {
+			ctx = pool.WithLowPriority(ctx)
+		}
+		var prefixes []string
+		if executeReq.Affinity != "" {
+			prefixes = []string{executeReq.Affinity}
+		}
+
+		reply := runJob(ctx, p, internal.WorkerJob{
+			Request:    internal.LlamaRequest{Model: model.Model},
+			Endpoint:   executeReq.Endpoint,
+			Body:       executeReq.Body,
+			Capability: capability,
+			Prefixes:   prefixes,
+			MaxRetries: p.GetMaxRetries(),
+			LocalOnly:  true,
+		})
+		if pool.IsError(reply) {
+			http.Error(w, reply, errorStatus(reply))
+			return
+		}
+
+		fed.Served(peer, []byte(reply))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(reply))
+	}
+}
+
+// HandlePeerModels tells a peer hub which models it can send here
+func HandlePeerModels(p *pool.Pool, fed *federation.Federation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fed.Authenticate(r) == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"models": p.LocalModels(),
+		})
+	}
+}
+
+// HandleFederation shows each peer hub's settings, activity and credit balance
+func HandleFederation(fed *federation.Federation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"peers": fed.Status(),
+		})
+	}
+}
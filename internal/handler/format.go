@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gollama/internal"
+	"gollama/internal/schema"
+)
+
+// maxGrammarBytes keeps GBNF grammars to a size llama.cpp compiles quickly
+const maxGrammarBytes = 64 << 10
+
+/*
+outputCheck is what the hub verifies about a constrained reply before returning it. GBNF grammars
+are enforced by llama.cpp alone; we don't parse them on the hub.
+*/
+type outputCheck struct {
+	json   bool           // reply must be a JSON object
+	schema *schema.Schema // and match this schema, when set
+}
+
+/*
+checkResponseFormat validates a client's response_format or grammar and returns how its output
+should be checked. Only one of the two may be given.
+*/
+func checkResponseFormat(rf *internal.ResponseFormat, grammar string) (outputCheck, error) {
+	if rf != nil && grammar != "" {
+		return outputCheck{}, fmt.Errorf("Send either response_format or grammar, not both")
+	}
+	if len(grammar) > maxGrammarBytes {
+		return outputCheck{}, fmt.Errorf("Grammar must be at most %d bytes", maxGrammarBytes)
+	}
+	if rf == nil {
+		return outputCheck{}, nil
+	}
+
+	switch rf.Type {
+	case "text":
+		return outputCheck{}, nil
+	case "json_object":
+		return outputCheck{json: true}, nil
+	case "json_schema":
+		if rf.JSONSchema == nil || len(rf.JSONSchema.Schema) == 0 {
+			return outputCheck{}, fmt.Errorf("response_format json_schema needs a json_schema.schema")
+		}
+		s, err := schema.Parse(rf.JSONSchema.Schema)
+		if err != nil {
+			return outputCheck{}, fmt.Errorf("response_format: %v", err)
+		}
+		return outputCheck{json: true, schema: s}, nil
+	}
+	return outputCheck{}, fmt.Errorf("response_format type must be text, json_object or json_schema")
+}
+
+/*
+verify checks a reply's content against the requested format
+*/
+func (c outputCheck) verify(content string) error {
+	if !c.json {
+		return nil
+	}
+
+	var value interface{}
+	err := json.Unmarshal([]byte(strings.TrimSpace(content)), &value)
+	if err != nil {
+		return fmt.Errorf("reply is not JSON: %v", err)
+	}
+	if _, ok := value.(map[string]interface{}); !ok && c.schema == nil {
+		return fmt.Errorf("reply is not a JSON object")
+	}
+	if c.schema != nil {
+		return c.schema.Validate(value)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"gollama/internal"
+	"gollama/internal/pool"
+	"gollama/internal/templates"
+)
+
+/*
+submitAndWait queues a request on the pool and blocks until a worker replies. Replies starting with
+"Error" or "Worker" are failures (see pool.IsError). validate, if set, rejects bad output: it's
+retried on another worker and never cached.
+*/
+func submitAndWait(ctx context.Context, p *pool.Pool, req internal.LlamaRequest, maxRetries int, validate func(reply string) error) string {
+	return waitForJob(ctx, p, internal.WorkerJob{
+		Request:    req,
+		MaxRetries: maxRetries,
+		Validate:   validate,
+	})
+}
+
+/*
+submitRawAndWait queues a request body for a specific llama.cpp endpoint and blocks until a worker
+replies with llama.cpp's raw JSON response. capability restricts which workers can take the job;
+prefixes (see pool.PromptKeys) route it to a worker likely to have the prompt cached.
+*/
+func submitRawAndWait(ctx context.Context, p *pool.Pool, endpoint string, model string, capability string, body []byte, prefixes []string, maxRetries int) string {
+	return waitForJob(ctx, p, internal.WorkerJob{
+		Request:    internal.LlamaRequest{Model: model},
+		Endpoint:   endpoint,
+		Body:       body,
+		Capability: capability,
+		Prefixes:   prefixes,
+		MaxRetries: maxRetries,
+	})
+}
+
+/*
+waitForJob assigns the job a worker, queues it and blocks until it has a reply. If ctx ends first
+(the client disconnected or the job was cancelled), the job is abandoned and the pool drops it.
+Deterministic jobs are answered from the response cache when possible, and their replies cached.
+Only replies that pass the job's Validate are cached, and a cached reply that fails it (say, one
+stored before the check existed) is evicted and the job run again.
+*/
+func waitForJob(ctx context.Context, p *pool.Pool, job internal.WorkerJob) string {
+	if job.Body == nil {
+		job.Request.CachePrompt = promptCaching(job.Request.CachePrompt)
+		if job.Prefixes == nil {
+			job.Prefixes = pool.MessageKeys(job.Request.Messages)
+		}
+	}
+
+	key, cacheable := "", false
+	if responseCache != nil {
+		key, cacheable = cacheKey(job)
+	}
+	if cacheable {
+		reply, hit := responseCache.Get(key)
+		if hit && job.Validate != nil && job.Validate(reply) != nil {
+			responseCache.Delete(key)
+			hit = false
+		}
+		recordCacheLookup(ctx, hit)
+		if hit {
+			return reply
+		}
+	}
+
+	reply := runJob(ctx, p, job)
+	if cacheable && !pool.IsError(reply) {
+		responseCache.Put(key, reply)
+	}
+	return reply
+}
+
+/*
+errorStatus is the HTTP status for a failed job's reply: 400 when a worker rejected the request as
+invalid, 502 for anything else
+*/
+func errorStatus(reply string) int {
+	if pool.IsRejected(reply) {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+/*
+runJob submits the job to the pool and waits for its reply
+*/
+func runJob(ctx context.Context, p *pool.Pool, job internal.WorkerJob) string {
+	job.WorkerURL = p.GetWorkerForJob(job)
+	if job.WorkerURL == "" {
+		return "Error: No available workers"
+	}
+
+	job.Ctx = ctx
+	job.ReplyCh = make(chan string, 1) // buffered so the pool never blocks on an abandoned job
+	job.RetryCount = 0
+	p.SubmitJob(job)
+
+	select {
+	case reply := <-job.ReplyCh:
+		return reply
+	case <-ctx.Done():
+		return "Error: request cancelled"
+	}
+}
+
+/*
+renderTemplate builds the llama.cpp request for a named prompt template and returns it with the
+template's retry limit (the pool default when the template doesn't set one). A model chosen by the
+client wins over the template's model.
+*/
+func renderTemplate(p *pool.Pool, reg *templates.Registry, name string, model string, data interface{}) (internal.LlamaRequest, int, error) {
+	tmpl, ok := reg.Get(name)
+	if !ok {
+		return internal.LlamaRequest{}, 0, fmt.Errorf("template %s is not defined", name)
+	}
+
+	req, err := tmpl.Build(data)
+	if err != nil {
+		return req, 0, err
+	}
+	if model != "" {
+		req.Model = model
+	}
+
+	retries := tmpl.MaxRetries
+	if retries == 0 {
+		retries = p.GetMaxRetries()
+	}
+	return req, retries, nil
+}
+
+/*
+promptCaching turns llama.cpp's cache_prompt on unless the client chose otherwise, so a worker can
+reuse the KV cache of a prompt prefix it has already processed
+*/
+func promptCaching(cachePrompt *bool) *bool {
+	if cachePrompt != nil {
+		return cachePrompt
+	}
+	on := true
+	return &on
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"gollama/internal"
+	"gollama/internal/jobs"
+)
+
+// HandleSubmitJob queues a request to run asynchronously and returns its job ID right away. A
+// resubmission with the same Idempotency-Key header returns the original job with 200 instead of 202,
+// or 422 if the original was a different request.
+func HandleSubmitJob(store *jobs.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var jobReq internal.JobRequest
+		err := json.NewDecoder(r.Body).Decode(&jobReq)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		job, created, err := store.Submit(jobReq.Endpoint, jobReq.Body, jobReq.CallbackURL, r.Header.Get("Idempotency-Key"))
+		var invalid *jobs.InvalidError
+		if errors.As(err, &invalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, jobs.ErrKeyReused) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			// the queue couldn't take the job; resubmitting with the same Idempotency-Key is safe
+			log.Printf("Failed to queue async job: %v", err)
+			http.Error(w, "Job queue unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		if created {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		_ = json.NewEncoder(w).Encode(job)
+	}
+}
+
+// HandleJob returns an async job's status and result (GET) or cancels it (DELETE)
+func HandleJob(store *jobs.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		var job jobs.Job
+		var ok bool
+		switch r.Method {
+		case "GET":
+			job, ok = store.Get(id)
+		case "DELETE":
+			job, ok = store.Cancel(id)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !ok {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(job)
+	}
+}
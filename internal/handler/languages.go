@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"sort"
+	"strings"
+)
+
+/*
+languageNames maps ISO 639-1 codes to English language names. The names are what we show the model;
+the codes are what clients send and get back.
+*/
+var languageNames = map[string]string{
+	"af": "Afrikaans", "am": "Amharic", "ar": "Arabic", "az": "Azerbaijani", "be": "Belarusian",
+	"bg": "Bulgarian", "bn": "Bengali", "bs": "Bosnian", "ca": "Catalan", "cs": "Czech",
+	"cy": "Welsh", "da": "Danish", "de": "German", "el": "Greek", "en": "English",
+	"eo": "Esperanto", "es": "Spanish", "et": "Estonian", "eu": "Basque", "fa": "Persian",
+	"fi": "Finnish", "fr": "French", "ga": "Irish", "gl": "Galician",
+	"gu": "Gujarati", "ha": "Hausa", "he": "Hebrew", "hi": "Hindi", "hr": "Croatian",
+	"ht": "Haitian Creole", "hu": "Hungarian", "hy": "Armenian", "id": "Indonesian", "ig": "Igbo",
+	"is": "Icelandic", "it": "Italian", "ja": "Japanese", "jv": "Javanese", "ka": "Georgian",
+	"kk": "Kazakh", "km": "Khmer", "kn": "Kannada", "ko": "Korean", "ku": "Kurdish",
+	"ky": "Kyrgyz", "la": "Latin", "lb": "Luxembourgish", "lo": "Lao", "lt": "Lithuanian",
+	"lv": "Latvian", "mg": "Malagasy", "mi": "Maori", "mk": "Macedonian", "ml": "Malayalam",
+	"mn": "Mongolian", "mr": "Marathi", "ms": "Malay", "mt": "Maltese", "my": "Burmese",
+	"ne": "Nepali", "nl": "Dutch", "no": "Norwegian", "pa": "Punjabi", "pl": "Polish",
+	"ps": "Pashto", "pt": "Portuguese", "ro": "Romanian", "ru": "Russian", "rw": "Kinyarwanda",
+	"si": "Sinhala", "sk": "Slovak", "sl": "Slovenian", "sm": "Samoan", "sn": "Shona",
+	"so": "Somali", "sq": "Albanian", "sr": "Serbian", "st": "Sesotho", "su": "Sundanese",
+	"sv": "Swedish", "sw": "Swahili", "ta": "Tamil", "te": "Telugu", "tg": "Tajik",
+	"th": "Thai", "tk": "Turkmen", "tl": "Tagalog", "tr": "Turkish", "uk": "Ukrainian",
+	"ur": "Urdu", "uz": "Uzbek", "vi": "Vietnamese", "xh": "Xhosa", "yi": "Yiddish",
+	"yo": "Yoruba", "zh": "Chinese", "zu": "Zulu",
+}
+
+/*
+normalizeLanguage resolves an ISO 639-1 code, or for older clients an English language name, to the
+canonical lowercase code. Returns false if the language is not recognized.
+*/
+func normalizeLanguage(language string) (string, bool) {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if _, ok := languageNames[language]; ok {
+		return language, true
+	}
+
+	// Accept region-qualified codes like "pt-BR" by their base language
+	if base, _, found := strings.Cut(language, "-"); found {
+		if _, ok := languageNames[base]; ok {
+			return base, true
+		}
+	}
+
+	for code, name := range languageNames {
+		if strings.ToLower(name) == language {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+/*
+languageCodes returns every supported code, used to constrain language detection output
+*/
+func languageCodes() []string {
+	codes := make([]string, 0, len(languageNames))
+	for code := range languageNames {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes) // stable order keeps the generated schema identical between requests
+	return codes
+}
@@ -1,23 +1,38 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 
 	"gollama/internal"
 	"gollama/internal/pool"
+	"gollama/internal/templates"
 )
 
-// HandleSentiment processes sentiment analysis requests from clients
-func HandleSentiment(p *pool.Pool) http.HandlerFunc {
+// sentimentLabels are the only labels the model is allowed to produce
+var sentimentLabels = []string{"positive", "negative", "neutral", "mixed"}
+
+// Batch limit for /sentiment
+const (
+	maxSentimentBatch = 100
+)
+
+// HandleSentiment processes sentiment analysis requests from clients. The model's output is constrained
+// to a JSON schema so clients always get a clean label, confidence and rationale.
+func HandleSentiment(p *pool.Pool, reg *templates.Registry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
+		ctx := r.Context()
+
 		var sentReq internal.SentimentRequest
 		err := json.NewDecoder(r.Body).Decode(&sentReq)
 		if err != nil {
@@ -25,46 +40,198 @@ func HandleSentiment(p *pool.Pool) http.HandlerFunc {
 			return
 		}
 
-		if sentReq.Text == "" {
-			http.Error(w, "Text field is required", http.StatusBadRequest)
+		if sentReq.Text == "" && len(sentReq.Texts) == 0 {
+			http.Error(w, "Text or texts field is required", http.StatusBadRequest)
+			return
+		}
+
+		if sentReq.Text != "" && len(sentReq.Texts) > 0 {
+			http.Error(w, "Send either text or texts, not both", http.StatusBadRequest)
 			return
 		}
 
+		if len(sentReq.Texts) > maxSentimentBatch {
+			http.Error(w, fmt.Sprintf("At most %d texts per request", maxSentimentBatch), http.StatusBadRequest)
+			return
+		}
+
+		for _, aspect := range sentReq.Aspects {
+			if strings.TrimSpace(aspect) == "" {
+				http.Error(w, "Aspects must not be empty", http.StatusBadRequest)
+				return
+			}
+		}
+
 		if p.GetWorkerCount() == 0 {
 			http.Error(w, "No workers available", http.StatusServiceUnavailable)
 			return
 		}
 
-		log.Printf("Received sentiment analysis request for text: %s...", truncateString(sentReq.Text, 50))
+		var sentResp internal.SentimentResponse
+		if sentReq.Text != "" {
+			log.Printf("Received sentiment analysis request for text: %s...", truncateString(sentReq.Text, 50))
 
-		// Construct the sentiment analysis prompt
-		prompt := fmt.Sprintf("Analyze the sentiment of the following text and respond with only one word: positive, negative, or neutral.\n\nText: %s\n\nSentiment:", sentReq.Text)
+			result := analyzeSentiment(ctx, p, reg, sentReq, sentReq.Text)
+			if result.Error != "" {
+				http.Error(w, result.Error, errorStatus(result.Error))
+				return
+			}
+			sentResp.Sentiment = result.Label
+			sentResp.Result = &result
+		} else {
+			log.Printf("Received sentiment analysis batch of %d texts", len(sentReq.Texts))
 
-		llamaReq := internal.LlamaRequest{
-			Messages: []internal.Message{
-				{Role: "user", Content: prompt},
-			},
-			MaxTokens: 50,
+			sentResp.Results = make([]internal.SentimentResult, len(sentReq.Texts))
+			var wg sync.WaitGroup
+			for i, text := range sentReq.Texts {
+				wg.Add(1)
+				go func(i int, text string) {
+					defer wg.Done()
+					sentResp.Results[i] = analyzeSentiment(ctx, p, reg, sentReq, text)
+				}(i, text)
+			}
+			wg.Wait()
 		}
 
-		replyCh := make(chan string)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(sentResp)
+	}
+}
 
-		job := internal.WorkerJob{
-			Request:    llamaReq,
-			ReplyCh:    replyCh,
-			WorkerURL:  p.GetWorker(),
-			RetryCount: 0,
-			MaxRetries: 3,
+/*
+analyzeSentiment runs one text through the pool with schema-constrained output and validates the result.
+Failures are reported in the result's Error field so one bad text doesn't sink a whole batch.
+*/
+func analyzeSentiment(ctx context.Context, p *pool.Pool, reg *templates.Registry, sentReq internal.SentimentRequest, text string) internal.SentimentResult {
+	llamaReq, maxRetries, err := renderTemplate(p, reg, "sentiment", sentReq.Model, sentimentData{Text: text, Aspects: sentReq.Aspects})
+	if err != nil {
+		return internal.SentimentResult{Error: fmt.Sprintf("Error: %v", err)}
+	}
+	llamaReq.ResponseFormat = &internal.ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &internal.JSONSchema{
+			Name:   "sentiment",
+			Schema: sentimentSchema(sentReq.Aspects),
+		},
+	}
+
+	// Output that fails validation is retried on another worker, and never cached
+	reply := submitAndWait(ctx, p, llamaReq, maxRetries, func(reply string) error {
+		_, err := parseSentiment(reply, sentReq.Aspects)
+		if err != nil {
+			return fmt.Errorf("invalid sentiment output: %v", err)
 		}
-		log.Printf("Sentiment job assigned to worker: %s", job.WorkerURL)
+		return nil
+	})
+	if pool.IsError(reply) {
+		return internal.SentimentResult{Error: reply}
+	}
 
-		p.SubmitJob(job)
-		reply := <-replyCh
+	result, err := parseSentiment(reply, sentReq.Aspects)
+	if err != nil {
+		return internal.SentimentResult{Error: fmt.Sprintf("Error: invalid sentiment output: %v", err)}
+	}
+	return result
+}
 
-		sentResp := internal.SentimentResponse{Sentiment: reply}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(sentResp)
+// sentimentData is what the sentiment template is rendered with
+type sentimentData struct {
+	Text    string
+	Aspects []string
+}
+
+/*
+sentimentSchema builds the JSON schema llama.cpp uses to constrain the output
+*/
+func sentimentSchema(aspects []string) json.RawMessage {
+	required := []string{"label", "confidence", "rationale"}
+	properties := sentimentProperties()
+
+	if len(aspects) > 0 {
+		aspectProperties := sentimentProperties()
+		aspectProperties["aspect"] = map[string]interface{}{"type": "string", "enum": aspects}
+		properties["aspects"] = map[string]interface{}{
+			"type":     "array",
+			"minItems": len(aspects),
+			"maxItems": len(aspects),
+			"items": map[string]interface{}{
+				"type":       "object",
+				"properties": aspectProperties,
+				"required":   append([]string{"aspect"}, required...),
+			},
+		}
+		required = append(required, "aspects")
+	}
+
+	schema, _ := json.Marshal(map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	})
+	return schema
+}
+
+/*
+sentimentProperties returns the schema properties shared by the overall and per-aspect sentiment
+*/
+func sentimentProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"label":      map[string]interface{}{"type": "string", "enum": sentimentLabels},
+		"confidence": map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1},
+		"rationale":  map[string]interface{}{"type": "string"},
+	}
+}
+
+/*
+parseSentiment decodes and validates the model's JSON. Grammar-constrained output should always pass,
+but workers running older llama.cpp builds may ignore response_format.
+*/
+func parseSentiment(reply string, aspects []string) (internal.SentimentResult, error) {
+	var result internal.SentimentResult
+	err := json.Unmarshal([]byte(strings.TrimSpace(reply)), &result)
+	if err != nil {
+		return result, fmt.Errorf("not JSON: %w", err)
+	}
+	result.Error = "" // only the hub reports errors, never the model
+
+	if err := validateSentiment(result.Label, result.Confidence); err != nil {
+		return result, err
+	}
+
+	if len(aspects) == 0 {
+		result.Aspects = nil
+		return result, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range result.Aspects {
+		if err := validateSentiment(a.Label, a.Confidence); err != nil {
+			return result, fmt.Errorf("aspect %s: %w", a.Aspect, err)
+		}
+		seen[a.Aspect] = true
+	}
+	for _, aspect := range aspects {
+		if !seen[aspect] {
+			return result, fmt.Errorf("missing aspect %s", aspect)
+		}
+	}
+	return result, nil
+}
+
+func validateSentiment(label string, confidence float64) error {
+	validLabel := false
+	for _, l := range sentimentLabels {
+		if label == l {
+			validLabel = true
+		}
+	}
+	if !validLabel {
+		return fmt.Errorf("unknown label %q", label)
+	}
+	if confidence < 0 || confidence > 1 {
+		return fmt.Errorf("confidence %v out of range", confidence)
 	}
+	return nil
 }
 
 // truncateString is a helper function to truncate long strings for logging
@@ -21,6 +21,13 @@ func HandleStats(p *pool.Pool) http.HandlerFunc {
 		response := map[string]interface{}{
 			"total_workers": p.GetWorkerCount(),
 			"workers":       formatWorkerStats(stats),
+			"retries":       p.GetRetryStats(),
+		}
+		if hedging, ok := p.GetHedgeStats(); ok {
+			response["hedging"] = hedging
+		}
+		if responseCache != nil {
+			response["cache"] = responseCache.Stats()
 		}
 
 		_ = json.NewEncoder(w).Encode(response)
@@ -33,14 +40,22 @@ func formatWorkerStats(stats map[string]internal.WorkerStats) map[string]interfa
 	for url, stat := range stats {
 		uptime := time.Since(stat.StartTime)
 
-		formatted[url] = map[string]interface{}{
+		entry := map[string]interface{}{
+			"name":           stat.Name,
+			"models":         stat.Models,
 			"jobs_completed": stat.JobsCompleted,
 			"jobs_failed":    stat.JobsFailed,
 			"uptime_seconds": int(uptime.Seconds()),
 			"uptime_pretty":  uptime.Round(time.Second).String(),
 			"start_time":     stat.StartTime.Format(time.RFC3339),
 			"score":          calculateWorkerScore(stat, uptime),
+			"latency":        stat.Latency,
+			"breaker":        stat.Breaker,
+		}
+		if stat.Peer {
+			entry["peer"] = true
 		}
+		formatted[url] = entry
 	}
 
 	return formatted
@@ -1,26 +1,49 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 
 	"gollama/internal"
 	"gollama/internal/pool"
+	"gollama/internal/templates"
 )
 
-// HandleSummarize processes summarization requests from clients
-func HandleSummarize(p *pool.Pool) http.HandlerFunc {
+// Chunking defaults used when workers haven't reported their context size
+const (
+	defaultChunkTokens = 1500
+	chunkOverlapTokens = 100
+	maxReduceRounds    = 4 // guards against summaries that never shrink
+	maxSummarizeBytes  = 8 << 20
+)
+
+// HandleSummarize processes summarization requests from clients. Documents longer than a worker's
+// context window are summarized map-reduce style: chunks are summarized in parallel across the pool,
+// then the partial summaries are combined into one. At most one chunk per worker is in flight at a
+// time, so a long document can't flood the queue ahead of other clients.
+func HandleSummarize(p *pool.Pool, reg *templates.Registry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
+		ctx := r.Context()
+
 		var sumReq internal.SummarizeRequest
-		err := json.NewDecoder(r.Body).Decode(&sumReq)
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSummarizeBytes)).Decode(&sumReq)
 		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Text too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
@@ -30,6 +53,16 @@ func HandleSummarize(p *pool.Pool) http.HandlerFunc {
 			return
 		}
 
+		if sumReq.Style != "" && sumReq.Style != "prose" && sumReq.Style != "bullets" {
+			http.Error(w, "Style must be prose or bullets", http.StatusBadRequest)
+			return
+		}
+
+		if sumReq.TargetWords < 0 {
+			http.Error(w, "target_words must be positive", http.StatusBadRequest)
+			return
+		}
+
 		if p.GetWorkerCount() == 0 {
 			http.Error(w, "No workers available", http.StatusServiceUnavailable)
 			return
@@ -37,36 +70,134 @@ func HandleSummarize(p *pool.Pool) http.HandlerFunc {
 
 		log.Printf("Received summarize request for text: %s...", truncate(sumReq.Text, 50))
 
-		// Construct the summarization prompt
-		prompt := fmt.Sprintf("Summarize the following text in a concise manner:\n\n%s", sumReq.Text)
+		chunks := splitByTokenBudget(sumReq.Text, chunkBudget(p, sumReq.Model), chunkOverlapTokens)
+		sumResp := internal.SummarizeResponse{Chunks: len(chunks)}
 
-		llamaReq := internal.LlamaRequest{
-			Messages: []internal.Message{
-				{Role: "user", Content: prompt},
-			},
-			MaxTokens: 150,
+		var summary string
+		if len(chunks) == 1 {
+			summary, err = runSummary(ctx, p, reg, "summarize", sumReq, sumReq.Text)
+		} else {
+			log.Printf("Summarize: document split into %d chunks", len(chunks))
+			var partials []string
+			partials, err = summarizeChunks(ctx, p, reg, sumReq, chunks)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			if sumReq.ReturnChunks {
+				sumResp.ChunkSummaries = partials
+			}
+			summary, err = reduceSummaries(ctx, p, reg, sumReq, partials)
 		}
-
-		replyCh := make(chan string)
-
-		job := internal.WorkerJob{
-			Request:    llamaReq,
-			ReplyCh:    replyCh,
-			WorkerURL:  p.GetWorker(),
-			RetryCount: 0,
-			MaxRetries: 3,
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
 		}
-		log.Printf("Summarize job assigned to worker: %s", job.WorkerURL)
 
-		p.SubmitJob(job)
-		reply := <-replyCh
+		if pool.IsError(summary) {
+			http.Error(w, summary, errorStatus(summary))
+			return
+		}
 
-		sumResp := internal.SummarizeResponse{Summary: reply}
+		sumResp.Summary = summary
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(sumResp)
 	}
 }
 
+/*
+chunkBudget sizes chunks to half the smallest context window serving the model, leaving room for the
+prompt and the generated summary
+*/
+func chunkBudget(p *pool.Pool, model string) int {
+	if ctx := p.MinContextSize(model); ctx > 0 {
+		return ctx / 2
+	}
+	return defaultChunkTokens
+}
+
+/*
+summarizeChunks fans the chunks out across the pool in parallel, no more at once than there are
+workers, and returns their summaries in order
+*/
+func summarizeChunks(ctx context.Context, p *pool.Pool, reg *templates.Registry, sumReq internal.SummarizeRequest, chunks []string) ([]string, error) {
+	summaries := make([]string, len(chunks))
+	errs := make([]error, len(chunks))
+	slots := make(chan struct{}, max(p.GetWorkerCount(), 1))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err() // the client is gone; don't start the rest
+			break
+		}
+		wg.Add(1)
+		go func(i int, chunk string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			summaries[i], errs[i] = runSummary(ctx, p, reg, "summarize_chunk", sumReq, chunk)
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	for i, s := range summaries {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if pool.IsError(s) {
+			return nil, fmt.Errorf("chunk %d of %d failed: %s", i+1, len(chunks), s)
+		}
+	}
+	return summaries, nil
+}
+
+/*
+reduceSummaries combines partial summaries into the final summary. If the partials are themselves too
+long for one prompt, they are chunked and summarized again until they fit.
+*/
+func reduceSummaries(ctx context.Context, p *pool.Pool, reg *templates.Registry, sumReq internal.SummarizeRequest, partials []string) (string, error) {
+	budget := chunkBudget(p, sumReq.Model)
+	for round := 0; round < maxReduceRounds; round++ {
+		combined := strings.Join(partials, "\n\n")
+		if estimateTokens(combined) <= budget {
+			return runSummary(ctx, p, reg, "summarize_combine", sumReq, combined)
+		}
+
+		var err error
+		partials, err = summarizeChunks(ctx, p, reg, sumReq, splitByTokenBudget(combined, budget, chunkOverlapTokens))
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("document too long to summarize")
+}
+
+// summaryData is what the summarize templates are rendered with
+type summaryData struct {
+	Text        string
+	Style       string
+	TargetWords int
+}
+
+/*
+runSummary renders one of the summarize templates and runs it on the pool. When the client asked for
+a length, the final summary is sized for it rather than the template's max_tokens.
+*/
+func runSummary(ctx context.Context, p *pool.Pool, reg *templates.Registry, name string, sumReq internal.SummarizeRequest, text string) (string, error) {
+	data := summaryData{Text: text, Style: sumReq.Style, TargetWords: sumReq.TargetWords}
+	req, maxRetries, err := renderTemplate(p, reg, name, sumReq.Model, data)
+	if err != nil {
+		return "", err
+	}
+	if sumReq.TargetWords > 0 && name != "summarize_chunk" {
+		req.MaxTokens = sumReq.TargetWords * 2 // words are ~1.3 tokens; leave headroom so output isn't cut off
+	}
+	return submitAndWait(ctx, p, req, maxRetries, nil), nil
+}
+
 // truncate is a helper function to truncate long strings for logging
 func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
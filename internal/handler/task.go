@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"gollama/internal"
+	"gollama/internal/pool"
+	"gollama/internal/templates"
+)
+
+// HandleTask runs a task template registered with an input schema. The input is validated before any
+// worker sees it, and JSON output is validated against the task's output schema (or the client's
+// response_format) before it's returned; output that fails is retried on another worker.
+func HandleTask(p *pool.Pool, reg *templates.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx := r.Context()
+
+		name := r.PathValue("name")
+		tmpl, ok := reg.Get(name)
+		if !ok || !tmpl.IsTask() {
+			http.Error(w, fmt.Sprintf("Unknown task %q", name), http.StatusNotFound)
+			return
+		}
+
+		var taskReq internal.TaskRequest
+		err := json.NewDecoder(r.Body).Decode(&taskReq)
+		if err != nil || len(taskReq.Input) == 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		var input map[string]interface{}
+		err = json.Unmarshal(taskReq.Input, &input)
+		if err != nil {
+			http.Error(w, "Input must be a JSON object", http.StatusBadRequest)
+			return
+		}
+		err = tmpl.InputSchema().Validate(input)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid input: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		custom, err := checkResponseFormat(taskReq.ResponseFormat, taskReq.Grammar)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Optional fields the client left out render as empty rather than failing the template
+		for field := range tmpl.InputSchema().Properties {
+			if _, ok := input[field]; !ok {
+				input[field] = nil
+			}
+		}
+
+		if p.GetWorkerCount() == 0 {
+			http.Error(w, "No workers available", http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Printf("Received task %s", name)
+
+		llamaReq, maxRetries, err := renderTemplate(p, reg, name, taskReq.Model, input)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Task %s failed to render: %v", name, err), http.StatusBadRequest)
+			return
+		}
+
+		// The task's own output schema applies unless the client asked for a different format
+		check := outputCheck{json: tmpl.OutputSchema() != nil, schema: tmpl.OutputSchema()}
+		if taskReq.ResponseFormat != nil || taskReq.Grammar != "" {
+			check = custom
+			llamaReq.ResponseFormat = taskReq.ResponseFormat
+			llamaReq.Grammar = taskReq.Grammar
+		}
+
+		reply := waitForJob(ctx, p, internal.WorkerJob{
+			Request:    llamaReq,
+			MaxRetries: maxRetries,
+			Validate:   check.verify,
+		})
+		if pool.IsError(reply) {
+			http.Error(w, reply, errorStatus(reply))
+			return
+		}
+
+		taskResp := internal.TaskResponse{Task: name}
+		if check.json {
+			taskResp.Output = json.RawMessage(strings.TrimSpace(reply))
+		} else {
+			taskResp.Text = reply
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(taskResp)
+	}
+}
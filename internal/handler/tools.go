@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"gollama/internal"
+	"gollama/internal/schema"
+)
+
+// toolName is the OpenAI restriction on function names, which some chat templates rely on
+var toolName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Limits on tool definitions per chat request
+const maxTools = 128
+
+/*
+checkTools validates tool definitions and returns the parsed parameter schema of each by name, so
+the calls the model makes can be checked against them
+*/
+func checkTools(tools []internal.Tool) (map[string]*schema.Schema, error) {
+	if len(tools) > maxTools {
+		return nil, fmt.Errorf("At most %d tools per request", maxTools)
+	}
+
+	params := make(map[string]*schema.Schema, len(tools))
+	for i, tool := range tools {
+		if tool.Type != "function" {
+			return nil, fmt.Errorf("tools[%d]: type must be function", i)
+		}
+		name := tool.Function.Name
+		if !toolName.MatchString(name) {
+			return nil, fmt.Errorf("tools[%d]: function name must be 1-64 letters, digits, underscores or dashes", i)
+		}
+		if _, dup := params[name]; dup {
+			return nil, fmt.Errorf("tools[%d]: duplicate function %s", i, name)
+		}
+
+		params[name] = nil
+		if len(tool.Function.Parameters) > 0 {
+			s, err := schema.Parse(tool.Function.Parameters)
+			if err != nil {
+				return nil, fmt.Errorf("tools[%d] parameters: %v", i, err)
+			}
+			params[name] = s
+		}
+	}
+	return params, nil
+}
+
+/*
+checkToolChoice accepts "auto", "none", "required" or a specific function that is one of the tools
+*/
+func checkToolChoice(choice json.RawMessage, tools map[string]*schema.Schema) error {
+	if len(choice) == 0 {
+		return nil
+	}
+	if len(tools) == 0 {
+		return fmt.Errorf("tool_choice requires tools")
+	}
+
+	var mode string
+	if json.Unmarshal(choice, &mode) == nil {
+		if mode != "auto" && mode != "none" && mode != "required" {
+			return fmt.Errorf("tool_choice must be auto, none, required or a function")
+		}
+		return nil
+	}
+
+	var named struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if json.Unmarshal(choice, &named) != nil || named.Type != "function" {
+		return fmt.Errorf("tool_choice must be auto, none, required or a function")
+	}
+	if _, ok := tools[named.Function.Name]; !ok {
+		return fmt.Errorf("tool_choice names unknown function %s", named.Function.Name)
+	}
+	return nil
+}
+
+/*
+checkMessages validates a conversation: known roles, and every tool result answering a call the
+assistant made earlier in the conversation
+*/
+func checkMessages(messages []internal.Message) error {
+	calls := make(map[string]bool)
+	for i, m := range messages {
+		switch m.Role {
+		case "system", "user":
+			if m.Content == "" {
+				return fmt.Errorf("messages[%d]: content is required", i)
+			}
+		case "assistant":
+			if m.Content == "" && len(m.ToolCalls) == 0 {
+				return fmt.Errorf("messages[%d]: assistant messages need content or tool_calls", i)
+			}
+			for _, call := range m.ToolCalls {
+				if call.ID == "" {
+					return fmt.Errorf("messages[%d]: tool calls need an id", i)
+				}
+				calls[call.ID] = true
+			}
+		case "tool":
+			if !calls[m.ToolCallID] {
+				return fmt.Errorf("messages[%d]: tool_call_id %q doesn't match an earlier tool call", i, m.ToolCallID)
+			}
+		default:
+			return fmt.Errorf("messages[%d]: unknown role %q", i, m.Role)
+		}
+	}
+	return nil
+}
+
+/*
+checkToolCalls verifies the model only called declared tools, with arguments that are a JSON object
+matching the tool's parameters. IDs and types are filled in when the chat template didn't produce them.
+*/
+func checkToolCalls(calls []internal.ToolCall, tools map[string]*schema.Schema) error {
+	for i := range calls {
+		call := &calls[i]
+		s, ok := tools[call.Function.Name]
+		if !ok {
+			return fmt.Errorf("model called unknown tool %q", call.Function.Name)
+		}
+
+		var args interface{}
+		err := json.Unmarshal([]byte(call.Function.Arguments), &args)
+		if err != nil {
+			return fmt.Errorf("arguments for %s are not JSON: %v", call.Function.Name, err)
+		}
+		if s != nil {
+			if err := s.Validate(args); err != nil {
+				return fmt.Errorf("arguments for %s: %v", call.Function.Name, err)
+			}
+		}
+
+		if call.Type == "" {
+			call.Type = "function"
+		}
+		if call.ID == "" {
+			call.ID = fmt.Sprintf("call_%d", i)
+		}
+	}
+	return nil
+}
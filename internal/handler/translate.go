@@ -1,23 +1,38 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"regexp"
+	"strings"
+	"sync"
 
 	"gollama/internal"
 	"gollama/internal/pool"
+	"gollama/internal/templates"
 )
 
+// Batch limit for /translate
+const (
+	maxTranslateBatch = 100
+)
+
+// markupTag matches opening and closing HTML tags so we can check they survived translation
+var markupTag = regexp.MustCompile(`</?([a-zA-Z][a-zA-Z0-9]*)`)
+
 // HandleTranslate processes translation requests from clients
-func HandleTranslate(p *pool.Pool) http.HandlerFunc {
+func HandleTranslate(p *pool.Pool, reg *templates.Registry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
+		ctx := r.Context()
+
 		var transReq internal.TranslateRequest
 		err := json.NewDecoder(r.Body).Decode(&transReq)
 		if err != nil {
@@ -25,8 +40,18 @@ func HandleTranslate(p *pool.Pool) http.HandlerFunc {
 			return
 		}
 
-		if transReq.Text == "" {
-			http.Error(w, "Text field is required", http.StatusBadRequest)
+		if transReq.Text == "" && len(transReq.Texts) == 0 {
+			http.Error(w, "Text or texts field is required", http.StatusBadRequest)
+			return
+		}
+
+		if transReq.Text != "" && len(transReq.Texts) > 0 {
+			http.Error(w, "Send either text or texts, not both", http.StatusBadRequest)
+			return
+		}
+
+		if len(transReq.Texts) > maxTranslateBatch {
+			http.Error(w, fmt.Sprintf("At most %d texts per request", maxTranslateBatch), http.StatusBadRequest)
 			return
 		}
 
@@ -35,41 +60,214 @@ func HandleTranslate(p *pool.Pool) http.HandlerFunc {
 			return
 		}
 
+		target, ok := normalizeLanguage(transReq.Language)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unsupported language %q: use an ISO 639-1 code such as es or ja", transReq.Language), http.StatusBadRequest)
+			return
+		}
+		transReq.Language = target
+
+		if transReq.SourceLanguage != "" {
+			source, ok := normalizeLanguage(transReq.SourceLanguage)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Unsupported source language %q", transReq.SourceLanguage), http.StatusBadRequest)
+				return
+			}
+			transReq.SourceLanguage = source
+		}
+
+		switch transReq.Format {
+		case "":
+			transReq.Format = "text"
+		case "text", "markdown", "html":
+		default:
+			http.Error(w, "Format must be text, markdown or html", http.StatusBadRequest)
+			return
+		}
+
 		if p.GetWorkerCount() == 0 {
 			http.Error(w, "No workers available", http.StatusServiceUnavailable)
 			return
 		}
 
-		log.Printf("Received translate request to %s for text: %s...", transReq.Language, truncateText(transReq.Text, 50))
+		transResp := internal.TranslateResponse{TargetLanguage: target}
+		if transReq.Text != "" {
+			log.Printf("Received translate request to %s for text: %s...", target, truncateText(transReq.Text, 50))
 
-		// Construct the translation prompt
-		prompt := fmt.Sprintf("Translate the following text to %s:\n\n%s", transReq.Language, transReq.Text)
+			result := translateOne(ctx, p, reg, transReq, transReq.Text)
+			if result.Error != "" {
+				http.Error(w, result.Error, errorStatus(result.Error))
+				return
+			}
+			transResp.Translation = result.Translation
+			transResp.SourceLanguage = result.SourceLanguage
+		} else {
+			log.Printf("Received translate batch of %d texts to %s", len(transReq.Texts), target)
 
-		llamaReq := internal.LlamaRequest{
-			Messages: []internal.Message{
-				{Role: "user", Content: prompt},
-			},
-			MaxTokens: 200,
+			transResp.Translations = make([]internal.TranslationResult, len(transReq.Texts))
+			var wg sync.WaitGroup
+			for i, text := range transReq.Texts {
+				wg.Add(1)
+				go func(i int, text string) {
+					defer wg.Done()
+					transResp.Translations[i] = translateOne(ctx, p, reg, transReq, text)
+				}(i, text)
+			}
+			wg.Wait()
 		}
 
-		replyCh := make(chan string)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(transResp)
+	}
+}
+
+/*
+translateOne translates a single text. The model answers with a JSON object holding the detected
+source language and the translation, which is then checked for glossary and markup compliance.
+*/
+func translateOne(ctx context.Context, p *pool.Pool, reg *templates.Registry, transReq internal.TranslateRequest, text string) internal.TranslationResult {
+	data := translateData{
+		Text:           text,
+		SourceLanguage: languageNames[transReq.SourceLanguage],
+		TargetLanguage: languageNames[transReq.Language],
+		Format:         transReq.Format,
+		Glossary:       transReq.Glossary,
+		DoNotTranslate: transReq.DoNotTranslate,
+	}
+	llamaReq, maxRetries, err := renderTemplate(p, reg, "translate", transReq.Model, data)
+	if err != nil {
+		return internal.TranslationResult{Error: fmt.Sprintf("Error: %v", err)}
+	}
+	// translations run a little longer than their source in most languages
+	llamaReq.MaxTokens = max(llamaReq.MaxTokens, estimateTokens(text)*2)
+	llamaReq.ResponseFormat = &internal.ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &internal.JSONSchema{
+			Name:   "translation",
+			Schema: translateSchema(transReq.SourceLanguage),
+		},
+	}
 
-		job := internal.WorkerJob{
-			Request:    llamaReq,
-			ReplyCh:    replyCh,
-			WorkerURL:  p.GetWorker(),
-			RetryCount: 0,
-			MaxRetries: 3,
+	// Output that fails validation is retried on another worker, and never cached
+	reply := submitAndWait(ctx, p, llamaReq, maxRetries, func(reply string) error {
+		_, err := parseTranslation(transReq, text, reply)
+		return err
+	})
+	if pool.IsError(reply) {
+		return internal.TranslationResult{Error: reply}
+	}
+
+	result, err := parseTranslation(transReq, text, reply)
+	if err != nil {
+		return internal.TranslationResult{Error: fmt.Sprintf("Error: %v", err)}
+	}
+	return result
+}
+
+/*
+parseTranslation decodes the model's JSON output and checks it against the request
+*/
+func parseTranslation(transReq internal.TranslateRequest, text string, reply string) (internal.TranslationResult, error) {
+	var result internal.TranslationResult
+	err := json.Unmarshal([]byte(strings.TrimSpace(reply)), &result)
+	if err == nil {
+		result.Error = ""
+		err = checkTranslation(transReq, text, result)
+	}
+	if err != nil {
+		return result, fmt.Errorf("invalid translation output: %v", err)
+	}
+	return result, nil
+}
+
+/*
+translateData is what the translate template is rendered with. Languages are English names so the
+prompt reads naturally; SourceLanguage is empty when the model should detect it.
+*/
+type translateData struct {
+	Text           string
+	SourceLanguage string
+	TargetLanguage string
+	Format         string
+	Glossary       map[string]string
+	DoNotTranslate []string
+}
+
+/*
+translateSchema constrains the output to a known source language code and a translation. When the
+client gave the source language, detection is pinned to it.
+*/
+func translateSchema(source string) json.RawMessage {
+	codes := languageCodes()
+	if source != "" {
+		codes = []string{source}
+	}
+
+	schema, _ := json.Marshal(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"source_language": map[string]interface{}{"type": "string", "enum": codes},
+			"translation":     map[string]interface{}{"type": "string"},
+		},
+		"required": []string{"source_language", "translation"},
+	})
+	return schema
+}
+
+/*
+checkTranslation verifies the parts of the output we can check mechanically: protected terms were
+kept, glossary terms appear (when they appeared in the source), and markup survived
+*/
+func checkTranslation(transReq internal.TranslateRequest, text string, result internal.TranslationResult) error {
+	if strings.TrimSpace(result.Translation) == "" {
+		return fmt.Errorf("empty translation")
+	}
+
+	if _, ok := languageNames[result.SourceLanguage]; !ok {
+		return fmt.Errorf("unknown source language %q", result.SourceLanguage)
+	}
+
+	for _, term := range transReq.DoNotTranslate {
+		if strings.Contains(text, term) && !strings.Contains(result.Translation, term) {
+			return fmt.Errorf("protected term %q was altered", term)
 		}
-		log.Printf("Translate job assigned to worker: %s", job.WorkerURL)
+	}
 
-		p.SubmitJob(job)
-		reply := <-replyCh
+	for term, translation := range transReq.Glossary {
+		if strings.Contains(strings.ToLower(text), strings.ToLower(term)) &&
+			!strings.Contains(strings.ToLower(result.Translation), strings.ToLower(translation)) {
+			return fmt.Errorf("glossary term %q was not translated as %q", term, translation)
+		}
+	}
 
-		transResp := internal.TranslateResponse{Translation: reply}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(transResp)
+	switch transReq.Format {
+	case "html":
+		if !sameTags(text, result.Translation) {
+			return fmt.Errorf("HTML tags were not preserved")
+		}
+	case "markdown":
+		if strings.Count(text, "```") != strings.Count(result.Translation, "```") {
+			return fmt.Errorf("Markdown code fences were not preserved")
+		}
+	}
+	return nil
+}
+
+/*
+sameTags reports whether two HTML fragments contain the same sequence of tags
+*/
+func sameTags(a string, b string) bool {
+	tagsA := markupTag.FindAllString(a, -1)
+	tagsB := markupTag.FindAllString(b, -1)
+	if len(tagsA) != len(tagsB) {
+		return false
+	}
+	for i := range tagsA {
+		if !strings.EqualFold(tagsA[i], tagsB[i]) {
+			return false
+		}
 	}
+	return true
 }
 
 // truncateText is a helper function to truncate long strings for logging
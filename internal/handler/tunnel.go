@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"gollama/internal"
+	"gollama/internal/auth"
+	"gollama/internal/pool"
+)
+
+// tunnelPingInterval keeps idle tunnels alive through NAT gateways and proxies
+const tunnelPingInterval = 15 * time.Second
+
+/*
+HandleTunnel holds open a reverse connection from a worker that can't accept inbound requests.
+Jobs for the worker are streamed down the response as newline-delimited JSON.
+*/
+func HandleTunnel(p *pool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, err := auth.ClaimsFromRequest(r)
+		if err != nil {
+			log.Printf("Tunnel rejected: %v", err)
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		// The tunnel is keyed by the token's worker ID, so a worker calling itself something else
+		// would be listed and routed to under a name it doesn't know
+		if id := r.Header.Get(internal.WorkerIDHeader); id != "" && id != claims.WorkerID {
+			log.Printf("Tunnel rejected: worker %s presented a token issued to %s", id, claims.WorkerID)
+			http.Error(w, "Token was not issued for this worker", http.StatusForbidden)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		var models []internal.ModelInfo
+		if header := r.Header.Get(internal.WorkerModelsHeader); header != "" {
+			if err := json.Unmarshal([]byte(header), &models); err != nil {
+				http.Error(w, "Invalid models header", http.StatusBadRequest)
+				return
+			}
+		}
+
+		t := p.OpenTunnel(claims.WorkerID, models)
+		defer p.CloseTunnel(t)
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		encoder := json.NewEncoder(w)
+		ticker := time.NewTicker(tunnelPingInterval)
+		defer ticker.Stop()
+
+		for {
+			var msg internal.TunnelMessage
+			select {
+			case msg = <-t.Requests():
+			case <-ticker.C:
+				msg = internal.TunnelMessage{Type: "ping"}
+			case <-t.Closed():
+				return
+			case <-r.Context().Done():
+				return
+			}
+
+			if err := encoder.Encode(msg); err != nil {
+				log.Printf("Tunnel write to %s failed: %v", claims.WorkerID, err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+/*
+HandleTunnelResult accepts job results posted back by reverse-connected workers
+*/
+func HandleTunnelResult(p *pool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, err := auth.ClaimsFromRequest(r)
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		var result internal.TunnelResult
+		err = json.NewDecoder(r.Body).Decode(&result)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		err = p.DeliverTunnelResult(claims.WorkerID, result)
+		if err != nil {
+			log.Printf("Dropping tunnel result from %s: %v", claims.WorkerID, err)
+			http.Error(w, "Unknown tunnel request", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -3,7 +3,10 @@ package handler
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
+	"gollama/internal"
+	"gollama/internal/auth"
 	"gollama/internal/pool"
 )
 
@@ -11,8 +14,9 @@ import (
 WorkerInfo is the payload for registering a new worker
 */
 type WorkerInfo struct {
-	URL   string `json:"url"`
-	Model string `json:"model"`
+	URL    string               `json:"url"`
+	Name   string               `json:"name"`
+	Models []internal.ModelInfo `json:"models"`
 }
 
 /*
@@ -32,8 +36,32 @@ func HandleConnectWorker(p *pool.Pool) http.HandlerFunc {
 			return
 		}
 
+		if workerInfo.URL == "" {
+			http.Error(w, "Missing url", http.StatusBadRequest)
+			return
+		}
+		if workerInfo.Name == "" {
+			workerInfo.Name = workerInfo.URL
+		}
+
+		// The worker only accepts /execute calls carrying the token it registered with
+		claims, err := auth.ClaimsFromRequest(r)
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		if claims.URL != workerInfo.URL {
+			http.Error(w, "Token was not issued for this worker URL", http.StatusForbidden)
+			return
+		}
+
 		//worker already did health check - should be OK for now
-		p.AddWorker(workerInfo.URL)
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		err = p.RegisterWorker(workerInfo.URL, workerInfo.Name, workerInfo.Models, token)
+		if err != nil {
+			http.Error(w, "Registration failed: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		response := map[string]string{
@@ -0,0 +1,524 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gollama/internal/pool"
+)
+
+// Status is where an async job is in its lifecycle
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// MaxKeyLength caps idempotency keys
+const MaxKeyLength = 255
+
+// Recovered jobs may find no workers yet, as workers reconnect after a hub restart. They wait up
+// to recoveryWait for one, backing off up to maxRecoveryBackoff between attempts.
+const (
+	recoveryWait       = 10 * time.Minute
+	maxRecoveryBackoff = 30 * time.Second
+)
+
+/*
+allowedEndpoints are the hub routes that can run asynchronously. /tasks/{name} is matched by prefix.
+*/
+var allowedEndpoints = map[string]bool{
+	"/chat":           true,
+	"/summarize":      true,
+	"/translate":      true,
+	"/sentiment":      true,
+	"/v1/completions": true,
+	"/infill":         true,
+	"/v1/embeddings":  true,
+}
+
+/*
+Job is an asynchronous request. Result holds the JSON the endpoint would have returned
+synchronously; Error holds its error message when it failed.
+*/
+type Job struct {
+	ID             string          `json:"id"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	Endpoint       string          `json:"endpoint"`
+	Status         Status          `json:"status"`
+	StatusCode     int             `json:"status_code,omitempty"`
+	Result         json.RawMessage `json:"result,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	CallbackURL    string          `json:"callback_url,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	StartedAt      *time.Time      `json:"started_at,omitempty"`
+	CompletedAt    *time.Time      `json:"completed_at,omitempty"`
+
+	body      json.RawMessage
+	cancel    context.CancelFunc
+	recovered bool // re-queued after a hub restart
+}
+
+/*
+Finished reports whether the job has reached a final status
+*/
+func (j *Job) Finished() bool {
+	return j.Status == StatusCompleted || j.Status == StatusFailed || j.Status == StatusCancelled
+}
+
+/*
+Store runs async jobs through the hub's own handlers and keeps their results until the retention
+period after they finish. Jobs are recorded in a pool.Queue; with a durable one, jobs that hadn't
+finished when the hub stopped run again on startup.
+*/
+type Store struct {
+	queue     pool.Queue
+	handler   http.Handler
+	retention time.Duration
+	secret    []byte
+	client    *http.Client
+	running   chan struct{} // semaphore bounding how many async jobs run at once
+
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+/*
+NewStore creates a job store that records jobs in queue and dispatches them to handler (the hub's
+mux). Webhooks are signed with secret; with no secret, jobs can't use callbacks.
+*/
+func NewStore(queue pool.Queue, handler http.Handler, retention time.Duration, maxRunning int, secret string) *Store {
+	if maxRunning < 1 {
+		maxRunning = 1
+	}
+	return &Store{
+		queue:     queue,
+		handler:   handler,
+		retention: retention,
+		secret:    []byte(secret),
+		client:    webhookClient(false),
+		running:   make(chan struct{}, maxRunning),
+		jobs:      make(map[string]*Job),
+	}
+}
+
+/*
+Start restores jobs from the queue, re-running any that hadn't finished, and begins expiring
+finished jobs past their retention period. Call it once the routes jobs replay through exist.
+*/
+func (s *Store) Start() {
+	s.recover()
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.expire()
+		}
+	}()
+	log.Printf("Async jobs enabled (retention %s, max running %d)", s.retention, cap(s.running))
+}
+
+/*
+InvalidError is a Submit error caused by the request itself, as opposed to the hub failing to queue
+the job
+*/
+type InvalidError struct {
+	msg string
+}
+
+func (e *InvalidError) Error() string {
+	return e.msg
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return &InvalidError{msg: fmt.Sprintf(format, args...)}
+}
+
+/*
+ErrKeyReused means an idempotency key was sent again with a different request than the one it was
+first used for
+*/
+var ErrKeyReused = errors.New("Idempotency-Key was already used for a different request")
+
+/*
+RequestHash digests the parts of a request, so a retry with an idempotency key can be checked
+against the request the key was first used for
+*/
+func RequestHash(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+Submit validates and queues a job. The body is what the client would have POSTed to the endpoint.
+If key is set and a job was already submitted with it, that job is returned instead, with false;
+if that job was for a different request, Submit fails with ErrKeyReused. A request that can't be
+accepted fails with an *InvalidError; any other error means the queue couldn't take the job.
+*/
+func (s *Store) Submit(endpoint string, body json.RawMessage, callbackURL string, key string) (Job, bool, error) {
+	if !EndpointAllowed(endpoint) {
+		return Job{}, false, invalidf("endpoint %s can't run asynchronously", endpoint)
+	}
+	if len(body) == 0 {
+		return Job{}, false, invalidf("body is required")
+	}
+	if len(key) > MaxKeyLength {
+		return Job{}, false, invalidf("Idempotency-Key is longer than %d characters", MaxKeyLength)
+	}
+	if callbackURL != "" {
+		if len(s.secret) == 0 {
+			return Job{}, false, invalidf("callbacks are disabled: the hub has no WEBHOOK_SECRET")
+		}
+		u, err := url.Parse(callbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			return Job{}, false, invalidf("callback_url must be an http or https URL")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:             NewID("job_"),
+		IdempotencyKey: key,
+		Endpoint:       endpoint,
+		Status:         StatusQueued,
+		CallbackURL:    callbackURL,
+		CreatedAt:      time.Now(),
+		body:           body,
+		cancel:         cancel,
+	}
+
+	// the queue settles concurrent submissions with the same key. Adding may mean a round trip to
+	// the cluster leader, so it happens outside s.mu; a duplicate that arrives before the job is in
+	// s.jobs is answered from the queue's record.
+	hash := RequestHash([]byte(endpoint), []byte(callbackURL), body)
+	queued, created, err := s.queue.Add(pool.QueuedJob{
+		ID:       job.ID,
+		Key:      key,
+		Hash:     hash,
+		Endpoint: endpoint,
+		Body:     body,
+		Data:     encodeJob(*job),
+	})
+	if err != nil {
+		cancel()
+		return Job{}, false, err
+	}
+	if !created {
+		cancel()
+		if queued.Hash != "" && queued.Hash != hash {
+			// jobs queued before hashes were kept have none, and match any request
+			return Job{}, false, ErrKeyReused
+		}
+		s.mu.RLock()
+		existing, ok := s.jobs[queued.ID]
+		var snapshot Job
+		if ok {
+			snapshot = *existing
+		}
+		s.mu.RUnlock()
+		if !ok {
+			// the job is on another hub replica, was dropped from this store, or is still being
+			// added; the queue's record of it will do
+			if json.Unmarshal(queued.Data, &snapshot) != nil || snapshot.ID != queued.ID {
+				return Job{}, false, invalidf("job %s for this Idempotency-Key is gone", queued.ID)
+			}
+		}
+		log.Printf("Async job %s matched by idempotency key", queued.ID)
+		return snapshot, false, nil
+	}
+
+	s.mu.Lock()
+	s.jobs[job.ID] = job
+	snapshot := *job
+	s.mu.Unlock()
+
+	go s.run(ctx, job)
+	log.Printf("Queued async job %s for %s", job.ID, endpoint)
+	return snapshot, true, nil
+}
+
+/*
+Get returns a snapshot of a job
+*/
+func (s *Store) Get(id string) (Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+/*
+Cancel stops a queued or running job. A job that already finished is deleted instead, so clients
+can free results early. Returns false if the job doesn't exist.
+*/
+func (s *Store) Cancel(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	if job.Finished() {
+		delete(s.jobs, id)
+		s.forget(id)
+		log.Printf("Deleted async job %s", id)
+		return *job, true
+	}
+
+	job.cancel()
+	now := time.Now()
+	job.Status = StatusCancelled
+	job.CompletedAt = &now
+	s.record(job)
+	log.Printf("Cancelled async job %s", id)
+	return *job, true
+}
+
+/*
+run waits for a free slot, then replays the request against the hub's handler and records the result
+*/
+func (s *Store) run(ctx context.Context, job *Job) {
+	select {
+	case s.running <- struct{}{}:
+		defer func() { <-s.running }()
+	case <-ctx.Done():
+		return // cancelled while queued
+	}
+
+	s.mu.Lock()
+	if job.Status != StatusQueued {
+		s.mu.Unlock()
+		return
+	}
+	started := time.Now()
+	job.Status = StatusRunning
+	job.StartedAt = &started
+	s.mu.Unlock()
+
+	code, body := Replay(ctx, s.handler, job.Endpoint, job.body)
+	for backoff := time.Second; job.recovered && code == http.StatusServiceUnavailable &&
+		time.Since(started) < recoveryWait; backoff = min(backoff*2, maxRecoveryBackoff) {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		code, body = Replay(ctx, s.handler, job.Endpoint, job.body)
+	}
+	s.finish(job, code, body)
+	job.cancel() // release the context now that the handler is done
+}
+
+/*
+finish records the handler's response and fires the webhook. A job cancelled while it ran stays
+cancelled.
+*/
+func (s *Store) finish(job *Job, code int, body []byte) {
+	s.mu.Lock()
+	if job.Status == StatusCancelled {
+		s.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	job.CompletedAt = &now
+	job.StatusCode = code
+	job.body = nil
+
+	trimmed := bytes.TrimSpace(body)
+	if code < 400 && json.Valid(trimmed) {
+		job.Status = StatusCompleted
+		job.Result = json.RawMessage(trimmed)
+	} else {
+		job.Status = StatusFailed
+		job.Error = string(trimmed)
+	}
+	s.record(job)
+	snapshot := *job
+	s.mu.Unlock()
+
+	log.Printf("Async job %s %s in %s", job.ID, snapshot.Status, now.Sub(snapshot.CreatedAt).Round(time.Millisecond))
+	if snapshot.CallbackURL != "" {
+		go s.notify(snapshot)
+	}
+}
+
+/*
+expire drops finished jobs older than the retention period
+*/
+func (s *Store) expire() {
+	cutoff := time.Now().Add(-s.retention)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, job := range s.jobs {
+		if job.Finished() && job.CompletedAt != nil && job.CompletedAt.Before(cutoff) {
+			delete(s.jobs, id)
+			s.forget(id)
+		}
+	}
+}
+
+/*
+recover loads the queue's jobs into the store. Finished jobs come back with their results; the rest
+run again from the start, since a job that was running when the hub stopped may not have finished.
+*/
+func (s *Store) recover() {
+	requeued := 0
+	queued := s.queue.Jobs()
+	for _, q := range queued {
+		if s.Resume(q) && !q.Done {
+			requeued++
+		}
+	}
+	if len(queued) > 0 {
+		log.Printf("Recovered %d async jobs, %d queued to run again", len(queued), requeued)
+	}
+}
+
+/*
+Resume loads one queued job into the store, running it again if it hadn't finished. It's how jobs
+come back after a restart, and how a hub replica takes over the jobs of one that went down. A job
+the store already has is left alone.
+*/
+func (s *Store) Resume(q pool.QueuedJob) bool {
+	var job Job
+	err := json.Unmarshal(q.Data, &job)
+	if err != nil || job.ID != q.ID {
+		log.Printf("Dropping unreadable queued job %s", q.ID)
+		s.forget(q.ID)
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.jobs[job.ID]; exists {
+		return false
+	}
+	if q.Done {
+		s.jobs[job.ID] = &job
+		return true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job.Status = StatusQueued
+	job.StartedAt = nil
+	job.body = q.Body
+	job.cancel = cancel
+	job.recovered = true
+	s.jobs[job.ID] = &job
+
+	go s.run(ctx, &job)
+	return true
+}
+
+/*
+record saves a finished job's final state to the queue. Callers hold s.mu.
+*/
+func (s *Store) record(job *Job) {
+	err := s.queue.Finish(job.ID, encodeJob(*job))
+	if err != nil {
+		log.Printf("Failed to record async job %s: %v", job.ID, err)
+	}
+}
+
+/*
+forget removes a job from the queue
+*/
+func (s *Store) forget(id string) {
+	err := s.queue.Remove(id)
+	if err != nil {
+		log.Printf("Failed to remove async job %s from the queue: %v", id, err)
+	}
+}
+
+func encodeJob(job Job) json.RawMessage {
+	data, _ := json.Marshal(job) // a Job always encodes
+	return data
+}
+
+/*
+EndpointAllowed reports whether an endpoint can be run as an async job
+*/
+func EndpointAllowed(endpoint string) bool {
+	if allowedEndpoints[endpoint] {
+		return true
+	}
+	name, found := strings.CutPrefix(endpoint, "/tasks/")
+	return found && name != "" && !strings.ContainsAny(name, "/?#")
+}
+
+/*
+Replay POSTs body to endpoint on the hub's handler in-process and returns the response. The
+request carries ctx, so cancelling it aborts the worker call behind the handler.
+*/
+func Replay(ctx context.Context, handler http.Handler, endpoint string, body []byte) (int, []byte) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := newRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.code, rec.body.Bytes()
+}
+
+/*
+NewID returns a random identifier with the given prefix
+*/
+func NewID(prefix string) string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+/*
+recorder captures a handler's response in memory
+*/
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newRecorder() *recorder {
+	return &recorder{header: make(http.Header), code: http.StatusOK}
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *recorder) WriteHeader(code int) {
+	r.code = code
+}
@@ -0,0 +1,133 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Webhook headers. Receivers recompute Sign(secret, timestamp, body) and compare it to the signature.
+const (
+	SignatureHeader = "X-Gollama-Signature"
+	TimestampHeader = "X-Gollama-Timestamp"
+)
+
+// webhookAttempts is how many times a callback is tried before giving up
+const webhookAttempts = 4
+
+/*
+Sign computes the webhook signature: hex HMAC-SHA256 over "<timestamp>.<body>". Including the
+timestamp lets receivers reject replayed deliveries.
+*/
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// cgnat is the carrier-grade NAT range, which net.IP doesn't count as private
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+/*
+webhookClient returns the client webhooks are delivered with. Unless allowPrivate is set, it refuses
+to connect to loopback, private, link-local (which includes cloud metadata services) and other
+non-public addresses. The check is made on the address actually dialled, so it also covers
+redirects and hostnames that resolve to internal addresses.
+*/
+func webhookClient(allowPrivate bool) *http.Client {
+	if allowPrivate {
+		return &http.Client{Timeout: 10 * time.Second}
+	}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !publicIP(ip) {
+				return fmt.Errorf("callback address %s is not public", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // a proxy would dial the callback on our behalf, past the check
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+/*
+publicIP reports whether ip is a globally routable unicast address
+*/
+func publicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnat.Contains(ip)
+}
+
+/*
+AllowPrivateCallbacks lets webhooks go to loopback and private addresses, e.g. a receiver on the
+same machine or network as the hub. Only for hubs whose clients are all trusted.
+*/
+func (s *Store) AllowPrivateCallbacks() {
+	s.client = webhookClient(true)
+}
+
+/*
+notify POSTs the finished job to its callback URL, retrying with backoff on errors and non-2xx replies
+*/
+func (s *Store) notify(job Job) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("Webhook for job %s: %v", job.ID, err)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = s.deliver(job.CallbackURL, body)
+		if err == nil {
+			log.Printf("Webhook for job %s delivered", job.ID)
+			return
+		}
+		log.Printf("Webhook for job %s failed (attempt %d/%d): %v", job.ID, attempt, webhookAttempts, err)
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (s *Store) deliver(url string, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(s.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %d", resp.StatusCode)
+	}
+	return nil
+}
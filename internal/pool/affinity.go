@@ -0,0 +1,236 @@
+package pool
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"gollama/internal"
+)
+
+// Prefix-affinity tuning
+const (
+	ringReplicas       = 100              // points per worker on the hash ring
+	affinityLoadFactor = 1.25             // a worker may take this much more than its fair share of in-flight jobs
+	affinityTTL        = 10 * time.Minute // how long a prefix is assumed to stay in a worker's KV cache
+	maxRecentPrefixes  = 50000
+	maxPrefixKeys      = 64 // keys kept per request; long conversations keep the first and the most recent
+	promptBlockSize    = 512
+)
+
+/*
+ringPoint is one of a worker's positions on the consistent-hash ring
+*/
+type ringPoint struct {
+	hash   uint64
+	worker string
+}
+
+/*
+affinityRoute records which worker last ran a prompt prefix
+*/
+type affinityRoute struct {
+	worker string
+	at     time.Time
+}
+
+/*
+MessageKeys hashes each leading run of a conversation: the first message, the first two, and so on.
+A follow-up turn repeats the previous turn's messages, so its keys include the previous turn's
+longest key, which routes it back to the worker holding that conversation in its KV cache.
+*/
+func MessageKeys(messages []internal.Message) []string {
+	h := sha256.New()
+	keys := make([]string, 0, len(messages))
+	for _, m := range messages {
+		h.Write([]byte(m.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Content))
+		h.Write([]byte{0})
+		for _, call := range m.ToolCalls {
+			h.Write([]byte(call.Function.Name))
+			h.Write([]byte(call.Function.Arguments))
+		}
+		h.Write([]byte(m.ToolCallID))
+		h.Write([]byte{0})
+		keys = append(keys, hex.EncodeToString(h.Sum(nil)[:16]))
+	}
+	return trimKeys(keys)
+}
+
+/*
+PromptKeys hashes a raw prompt in growing blocks, so prompts that share a long opening (a document,
+a code file) share keys
+*/
+func PromptKeys(prompt string) []string {
+	if prompt == "" {
+		return nil
+	}
+	h := sha256.New()
+	keys := make([]string, 0, len(prompt)/promptBlockSize+1)
+	for start := 0; start < len(prompt); start += promptBlockSize {
+		end := min(start+promptBlockSize, len(prompt))
+		h.Write([]byte(prompt[start:end]))
+		keys = append(keys, hex.EncodeToString(h.Sum(nil)[:16]))
+	}
+	return trimKeys(keys)
+}
+
+func trimKeys(keys []string) []string {
+	if len(keys) <= maxPrefixKeys {
+		return keys
+	}
+	return append(keys[:1], keys[len(keys)-maxPrefixKeys+1:]...)
+}
+
+/*
+GetWorkerForPrefix picks a worker for a prompt with the given prefix keys (see MessageKeys). The
+worker that most recently ran the longest matching prefix is preferred, then the first key's owner on
+the consistent-hash ring, so conversations sharing a system prompt land together. Workers already
+carrying more than their share of in-flight jobs are skipped. Falls back to round-robin.
+*/
+func (p *Pool) GetWorkerForPrefix(model string, capability string, keys []string) string {
+	return p.pickWorker(model, capability, keys, true)
+}
+
+/*
+pickWorker is GetWorkerForPrefix, spilling over to peer hubs only if spill is set
+*/
+func (p *Pool) pickWorker(model string, capability string, keys []string, spill bool) string {
+	if len(keys) > 0 {
+		p.mu.Lock()
+		worker := p.affinityWorker(model, capability, keys, spill)
+		p.mu.Unlock()
+		if worker != "" {
+			return worker
+		}
+	}
+	return p.nextWorker(model, capability, nil, spill)
+}
+
+/*
+affinityWorker is GetWorkerForPrefix without the fallback. Only local workers hold a KV cache worth
+routing to, so peer hubs are left out, as are saturated workers when the job could spill. Callers
+hold p.mu.
+*/
+func (p *Pool) affinityWorker(model string, capability string, keys []string, spill bool) string {
+	limit := p.loadCap(model, capability)
+	eligible := func(worker string) bool {
+		if _, peer := p.peers[worker]; peer || (spill && p.saturated(worker)) {
+			return false
+		}
+		// available goes last: for a half-open worker it claims the trial slot
+		return supports(p.workerStats[worker], model, capability) && p.inflight[worker] < limit && p.available(worker)
+	}
+
+	now := time.Now()
+	for i := len(keys) - 1; i >= 0; i-- {
+		route, ok := p.recent[keys[i]]
+		if ok && now.Sub(route.at) < affinityTTL && eligible(route.worker) {
+			return route.worker
+		}
+	}
+
+	if len(p.ring) == 0 {
+		return ""
+	}
+	h := hashKey(keys[0])
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		point := p.ring[(start+i)%len(p.ring)]
+		if eligible(point.worker) {
+			return point.worker
+		}
+	}
+	return ""
+}
+
+/*
+loadCap is how many in-flight jobs a worker may have before affinity stops sending it more: its
+fair share of the current load (plus the new job) times affinityLoadFactor. Callers hold p.mu.
+*/
+func (p *Pool) loadCap(model string, capability string) int {
+	total, workers := 0, 0
+	for _, worker := range p.workerOrder {
+		if _, peer := p.peers[worker]; peer {
+			continue
+		}
+		if supports(p.workerStats[worker], model, capability) {
+			total += p.inflight[worker]
+			workers++
+		}
+	}
+	if workers == 0 {
+		return 0
+	}
+	return int(math.Ceil(affinityLoadFactor * float64(total+1) / float64(workers)))
+}
+
+/*
+rememberPrefixes records that a worker now holds these prefixes in its KV cache
+*/
+func (p *Pool) rememberPrefixes(keys []string, worker string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if len(p.recent)+len(keys) > maxRecentPrefixes {
+		for key, route := range p.recent {
+			if now.Sub(route.at) >= affinityTTL {
+				delete(p.recent, key)
+			}
+		}
+		if len(p.recent)+len(keys) > maxRecentPrefixes {
+			p.recent = make(map[string]affinityRoute) // still full of live routes; start over
+		}
+	}
+	for _, key := range keys {
+		p.recent[key] = affinityRoute{worker: worker, at: now}
+	}
+}
+
+/*
+trackInflight adjusts a worker's count of jobs currently running on it
+*/
+func (p *Pool) trackInflight(worker string, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inflight[worker] += delta
+	if p.inflight[worker] <= 0 {
+		delete(p.inflight, worker)
+	}
+}
+
+/*
+rebuildRing places every worker on the consistent-hash ring. Callers hold p.mu.
+*/
+func (p *Pool) rebuildRing() {
+	ring := make([]ringPoint, 0, len(p.workerOrder)*ringReplicas)
+	for _, worker := range p.workerOrder {
+		if _, peer := p.peers[worker]; peer {
+			continue
+		}
+		for i := 0; i < ringReplicas; i++ {
+			ring = append(ring, ringPoint{hash: hashKey(worker + "#" + strconv.Itoa(i)), worker: worker})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	p.ring = ring
+}
+
+/*
+hashKey places a key on the ring. SHA-256 rather than a cheaper hash, because worker labels differ
+in a single character and need to spread evenly.
+*/
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,262 @@
+package pool
+
+import (
+	"log"
+	"time"
+
+	"gollama/internal"
+)
+
+// Breaker states
+const (
+	BreakerClosed   = "closed"    // healthy, takes traffic
+	BreakerOpen     = "open"      // failing, takes no traffic until its cooldown ends
+	BreakerHalfOpen = "half-open" // cooldown over, one trial request at a time decides
+)
+
+// Circuit breaker tuning
+const (
+	breakerWindowSize     = 20               // recent calls the error rate is computed over
+	breakerWindowAge      = time.Minute      // calls older than this no longer count
+	breakerMinCalls       = 5                // calls needed before the error rate can trip the breaker
+	breakerErrorRate      = 0.5              // error rate that trips the breaker
+	breakerMaxConsecutive = 3                // consecutive failures that trip it regardless of rate
+	breakerBaseCooldown   = 15 * time.Second // first open period; doubles on each failed trial
+	breakerMaxCooldown    = 5 * time.Minute
+	breakerTrialTimeout   = time.Minute      // a trial that never reports back frees the slot after this
+	breakerEvictAfter     = 10 * time.Minute // a worker down this long is removed from the pool
+	breakerSweepInterval  = 30 * time.Second
+)
+
+/*
+callOutcome is one call in a breaker's sliding window
+*/
+type callOutcome struct {
+	at      time.Time
+	success bool
+}
+
+/*
+breaker tracks one worker's recent failures. A tripped breaker keeps the worker out of rotation
+instead of removing it, so its stats survive and it can come back on its own.
+*/
+type breaker struct {
+	state       string
+	window      [breakerWindowSize]callOutcome
+	count       int
+	next        int
+	consecutive int           // failures in a row
+	trips       int           // times the breaker has opened
+	cooldown    time.Duration // length of the current open period
+	retryAt     time.Time     // when an open breaker goes half-open
+	trialAt     time.Time     // when the current half-open trial was sent
+	downSince   time.Time     // first trip since the worker last recovered
+}
+
+func newBreaker() *breaker {
+	return &breaker{state: BreakerClosed, cooldown: breakerBaseCooldown}
+}
+
+/*
+allow reports whether a worker can be sent a job now. In half-open it lets one trial through at a
+time, so callers must only ask for the worker they are about to use.
+*/
+func (b *breaker) allow(now time.Time) bool {
+	if b.state == BreakerOpen && !now.Before(b.retryAt) {
+		b.state = BreakerHalfOpen
+		b.trialAt = time.Time{}
+	}
+
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.trialAt.IsZero() || now.Sub(b.trialAt) > breakerTrialTimeout {
+			b.trialAt = now
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ready is allow without claiming the half-open trial, for checking whether a worker could take a job
+*/
+func (b *breaker) ready(now time.Time) bool {
+	switch {
+	case b.state == BreakerClosed:
+		return true
+	case b.state == BreakerOpen:
+		return !now.Before(b.retryAt)
+	default:
+		return b.trialAt.IsZero() || now.Sub(b.trialAt) > breakerTrialTimeout
+	}
+}
+
+/*
+release gives back a half-open trial that ended without saying anything about the worker, because
+the call was cancelled or never sent, so the next job can be the trial instead of waiting out
+breakerTrialTimeout. A trial claimed after since belongs to another job and is kept.
+*/
+func (b *breaker) release(since time.Time) {
+	if b.state == BreakerHalfOpen && !b.trialAt.After(since) {
+		b.trialAt = time.Time{}
+	}
+}
+
+/*
+record adds a call's outcome and returns the breaker's new state if it changed, or "" if it didn't
+*/
+func (b *breaker) record(success bool, now time.Time) string {
+	b.window[b.next] = callOutcome{at: now, success: success}
+	b.next = (b.next + 1) % breakerWindowSize
+	if b.count < breakerWindowSize {
+		b.count++
+	}
+
+	if success {
+		b.consecutive = 0
+		if b.state == BreakerHalfOpen {
+			b.state = BreakerClosed
+			b.cooldown = breakerBaseCooldown
+			b.downSince = time.Time{}
+			b.count, b.next = 0, 0 // start the recovered worker with a clean window
+			return BreakerClosed
+		}
+		return ""
+	}
+
+	b.consecutive++
+	switch b.state {
+	case BreakerHalfOpen:
+		b.cooldown = min(b.cooldown*2, breakerMaxCooldown)
+		b.trip(now)
+		return BreakerOpen
+	case BreakerClosed:
+		calls, rate := b.errorRate(now)
+		if b.consecutive >= breakerMaxConsecutive || (calls >= breakerMinCalls && rate >= breakerErrorRate) {
+			b.trip(now)
+			return BreakerOpen
+		}
+	}
+	return ""
+}
+
+func (b *breaker) trip(now time.Time) {
+	b.state = BreakerOpen
+	b.trips++
+	b.retryAt = now.Add(b.cooldown)
+	if b.downSince.IsZero() {
+		b.downSince = now
+	}
+}
+
+/*
+errorRate returns the number of calls in the window and the share of them that failed
+*/
+func (b *breaker) errorRate(now time.Time) (int, float64) {
+	calls, failures := 0, 0
+	for i := 0; i < b.count; i++ {
+		outcome := b.window[i]
+		if now.Sub(outcome.at) > breakerWindowAge {
+			continue
+		}
+		calls++
+		if !outcome.success {
+			failures++
+		}
+	}
+	if calls == 0 {
+		return 0, 0
+	}
+	return calls, float64(failures) / float64(calls)
+}
+
+func (b *breaker) status(now time.Time) internal.BreakerStatus {
+	_, rate := b.errorRate(now)
+	status := internal.BreakerStatus{State: b.state, ErrorRate: rate, Trips: b.trips}
+	if b.state == BreakerOpen {
+		retryAt := b.retryAt
+		status.RetryAt = &retryAt
+	}
+	return status
+}
+
+/*
+breakerFor returns a worker's breaker, creating it closed. Callers hold p.mu.
+*/
+func (p *Pool) breakerFor(worker string) *breaker {
+	b, ok := p.breakers[worker]
+	if !ok {
+		b = newBreaker()
+		p.breakers[worker] = b
+	}
+	return b
+}
+
+/*
+available reports whether a worker's breaker lets it take a job. Callers hold p.mu.
+*/
+func (p *Pool) available(worker string) bool {
+	return p.breakerFor(worker).allow(time.Now())
+}
+
+/*
+recordOutcome feeds a call's result to the worker's breaker. Callers hold p.mu.
+*/
+func (p *Pool) recordOutcome(worker string, success bool) {
+	switch p.breakerFor(worker).record(success, time.Now()) {
+	case BreakerOpen:
+		b := p.breakers[worker]
+		log.Printf("Circuit breaker for %s opened (trip %d); retrying in %v", worker, b.trips, b.cooldown)
+	case BreakerClosed:
+		log.Printf("Circuit breaker for %s closed; worker recovered", worker)
+	}
+}
+
+/*
+releaseTrial frees a worker's half-open trial slot, claimed no later than since, after a job that was
+picked for it reported no outcome
+*/
+func (p *Pool) releaseTrial(worker string, since time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.breakers[worker]; ok {
+		b.release(since)
+	}
+}
+
+/*
+evictDeadWorkers periodically removes workers whose breaker has stayed open for breakerEvictAfter
+without a successful trial. A worker that comes back registers again.
+*/
+func (p *Pool) evictDeadWorkers() {
+	ticker := time.NewTicker(breakerSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		var dead []string
+		p.mu.RLock()
+		for worker, b := range p.breakers {
+			if _, peer := p.peers[worker]; peer {
+				continue // peer hubs stay for as long as they're configured
+			}
+			if b.state != BreakerClosed && !b.downSince.IsZero() && now.Sub(b.downSince) > breakerEvictAfter {
+				dead = append(dead, worker)
+			}
+		}
+		p.mu.RUnlock()
+
+		p.mu.RLock()
+		r := p.replicator
+		p.mu.RUnlock()
+
+		for _, worker := range dead {
+			log.Printf("Worker %s has been failing for over %v, removing from pool", worker, breakerEvictAfter)
+			if r != nil && r.ReplicateRemoval(worker) == nil {
+				continue // removed on every hub, this one included
+			}
+			p.RemoveWorker(worker)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package pool
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+/*
+breakerStep is one thing that happens to a breaker in a test, and what it should answer
+*/
+type breakerStep struct {
+	at    time.Duration // since the test started
+	op    string        // allow, ok, fail or release
+	since time.Duration // for release: a trial claimed after this is kept
+	want  string        // allow's answer, or the state change record reports
+	state string        // the breaker's state afterwards
+}
+
+// trip opens a fresh breaker at the start of a test
+var trip = []breakerStep{
+	{0, "fail", 0, "", BreakerClosed},
+	{0, "fail", 0, "", BreakerClosed},
+	{0, "fail", 0, BreakerOpen, BreakerOpen},
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	cooldown := breakerBaseCooldown
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{"closed lets everything through", []breakerStep{
+			{0, "allow", 0, "true", BreakerClosed},
+			{0, "allow", 0, "true", BreakerClosed},
+			{0, "ok", 0, "", BreakerClosed},
+		}},
+		{"failures in a row trip it", append(trip,
+			breakerStep{0, "allow", 0, "false", BreakerOpen},
+		)},
+		{"a success resets the run of failures", []breakerStep{
+			{0, "fail", 0, "", BreakerClosed},
+			{0, "fail", 0, "", BreakerClosed},
+			{0, "ok", 0, "", BreakerClosed},
+			{0, "fail", 0, "", BreakerClosed},
+		}},
+		{"error rate trips it once enough calls are in", []breakerStep{
+			{0, "ok", 0, "", BreakerClosed},
+			{0, "fail", 0, "", BreakerClosed},
+			{0, "ok", 0, "", BreakerClosed},
+			{0, "fail", 0, "", BreakerClosed},
+			{0, "fail", 0, BreakerOpen, BreakerOpen},
+		}},
+		{"old calls don't count toward the rate", []breakerStep{
+			{0, "fail", 0, "", BreakerClosed},
+			{0, "fail", 0, "", BreakerClosed},
+			{0, "ok", 0, "", BreakerClosed},
+			{2 * breakerWindowAge, "ok", 0, "", BreakerClosed},
+			{2 * breakerWindowAge, "fail", 0, "", BreakerClosed},
+			{2 * breakerWindowAge, "ok", 0, "", BreakerClosed},
+			{2 * breakerWindowAge, "fail", 0, "", BreakerClosed},
+		}},
+		{"one trial at a time after the cooldown", append(trip,
+			breakerStep{cooldown - time.Second, "allow", 0, "false", BreakerOpen},
+			breakerStep{cooldown, "allow", 0, "true", BreakerHalfOpen},
+			breakerStep{cooldown, "allow", 0, "false", BreakerHalfOpen},
+			breakerStep{cooldown + breakerTrialTimeout + time.Second, "allow", 0, "true", BreakerHalfOpen},
+		)},
+		{"a successful trial closes it", append(trip,
+			breakerStep{cooldown, "allow", 0, "true", BreakerHalfOpen},
+			breakerStep{cooldown, "ok", 0, BreakerClosed, BreakerClosed},
+			breakerStep{cooldown, "allow", 0, "true", BreakerClosed},
+			breakerStep{cooldown, "fail", 0, "", BreakerClosed}, // the window started over
+		)},
+		{"a failed trial doubles the cooldown", append(trip,
+			breakerStep{cooldown, "allow", 0, "true", BreakerHalfOpen},
+			breakerStep{cooldown, "fail", 0, BreakerOpen, BreakerOpen},
+			breakerStep{2 * cooldown, "allow", 0, "false", BreakerOpen},
+			breakerStep{3 * cooldown, "allow", 0, "true", BreakerHalfOpen},
+		)},
+		{"release gives the trial back", append(trip,
+			breakerStep{cooldown, "allow", 0, "true", BreakerHalfOpen},
+			breakerStep{cooldown, "release", cooldown, "", BreakerHalfOpen},
+			breakerStep{cooldown, "allow", 0, "true", BreakerHalfOpen},
+		)},
+		{"release keeps a trial claimed since", append(trip,
+			breakerStep{cooldown, "allow", 0, "true", BreakerHalfOpen},
+			breakerStep{cooldown, "release", cooldown - time.Second, "", BreakerHalfOpen},
+			breakerStep{cooldown, "allow", 0, "false", BreakerHalfOpen},
+		)},
+		{"release does nothing to an open breaker", append(trip,
+			breakerStep{0, "release", 0, "", BreakerOpen},
+			breakerStep{0, "allow", 0, "false", BreakerOpen},
+		)},
+	}
+	start := time.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker()
+			for i, step := range tt.steps {
+				now := start.Add(step.at)
+				var got string
+				switch step.op {
+				case "allow":
+					got = fmt.Sprint(b.allow(now))
+				case "ok", "fail":
+					got = b.record(step.op == "ok", now)
+				case "release":
+					b.release(start.Add(step.since))
+				default:
+					t.Fatalf("step %d: unknown op %q", i, step.op)
+				}
+				if got != step.want {
+					t.Fatalf("step %d (%s at %v): got %q, want %q", i, step.op, step.at, got, step.want)
+				}
+				if b.state != step.state {
+					t.Fatalf("step %d (%s at %v): state %s, want %s", i, step.op, step.at, b.state, step.state)
+				}
+			}
+		})
+	}
+}
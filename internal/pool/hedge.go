@@ -0,0 +1,287 @@
+package pool
+
+import (
+	"context"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"gollama/internal"
+)
+
+// Hedging tuning
+const (
+	latencyWindowSize = 100                   // recent calls kept per worker and endpoint
+	minLatencySamples = 20                    // calls observed before a worker's latency is trusted
+	minHedgeDelay     = 50 * time.Millisecond // never hedge sooner than this
+	maxHedgeBurst     = 10.0                  // hedges that can be saved up while traffic is quiet
+)
+
+/*
+latencyWindow holds a worker's most recent call latencies for one endpoint
+*/
+type latencyWindow struct {
+	samples [latencyWindowSize]float64
+	count   int
+	next    int
+}
+
+func (w *latencyWindow) add(ms float64) {
+	w.samples[w.next] = ms
+	w.next = (w.next + 1) % latencyWindowSize
+	if w.count < latencyWindowSize {
+		w.count++
+	}
+}
+
+/*
+percentile returns the q-th percentile (0-100) of the window in milliseconds
+*/
+func (w *latencyWindow) percentile(q float64) float64 {
+	if w.count == 0 {
+		return 0
+	}
+	sorted := make([]float64, w.count)
+	copy(sorted, w.samples[:w.count])
+	sort.Float64s(sorted)
+	idx := int(math.Ceil(q/100*float64(w.count))) - 1
+	return sorted[max(0, min(idx, w.count-1))]
+}
+
+/*
+HedgeStats reports how often hedging fired and how often the duplicate beat the original
+*/
+type HedgeStats struct {
+	Percentile    float64 `json:"percentile"`
+	BudgetPercent float64 `json:"budget_percent"`
+	Sent          int     `json:"sent"`
+	Won           int     `json:"won"`
+}
+
+/*
+SetHedging turns on hedged requests: when a worker hasn't answered within the given percentile
+(e.g. 95) of its recent latency, the job is also sent to another worker and the first good answer
+wins. budgetPercent caps hedges as a share of all jobs, so a slow pool isn't swamped with
+duplicates. A percentile of 0 turns hedging off. Hedges already saved up are kept, so changing the
+settings on reload doesn't refill the budget.
+*/
+func (p *Pool) SetHedging(percentile float64, budgetPercent float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := percentile != p.hedgePercentile || budgetPercent/100 != p.hedgeBudget
+	p.hedgePercentile = percentile
+	p.hedgeBudget = budgetPercent / 100
+	if changed && percentile > 0 {
+		log.Printf("Hedging enabled at p%g latency (budget %g%% of jobs)", percentile, budgetPercent)
+	}
+}
+
+/*
+GetHedgeStats returns hedging counters, or false when hedging is off
+*/
+func (p *Pool) GetHedgeStats() (HedgeStats, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.hedgePercentile <= 0 {
+		return HedgeStats{}, false
+	}
+	return HedgeStats{
+		Percentile:    p.hedgePercentile,
+		BudgetPercent: p.hedgeBudget * 100,
+		Sent:          p.hedgesSent,
+		Won:           p.hedgesWon,
+	}, true
+}
+
+/*
+recordLatency adds a call's duration to the worker's window for the endpoint
+*/
+func (p *Pool) recordLatency(worker string, endpoint string, ms float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := worker + " " + endpoint
+	w, ok := p.latencies[key]
+	if !ok {
+		w = &latencyWindow{}
+		p.latencies[key] = w
+	}
+	w.add(ms)
+}
+
+/*
+latencySummary returns p50/p95 per endpoint for a worker, for /stats. Callers hold p.mu.
+*/
+func (p *Pool) latencySummary(worker string) map[string]internal.LatencySummary {
+	var summary map[string]internal.LatencySummary
+	for key, w := range p.latencies {
+		if len(key) <= len(worker) || key[:len(worker)] != worker || key[len(worker)] != ' ' {
+			continue
+		}
+		if summary == nil {
+			summary = make(map[string]internal.LatencySummary)
+		}
+		summary[key[len(worker)+1:]] = internal.LatencySummary{
+			P50:     w.percentile(50),
+			P95:     w.percentile(95),
+			Samples: w.count,
+		}
+	}
+	return summary
+}
+
+/*
+hedgeDelay is how long to wait on a worker before hedging, or 0 when hedging is off or the worker
+hasn't been observed enough yet. It also accrues the hedging budget, one job's worth per call.
+*/
+func (p *Pool) hedgeDelay(worker string, endpoint string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hedgePercentile <= 0 {
+		return 0
+	}
+	p.hedgeTokens = min(p.hedgeTokens+p.hedgeBudget, maxHedgeBurst)
+
+	w, ok := p.latencies[worker+" "+endpoint]
+	if !ok || w.count < minLatencySamples {
+		return 0
+	}
+	delay := time.Duration(w.percentile(p.hedgePercentile) * float64(time.Millisecond))
+	return max(delay, minHedgeDelay)
+}
+
+/*
+takeHedgeToken spends one hedge from the budget, reporting false if none are left
+*/
+func (p *Pool) takeHedgeToken() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hedgeTokens < 1 {
+		return false
+	}
+	p.hedgeTokens--
+	p.hedgesSent++
+	return true
+}
+
+/*
+callAttempt is one worker's answer to a possibly hedged job
+*/
+type callAttempt struct {
+	worker    string
+	result    string
+	latencyMS float64
+}
+
+/*
+callWithHedge runs the job on its worker and, if the worker is slower than usual, on a second worker
+too. The first successful answer wins and the other call is cancelled. If both fail, the original
+worker's error is returned. Returns the answer, its latency and the worker that gave it.
+*/
+func (p *Pool) callWithHedge(processorID int, job internal.WorkerJob) (string, float64, string) {
+	endpoint := job.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+
+	results := make(chan callAttempt, 2) // buffered so the loser never blocks
+	cancels := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	launch := func(worker string) {
+		ctx, cancel := context.WithCancel(job.Ctx)
+		cancels[worker] = cancel
+		attempt := job
+		attempt.Ctx = ctx
+		attempt.WorkerURL = worker
+
+		go func() {
+			start := time.Now()
+			p.trackInflight(worker, 1)
+			result, latencyMS := p.callWorker(attempt)
+			p.trackInflight(worker, -1)
+
+			switch {
+			case !IsError(result):
+				p.recordLatency(worker, endpoint, latencyMS)
+			case ctx.Err() != nil:
+				// a cancelled call says nothing about the worker, so a trial it was on goes to the
+				// next job
+				p.releaseTrial(worker, start)
+				if job.Ctx.Err() == nil {
+					// cancelled because the other worker won; it was at least this slow
+					p.recordLatency(worker, endpoint, float64(time.Since(start).Milliseconds()))
+				}
+			}
+			results <- callAttempt{worker: worker, result: result, latencyMS: latencyMS}
+		}()
+	}
+
+	delay := p.hedgeDelay(job.WorkerURL, endpoint)
+	launch(job.WorkerURL)
+	running := 1
+
+	var hedgeTimer <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+
+	var primaryFailure *callAttempt
+	for {
+		select {
+		case attempt := <-results:
+			running--
+			if !IsError(attempt.result) {
+				if attempt.worker != job.WorkerURL {
+					p.mu.Lock()
+					p.hedgesWon++
+					p.mu.Unlock()
+					log.Printf("[Processor %d] Hedge on %s beat %s", processorID, attempt.worker, job.WorkerURL)
+				}
+				return attempt.result, attempt.latencyMS, attempt.worker
+			}
+			if IsRejected(attempt.result) {
+				return attempt.result, 0, attempt.worker // the other worker would refuse it too
+			}
+
+			if attempt.worker == job.WorkerURL {
+				primaryFailure = &attempt
+			} else if job.Ctx.Err() == nil {
+				p.updateWorkerStats(attempt.worker, false, 0)
+			}
+			if running == 0 {
+				if primaryFailure != nil {
+					return primaryFailure.result, 0, job.WorkerURL
+				}
+				return attempt.result, 0, job.WorkerURL
+			}
+
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			if running != 1 || primaryFailure != nil {
+				continue
+			}
+			exclude := map[string]bool{job.WorkerURL: true}
+			for failed := range job.Failed {
+				exclude[failed] = true
+			}
+			worker := p.nextWorker(job.Request.Model, job.Capability, exclude, !job.LocalOnly)
+			if worker == "" {
+				continue
+			}
+			if !p.takeHedgeToken() {
+				p.releaseTrial(worker, time.Now()) // picking it may have claimed its half-open trial
+				continue
+			}
+			log.Printf("[Processor %d] Worker %s is slow (over %v), hedging on %s", processorID, job.WorkerURL, delay, worker)
+			launch(worker)
+			running++
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package pool
+
+import "testing"
+
+func TestHedgeBudget(t *testing.T) {
+	tests := []struct {
+		name       string
+		budget     float64
+		tokens     float64
+		earn       int // jobs looked at for hedging before the hedges
+		takes      []bool
+		wantTokens float64
+		wantSent   int
+	}{
+		{"no tokens, no hedge", 0.1, 0, 0, []bool{false}, 0, 0},
+		{"a partial token isn't enough", 0.1, 0.5, 0, []bool{false}, 0.5, 0},
+		{"spends saved tokens", 0.1, 2, 0, []bool{true, true, false}, 0, 2},
+		{"four jobs earn one hedge at 25%", 0.25, 0, 4, []bool{true, false}, 0, 1},
+		{"savings are capped", 0.5, maxHedgeBurst - 1, 10, nil, maxHedgeBurst, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(1, 1, 3)
+			p.hedgePercentile = 95
+			p.hedgeBudget, p.hedgeTokens = tt.budget, tt.tokens
+			for range tt.earn {
+				p.hedgeDelay("http://worker", "/chat")
+			}
+			for i, want := range tt.takes {
+				if got := p.takeHedgeToken(); got != want {
+					t.Fatalf("hedge %d: takeHedgeToken returned %v, want %v", i+1, got, want)
+				}
+			}
+			if p.hedgeTokens < tt.wantTokens-1e-9 || p.hedgeTokens > tt.wantTokens+1e-9 {
+				t.Fatalf("%v tokens left, want %v", p.hedgeTokens, tt.wantTokens)
+			}
+			if p.hedgesSent != tt.wantSent {
+				t.Fatalf("%d hedges sent, want %d", p.hedgesSent, tt.wantSent)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package pool
+
+import (
+	"log"
+	"time"
+
+	"gollama/internal"
+)
+
+// defaultPeerInflight caps our jobs running on a peer hub when its config doesn't
+const defaultPeerInflight = 4
+
+/*
+PeerLedger is told about the work peer hubs do for this one, so it can be charged to them (see
+internal/federation). response is the peer's raw llama.cpp response.
+*/
+type PeerLedger interface {
+	Consumed(peerURL string, response []byte)
+}
+
+/*
+SetFederation lets jobs spill over to peer hubs once every local worker serving them has spillAfter
+jobs running, or when no local worker serves them at all. ledger is charged for each job a peer
+runs. A spillAfter of 0 only uses peers for models no local worker serves.
+*/
+func (p *Pool) SetFederation(spillAfter int, ledger PeerLedger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.spillAfter = spillAfter
+	p.ledger = ledger
+}
+
+/*
+AddPeer adds a peer hub to the pool. It takes jobs over /execute like a worker, authenticated with
+token, but only ever as overflow: local workers are always tried first. maxInflight caps how many of
+our jobs it runs at once. Adding a peer that's already in the pool updates its models and leaves its
+circuit breaker alone.
+*/
+func (p *Pool) AddPeer(url string, name string, models []internal.ModelInfo, token string, maxInflight int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if maxInflight <= 0 {
+		maxInflight = defaultPeerInflight
+	}
+	p.peers[url] = maxInflight
+	p.workerTokens[url] = token
+
+	if stats, exists := p.workerStats[url]; exists {
+		stats.Name = name
+		stats.Models = models
+		return
+	}
+	p.workerStats[url] = &internal.WorkerStats{
+		Name:       name,
+		URL:        url,
+		Models:     models,
+		Peer:       true,
+		StartTime:  time.Now(),
+		LastActive: time.Now(),
+	}
+	p.workerOrder = append(p.workerOrder, url)
+	log.Printf("Added peer hub: %s at %s (%d models)", name, url, len(models))
+}
+
+/*
+RemovePeer takes a peer hub out of the pool
+*/
+func (p *Pool) RemovePeer(url string) {
+	p.RemoveWorker(url) // also forgets it as a peer
+}
+
+/*
+GetWorkerForJob picks the worker a job is first sent to: by prefix affinity, then round-robin (see
+GetWorkerForPrefix). A LocalOnly job never goes to a peer hub.
+*/
+func (p *Pool) GetWorkerForJob(job internal.WorkerJob) string {
+	return p.pickWorker(job.Request.Model, job.Capability, job.Prefixes, !job.LocalOnly)
+}
+
+/*
+HasLocalWorkerFor is HasWorkerFor leaving out peer hubs
+*/
+func (p *Pool) HasLocalWorkerFor(model string, capability string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.hasWorker(model, capability, false)
+}
+
+/*
+LocalModels returns the models this hub's own workers serve, one entry per model: what a peer hub
+can send us. A model's slots are summed across workers; its context size is the smallest any worker
+advertises.
+*/
+func (p *Pool) LocalModels() []internal.ModelInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var models []internal.ModelInfo
+	index := make(map[string]int)
+	for _, worker := range p.workerOrder {
+		if _, peer := p.peers[worker]; peer {
+			continue
+		}
+		for _, m := range p.workerStats[worker].Models {
+			i, seen := index[m.Name]
+			if !seen {
+				index[m.Name] = len(models)
+				models = append(models, m)
+				continue
+			}
+			if m.ContextSize > 0 && (models[i].ContextSize == 0 || m.ContextSize < models[i].ContextSize) {
+				models[i].ContextSize = m.ContextSize
+			}
+			models[i].Slots += m.Slots
+			models[i].Embeddings = models[i].Embeddings || m.Embeddings
+		}
+	}
+	return models
+}
+
+/*
+saturated reports whether a local worker is busy enough that new jobs should go to a peer hub
+instead. Callers hold p.mu.
+*/
+func (p *Pool) saturated(worker string) bool {
+	return len(p.peers) > 0 && p.spillAfter > 0 && p.inflight[worker] >= p.spillAfter
+}
+
+/*
+peerHasRoom reports whether a peer hub can take another of our jobs. Callers hold p.mu.
+*/
+func (p *Pool) peerHasRoom(worker string) bool {
+	limit, peer := p.peers[worker]
+	return peer && p.inflight[worker] < limit
+}
+
+/*
+chargePeer records a job a peer hub ran for us with the ledger
+*/
+func (p *Pool) chargePeer(worker string, response []byte) {
+	p.mu.RLock()
+	_, peer := p.peers[worker]
+	ledger := p.ledger
+	p.mu.RUnlock()
+	if peer && ledger != nil {
+		ledger.Consumed(worker, response)
+	}
+}
@@ -2,28 +2,62 @@ package pool
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"gollama/internal"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
 
+// defaultEndpoint is the llama.cpp route used by jobs that don't name one
+const defaultEndpoint = "/v1/chat/completions"
+
+// CapabilityEmbeddings routes a job only to workers with an embedding-capable backend for its model
+const CapabilityEmbeddings = "embeddings"
+
 /*
 Pool holds the last-known pool of workers. Workers are verified, used, or discarded as they're called upon by the
 jobProcessor.
 */
 type Pool struct {
 	jobs              chan internal.WorkerJob          //job queue channel - send jobs messages to this channel
+	lowJobs           chan internal.WorkerJob          // background work (batches), only taken when jobs is empty
+	retries           chan internal.WorkerJob          // failed jobs on their way back, taken ahead of jobs
+	lowRetries        chan internal.WorkerJob          // failed background jobs, taken ahead of lowJobs
 	workerStats       map[string]*internal.WorkerStats // worker stats by URL
 	workerOrder       []string                         // ordered list of worker URLs for round-robin
 	mu                sync.RWMutex                     // Protects worker data during concurrent calls
 	nextIdx           int
-	concurrentWorkers int // Number of concurrent job processors
-	maxRetries        int // Maximum number of retries per job
+	concurrentWorkers int                       // Number of concurrent job processors
+	maxRetries        int                       // Maximum number of retries per job
+	tunnels           map[string]*Tunnel        // reverse-connected workers by pseudo-URL
+	workerTokens      map[string]string         // JWT each worker registered with, presented back on /execute
+	inflight          map[string]int            // jobs currently running on each worker
+	ring              []ringPoint               // consistent-hash ring for prefix affinity, sorted by hash
+	recent            map[string]affinityRoute  // prompt prefix key -> worker that last ran it
+	latencies         map[string]*latencyWindow // recent call latencies by "worker endpoint"
+	breakers          map[string]*breaker       // circuit breaker per worker
+	hedgePercentile   float64                   // hedge after this percentile of a worker's latency; 0 is off
+	hedgeBudget       float64                   // hedges allowed per job
+	hedgeTokens       float64                   // hedges currently available
+	hedgesSent        int
+	hedgesWon         int
+	retryBaseDelay    time.Duration // backoff before the first retry; doubles for each one after
+	retryMaxDelay     time.Duration
+	retryBudget       float64 // retries allowed per new job; 0 is unlimited
+	retryTokens       float64 // retries currently available
+	retried           int
+	retriesDenied     int
+	rejected          int
+	replicator        Replicator     // shares worker registrations with other hubs; nil for a lone hub
+	peers             map[string]int // peer hub URL -> most of our jobs it may run at once
+	spillAfter        int            // jobs running on a local worker before new ones spill to peers
+	ledger            PeerLedger
 }
 
 /*
@@ -32,10 +66,25 @@ New creates a new worker pool with the specified configuration
 func New(queueSize int, concurrentWorkers int, maxRetries int) *Pool {
 	return &Pool{
 		jobs:              make(chan internal.WorkerJob, queueSize),
+		lowJobs:           make(chan internal.WorkerJob, queueSize),
+		retries:           make(chan internal.WorkerJob, queueSize),
+		lowRetries:        make(chan internal.WorkerJob, queueSize),
 		workerStats:       make(map[string]*internal.WorkerStats),
 		workerOrder:       make([]string, 0),
+		tunnels:           make(map[string]*Tunnel),
+		workerTokens:      make(map[string]string),
+		inflight:          make(map[string]int),
+		recent:            make(map[string]affinityRoute),
+		latencies:         make(map[string]*latencyWindow),
+		breakers:          make(map[string]*breaker),
+		peers:             make(map[string]int),
 		concurrentWorkers: concurrentWorkers,
 		maxRetries:        maxRetries,
+		retryBaseDelay:    defaultRetryBaseDelay,
+		retryMaxDelay:     defaultRetryMaxDelay,
+		retryBudget:       defaultRetryBudget,
+		retryTokens:       maxRetryBurst,
+		hedgeTokens:       1,
 	}
 }
 
@@ -46,35 +95,46 @@ func (p *Pool) Start() {
 	for i := 1; i <= p.concurrentWorkers; i++ {
 		go p.jobProcessor(i)
 	}
+	go p.evictDeadWorkers()
 	log.Printf("Worker pool initialized with %d job processors", p.concurrentWorkers)
 }
 
 /*
-retryJob attempts to retry a failed job with a different worker
-  - job:
-  - processorID:
-  - maxRetriesErrorMsg
+retryJob schedules a failed job to run again on a different worker after a backoff (see resubmit)
+  - job: the job that failed on job.WorkerURL
+  - processorID: for logging
+  - maxRetriesErrorMsg: the reply when the job is out of retries
 */
 func (p *Pool) retryJob(
 	job *internal.WorkerJob,
 	processorID int,
 	maxRetriesErrorMsg string,
 ) {
-	if job.RetryCount < job.MaxRetries {
-		job.RetryCount++
-		job.WorkerURL = p.GetWorker()
-		if job.WorkerURL != "" {
-			log.Printf("[Processor %d] Retrying job (attempt %d/%d) with worker %s",
-				processorID, job.RetryCount, job.MaxRetries, job.WorkerURL)
-			p.SubmitJob(*job)
-		} else {
-			log.Printf("[Processor %d] No workers available for retry", processorID)
-			job.ReplyCh <- "Error: No available workers for retry"
-		}
-	} else {
+	if job.Ctx != nil && job.Ctx.Err() != nil {
+		job.ReplyCh <- "Error: request cancelled"
+		return
+	}
+
+	if job.RetryCount >= job.MaxRetries {
 		log.Printf("[Processor %d] Job exceeded max retries (%d)", processorID, job.MaxRetries)
 		job.ReplyCh <- maxRetriesErrorMsg
+		return
+	}
+	if !p.takeRetry() {
+		log.Printf("[Processor %d] Retry budget exhausted, not retrying job", processorID)
+		job.ReplyCh <- "Error: Job failed and the retry budget is exhausted"
+		return
 	}
+
+	job.RetryCount++
+	failed := make(map[string]bool, len(job.Failed)+1) // copied: hedged attempts share the old map
+	for worker := range job.Failed {
+		failed[worker] = true
+	}
+	failed[job.WorkerURL] = true
+	job.Failed = failed
+
+	go p.resubmit(*job, processorID, p.retryDelay(job.RetryCount))
 }
 
 /*
@@ -85,77 +145,157 @@ channel/goroutine leaks, or mutex contention from heavy stats logging.
 */
 
 func (p *Pool) jobProcessor(id int) {
-	for job := range p.jobs {
-		jobStart := time.Now()
-		log.Printf("[Processor %d] Processing job with worker %s", id, job.WorkerURL)
-
-		callStart := time.Now()
-		result, latencyMS := p.callWorker(job.WorkerURL, job.Request)
-		callDuration := time.Since(callStart)
-
-		totalDuration := time.Since(jobStart)
-		queueDepth := len(p.jobs)
-		log.Printf("[Processor %d] Job completed in %v (worker call: %v) - Queue depth: %d",
-			id, totalDuration, callDuration, queueDepth)
-
-		if isError(result) {
-			log.Printf("[Processor %d] Worker %s failed, removing from pool", id, job.WorkerURL)
-			p.updateWorkerStats(job.WorkerURL, false, 0)
-			p.RemoveWorker(job.WorkerURL)
-			p.retryJob(&job, id, "Error: Job failed after maximum retries")
-			continue // Move to next job after retry
-		} else {
-			p.updateWorkerStats(job.WorkerURL, true, latencyMS)
-			job.ReplyCh <- result
+	for {
+		p.processJob(id, p.nextJob())
+	}
+}
+
+/*
+nextJob takes the next job to run, preferring interactive jobs over low-priority ones, and retries
+over new jobs of the same priority
+*/
+func (p *Pool) nextJob() internal.WorkerJob {
+	for _, queue := range []chan internal.WorkerJob{p.retries, p.jobs, p.lowRetries} {
+		select {
+		case job := <-queue:
+			return job
+		default:
 		}
 	}
+
+	select {
+	case job := <-p.retries:
+		return job
+	case job := <-p.jobs:
+		return job
+	case job := <-p.lowRetries:
+		return job
+	case job := <-p.lowJobs:
+		return job
+	}
 }
 
 /*
-callWorker sends an inference request to a worker via its standardized /execute endpoint
-Returns the response text and the latency in milliseconds
+processJob runs one job on its assigned worker, retrying elsewhere on failure
 */
-func (p *Pool) callWorker(workerURL string, req internal.LlamaRequest) (string, float64) {
-	startTime := time.Now()
+func (p *Pool) processJob(id int, job internal.WorkerJob) {
+	if job.Ctx == nil {
+		job.Ctx = context.Background()
+	}
+	if job.Ctx.Err() != nil {
+		log.Printf("[Processor %d] Dropping cancelled job", id)
+		p.releaseTrial(job.WorkerURL, time.Now()) // picking the worker may have claimed its trial
+		job.ReplyCh <- "Error: request cancelled"
+		return
+	}
 
-	jsonData, err := json.Marshal(req)
-	if err != nil {
-		return fmt.Sprintf("Error marshaling request: %v", err), 0
+	jobStart := time.Now()
+	log.Printf("[Processor %d] Processing job with worker %s", id, job.WorkerURL)
+	if job.RetryCount == 0 {
+		p.earnRetry()
 	}
 
-	/*
-		TODO: right now this is hard-coded. We need to update this so that callWorker adds info about
-			what endpoint we're trying to hit. So whether it's chat or otherwise.
-			Should depend on the gollama endpoint.
-	*/
-	executeReq := map[string]interface{}{
-		"endpoint": "/v1/chat/completions",
-		"body":     json.RawMessage(jsonData),
+	callStart := time.Now()
+	result, latencyMS, worker := p.callWithHedge(id, job)
+	job.WorkerURL = worker // a hedge may have answered instead
+	callDuration := time.Since(callStart)
+
+	totalDuration := time.Since(jobStart)
+	queueDepth := len(p.jobs) + len(p.lowJobs) + len(p.retries) + len(p.lowRetries)
+	log.Printf("[Processor %d] Job completed in %v (worker call: %v) - Queue depth: %d",
+		id, totalDuration, callDuration, queueDepth)
+
+	if job.Ctx.Err() != nil {
+		// the call was aborted by the client, which says nothing about the worker's health
+		log.Printf("[Processor %d] Job cancelled while running on worker %s", id, job.WorkerURL)
+		job.ReplyCh <- "Error: request cancelled"
+		return
 	}
 
-	executePayload, err := json.Marshal(executeReq)
-	if err != nil {
-		return fmt.Sprintf("Error marshaling execute request: %v", err), 0
+	if IsRejected(result) {
+		// the request itself is bad: the worker is fine and any other worker would refuse it too
+		log.Printf("[Processor %d] Worker %s rejected the request: %s", id, job.WorkerURL, result)
+		p.releaseTrial(job.WorkerURL, callStart)
+		p.mu.Lock()
+		p.rejected++
+		p.mu.Unlock()
+		job.ReplyCh <- result
+		return
 	}
 
-	resp, err := http.Post(
-		fmt.Sprintf("%s/execute", workerURL),
-		"application/json",
-		bytes.NewBuffer(executePayload),
-	)
-	if err != nil {
-		return fmt.Sprintf("Error contacting worker: %v", err), 0
+	if IsError(result) {
+		// the worker's circuit breaker decides whether it stays in rotation
+		log.Printf("[Processor %d] Worker %s failed", id, job.WorkerURL)
+		p.updateWorkerStats(job.WorkerURL, false, 0)
+		p.retryJob(&job, id, "Error: Job failed after maximum retries")
+		return // Move to next job after retry
+	} else if job.Validate != nil {
+		p.updateWorkerStats(job.WorkerURL, true, latencyMS)
+		if err := job.Validate(result); err != nil {
+			// the worker is healthy, the model just produced bad output; another worker may do better
+			log.Printf("[Processor %d] Output from worker %s failed validation: %v", id, job.WorkerURL, err)
+			p.retryJob(&job, id, fmt.Sprintf("Error: output failed validation after maximum retries: %v", err))
+			return
+		}
+		p.rememberPrefixes(job.Prefixes, job.WorkerURL)
+		job.ReplyCh <- result
+	} else {
+		p.updateWorkerStats(job.WorkerURL, true, latencyMS)
+		p.rememberPrefixes(job.Prefixes, job.WorkerURL)
+		job.ReplyCh <- result
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
+}
+
+/*
+callWorker sends a job to its worker via the standardized /execute endpoint, on the llama.cpp endpoint
+the job asks for. Chat jobs return the reply text; raw jobs return llama.cpp's JSON response.
+Returns the response and the latency in milliseconds
+*/
+func (p *Pool) callWorker(job internal.WorkerJob) (string, float64) {
+	startTime := time.Now()
+	workerURL := job.WorkerURL
+
+	endpoint := job.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+
+	jsonData := []byte(job.Body)
+	if job.Body == nil {
+		var err error
+		jsonData, err = json.Marshal(job.Request)
 		if err != nil {
-			log.Printf("Error closing response body: %v", err)
+			return fmt.Sprintf("Error marshaling request: %v", err), 0
 		}
-	}(resp.Body)
+	}
 
-	body, err := io.ReadAll(resp.Body)
+	var body []byte
+	var status int
+	var err error
+	if isTunnelURL(workerURL) {
+		body, status, err = p.executeTunnel(job.Ctx, workerURL, endpoint, jsonData, affinityHint(job.Prefixes))
+	} else {
+		body, status, err = p.executeHTTP(job.Ctx, workerURL, endpoint, jsonData, affinityHint(job.Prefixes))
+	}
+	if isClientError(status) {
+		msg := rawError(body)
+		if err != nil {
+			msg = err.Error()
+		}
+		return fmt.Sprintf("%s (%d): %s", rejectedPrefix, status, msg), 0
+	}
 	if err != nil {
-		return fmt.Sprintf("Error reading response: %v", err), 0
+		return fmt.Sprintf("Error contacting worker: %v", err), 0
+	}
+	if rawError(body) == "" {
+		p.chargePeer(workerURL, body)
+	}
+
+	if job.Body != nil {
+		if msg := rawError(body); msg != "" {
+			return fmt.Sprintf("Worker error: %s", msg), 0
+		}
+		return string(body), float64(time.Since(startTime).Microseconds()) / 1000.0
 	}
 
 	var workerResp internal.LlamaResponse
@@ -177,7 +317,117 @@ func (p *Pool) callWorker(workerURL string, req internal.LlamaRequest) (string,
 }
 
 /*
-updateWorkerStats updates the statistics for a worker after job completion
+rawError extracts the error message from a raw llama.cpp response, which reports errors either as a
+string or as an OpenAI-style {"message": ...} object, and from a worker's plain-text rejection.
+Returns "" for a successful response.
+*/
+func rawError(body []byte) string {
+	var resp struct {
+		Error json.RawMessage `json:"error"`
+	}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		// the worker itself rejected the command with a plain-text error
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > 200 {
+			msg = msg[:200] + "..."
+		}
+		return msg
+	}
+	if len(resp.Error) == 0 || string(resp.Error) == "null" {
+		return ""
+	}
+
+	var msg string
+	if json.Unmarshal(resp.Error, &msg) == nil {
+		return msg
+	}
+	var obj struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(resp.Error, &obj) == nil && obj.Message != "" {
+		return obj.Message
+	}
+	return string(resp.Error)
+}
+
+/*
+affinityHint is the key a worker uses to keep a conversation on the same local backend
+*/
+func affinityHint(prefixes []string) string {
+	if len(prefixes) == 0 {
+		return ""
+	}
+	return prefixes[0]
+}
+
+/*
+executeHTTP posts an execute command to a directly reachable worker and returns the raw response body
+and its status
+*/
+func (p *Pool) executeHTTP(ctx context.Context, workerURL string, endpoint string, body []byte, affinity string) ([]byte, int, error) {
+	executeReq := map[string]interface{}{
+		"endpoint": endpoint,
+		"body":     json.RawMessage(body),
+	}
+	if affinity != "" {
+		executeReq["affinity"] = affinity
+	}
+
+	executePayload, err := json.Marshal(executeReq)
+	if err != nil {
+		return nil, 0, fmt.Errorf("marshaling execute request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/execute", workerURL), bytes.NewBuffer(executePayload))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Workers only accept commands that carry the token we issued them
+	p.mu.RLock()
+	token := p.workerTokens[workerURL]
+	p.mu.RUnlock()
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Printf("Error closing response body: %v", err)
+		}
+	}(resp.Body)
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("reading response: %w", err)
+	}
+	return respBody, resp.StatusCode, nil
+}
+
+/*
+executeTunnel pushes an execute command down a reverse-connected worker's tunnel
+*/
+func (p *Pool) executeTunnel(ctx context.Context, workerURL string, endpoint string, body []byte, affinity string) ([]byte, int, error) {
+	p.mu.RLock()
+	t, exists := p.tunnels[workerURL]
+	p.mu.RUnlock()
+	if !exists {
+		return nil, 0, fmt.Errorf("no tunnel open for %s", workerURL)
+	}
+
+	return t.execute(ctx, endpoint, body, affinity)
+}
+
+/*
+updateWorkerStats updates the statistics for a worker after job completion and feeds the result to
+its circuit breaker
 */
 func (p *Pool) updateWorkerStats(url string, success bool, latencyMS float64) {
 	p.mu.Lock()
@@ -187,6 +437,7 @@ func (p *Pool) updateWorkerStats(url string, success bool, latencyMS float64) {
 	if !exists {
 		return // Worker not found, probably already removed
 	}
+	p.recordOutcome(url, success)
 
 	if success {
 		stats.JobsCompleted++
@@ -213,9 +464,9 @@ func (p *Pool) updateWorkerStats(url string, success bool, latencyMS float64) {
 }
 
 /*
-isError checks if the result is an error message
+IsError checks if the result is an error message
 */
-func isError(result string) bool {
+func IsError(result string) bool {
 	return len(result) > 5 && (result[:5] == "Error" || result[:5] == "error" || result[:6] == "Worker")
 }
 
@@ -263,28 +514,59 @@ func (p *Pool) isWorkerBusy(workerURL string) (busy bool, healthy bool) {
 }
 
 /*
-SubmitJob adds a job to the worker pool queue
+SubmitJob adds a job to the worker pool queue. Jobs whose context is marked low priority go to the
+background queue, which processors only drain when no interactive job is waiting.
 */
 func (p *Pool) SubmitJob(job internal.WorkerJob) {
+	if job.Ctx != nil && IsLowPriority(job.Ctx) {
+		p.lowJobs <- job
+		return
+	}
 	p.jobs <- job
 }
 
+// lowPriorityKey marks a context whose jobs should yield to interactive traffic
+type lowPriorityKey struct{}
+
 /*
-AddWorker adds a new worker to the pool
+WithLowPriority marks every job submitted under ctx as background work
 */
-func (p *Pool) AddWorker(url string) {
+func WithLowPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lowPriorityKey{}, true)
+}
+
+/*
+IsLowPriority reports whether ctx was marked with WithLowPriority
+*/
+func IsLowPriority(ctx context.Context) bool {
+	low, _ := ctx.Value(lowPriorityKey{}).(bool)
+	return low
+}
+
+/*
+AddWorker adds a new worker to the pool under the display name it registered with, along with the
+models it serves
+*/
+func (p *Pool) AddWorker(url string, name string, models []internal.ModelInfo) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Check if worker already exists - don't add them to the pool if they do
-	if _, exists := p.workerStats[url]; exists {
+	// Check if worker already exists - don't add them to the pool if they do, but pick up any
+	// change in the models it advertises (e.g. a backend was added or swapped)
+	// A re-registering worker is back up, so its breaker starts closed again.
+	if stats, exists := p.workerStats[url]; exists {
 		log.Printf("Worker %s already registered", url)
+		stats.Name = name
+		stats.Models = models
+		delete(p.breakers, url)
 		return
 	}
 
 	//initialize stats.
 	p.workerStats[url] = &internal.WorkerStats{
+		Name:          name,
 		URL:           url,
+		Models:        models,
 		JobsCompleted: 0,
 		JobsFailed:    0,
 		StartTime:     time.Now(),
@@ -294,7 +576,53 @@ func (p *Pool) AddWorker(url string) {
 	}
 
 	p.workerOrder = append(p.workerOrder, url)
-	log.Printf("Added worker: %s (total workers: %d)", url, len(p.workerOrder))
+	p.rebuildRing()
+	log.Printf("Added worker: %s at %s (total workers: %d)", name, url, len(p.workerOrder))
+}
+
+/*
+Replicator shares worker registrations with other hub replicas (see internal/cluster). It applies
+each change to every replica's pool, this one included, with AddWorker and RemoveWorker.
+*/
+type Replicator interface {
+	ReplicateWorker(url string, name string, models []internal.ModelInfo, token string) error
+	ReplicateRemoval(url string) error
+}
+
+/*
+SetReplicator makes worker registrations go through r, so every hub replica can dispatch to a worker
+that registered with any one of them
+*/
+func (p *Pool) SetReplicator(r Replicator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replicator = r
+}
+
+/*
+RegisterWorker adds a worker that registered over /connectWorker, along with the JWT it presents
+back on /execute. With a replicator set, the worker is added on every hub.
+*/
+func (p *Pool) RegisterWorker(url string, name string, models []internal.ModelInfo, token string) error {
+	p.mu.RLock()
+	r := p.replicator
+	p.mu.RUnlock()
+	if r != nil {
+		return r.ReplicateWorker(url, name, models, token)
+	}
+
+	p.AddWorker(url, name, models)
+	p.SetWorkerToken(url, token)
+	return nil
+}
+
+/*
+SetWorkerToken records the JWT a worker registered with so the pool can authenticate to its /execute endpoint
+*/
+func (p *Pool) SetWorkerToken(url string, token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workerTokens[url] = token
 }
 
 /*
@@ -309,10 +637,14 @@ func (p *Pool) RemoveWorker(url string) {
 			url, stats.JobsCompleted, stats.JobsFailed, time.Since(stats.StartTime).Round(time.Second))
 		delete(p.workerStats, url)
 	}
+	delete(p.workerTokens, url)
+	delete(p.breakers, url)
+	delete(p.peers, url)
 
 	for i, w := range p.workerOrder {
 		if w == url {
 			p.workerOrder = append(p.workerOrder[:i], p.workerOrder[i+1:]...)
+			p.rebuildRing()
 			log.Printf("Worker %s removed (total workers: %d)", url, len(p.workerOrder))
 			return
 		}
@@ -324,6 +656,31 @@ GetWorker returns a worker using round-robin selection
 Returns empty string if no workers are available
 */
 func (p *Pool) GetWorker() string {
+	return p.GetWorkerForModel("")
+}
+
+/*
+GetWorkerForModel returns the next worker in round-robin order that serves the given model.
+An empty model matches any worker. Returns empty string if no worker serves the model.
+*/
+func (p *Pool) GetWorkerForModel(model string) string {
+	return p.GetWorkerFor(model, "")
+}
+
+/*
+GetWorkerFor returns the next worker in round-robin order that serves the model with the given
+capability. Empty model or capability match anything.
+*/
+func (p *Pool) GetWorkerFor(model string, capability string) string {
+	return p.nextWorker(model, capability, nil, true)
+}
+
+/*
+nextWorker is GetWorkerFor skipping the workers in exclude. Local workers come first. With spill
+set, a peer hub with room takes the job when every local worker is saturated or none serves it;
+without it, peers are never picked.
+*/
+func (p *Pool) nextWorker(model string, capability string, exclude map[string]bool, spill bool) string {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -335,10 +692,107 @@ func (p *Pool) GetWorker() string {
 		p.nextIdx = 0
 	}
 
-	worker := p.workerOrder[p.nextIdx]
-	p.nextIdx = (p.nextIdx + 1) % len(p.workerOrder)
+	pick := func(accept func(worker string) bool) string {
+		for i := 0; i < len(p.workerOrder); i++ {
+			idx := (p.nextIdx + i) % len(p.workerOrder)
+			worker := p.workerOrder[idx]
+			// available goes last: for a half-open worker it claims the trial slot
+			if exclude[worker] || !supports(p.workerStats[worker], model, capability) || !accept(worker) || !p.available(worker) {
+				continue
+			}
+			p.nextIdx = (idx + 1) % len(p.workerOrder)
+			return worker
+		}
+		return ""
+	}
+	local := func(worker string) bool {
+		_, peer := p.peers[worker]
+		return !peer
+	}
 
-	return worker
+	if worker := pick(func(w string) bool { return local(w) && !(spill && p.saturated(w)) }); worker != "" {
+		return worker
+	}
+	if spill {
+		if worker := pick(p.peerHasRoom); worker != "" {
+			return worker
+		}
+	}
+	// nowhere to spill to: queue on a saturated local worker
+	return pick(local)
+}
+
+/*
+HasWorkerFor reports whether any worker in rotation serves the model with the given capability.
+Unlike GetWorkerFor it doesn't pick a worker, so it's safe for handlers to check before queueing.
+*/
+func (p *Pool) HasWorkerFor(model string, capability string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.hasWorker(model, capability, true)
+}
+
+/*
+hasWorker is HasWorkerFor, counting peer hubs only if peers is set. Callers hold p.mu.
+*/
+func (p *Pool) hasWorker(model string, capability string, peers bool) bool {
+	now := time.Now()
+	for _, worker := range p.workerOrder {
+		if _, peer := p.peers[worker]; peer && !peers {
+			continue
+		}
+		if !supports(p.workerStats[worker], model, capability) {
+			continue
+		}
+		if b, ok := p.breakers[worker]; !ok || b.ready(now) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+MinContextSize returns the smallest context window advertised by workers serving the model (any
+model if empty), so callers can size prompts that fit wherever the job lands. Returns 0 if unknown.
+*/
+func (p *Pool) MinContextSize(model string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	smallest := 0
+	for _, stats := range p.workerStats {
+		for _, m := range stats.Models {
+			if model != "" && m.Name != model {
+				continue
+			}
+			if m.ContextSize > 0 && (smallest == 0 || m.ContextSize < smallest) {
+				smallest = m.ContextSize
+			}
+		}
+	}
+	return smallest
+}
+
+/*
+supports checks whether a worker advertised the given model and capability at registration
+*/
+func supports(stats *internal.WorkerStats, model string, capability string) bool {
+	if stats == nil {
+		return false
+	}
+	if model == "" && capability == "" {
+		return true
+	}
+	for _, m := range stats.Models {
+		if model != "" && m.Name != model {
+			continue
+		}
+		if capability == CapabilityEmbeddings && !m.Embeddings {
+			continue
+		}
+		return true
+	}
+	return false
 }
 
 /*
@@ -357,9 +811,16 @@ func (p *Pool) GetWorkerStats() map[string]internal.WorkerStats {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
+	now := time.Now()
 	stats := make(map[string]internal.WorkerStats)
 	for url, workerStats := range p.workerStats {
-		stats[url] = *workerStats
+		copied := *workerStats
+		copied.Latency = p.latencySummary(url)
+		copied.Breaker = internal.BreakerStatus{State: BreakerClosed}
+		if b, ok := p.breakers[url]; ok {
+			copied.Breaker = b.status(now)
+		}
+		stats[url] = copied
 	}
 	return stats
 }
@@ -368,5 +829,16 @@ func (p *Pool) GetWorkerStats() map[string]internal.WorkerStats {
 GetMaxRetries returns the configured maximum number of retries
 */
 func (p *Pool) GetMaxRetries() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	return p.maxRetries
 }
+
+/*
+SetMaxRetries changes how many times new jobs are retried. Jobs already queued keep their count.
+*/
+func (p *Pool) SetMaxRetries(maxRetries int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxRetries = maxRetries
+}
@@ -0,0 +1,204 @@
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Queue backends
+const (
+	QueueMemory = "memory"
+	QueueWAL    = "wal"
+)
+
+/*
+QueuedJob is a request held in a Queue from submission until its owner removes it. Data is the
+owner's record of the job (its status, result and so on), so the job can be restored as it was.
+Body is dropped once the job is done; Hash, the owner's digest of the request, is kept with the key
+so a reused key can be told apart from a retry.
+*/
+type QueuedJob struct {
+	ID       string          `json:"id"`
+	Key      string          `json:"key,omitempty"` // idempotency key
+	Hash     string          `json:"hash,omitempty"`
+	Endpoint string          `json:"endpoint"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Done     bool            `json:"done,omitempty"`
+}
+
+/*
+Queue holds background jobs (async requests) so they outlive the process that accepted them. A job
+is added before it runs and marked done after, so anything not done when the hub stops is run again
+on startup: delivery is at least once. Idempotency keys stop a client's retried submission from
+creating a second job.
+*/
+type Queue interface {
+	// Add stores a new job. If a job with the same idempotency key is stored, that job is returned
+	// instead, with false.
+	Add(job QueuedJob) (QueuedJob, bool, error)
+	// Finish marks a job done and replaces its data
+	Finish(id string, data json.RawMessage) error
+	// Remove forgets a job and frees its idempotency key
+	Remove(id string) error
+	// Jobs returns every stored job in the order they were added
+	Jobs() []QueuedJob
+	Close() error
+}
+
+/*
+NewQueue opens a queue with the named backend. dir is only used by the WAL backend.
+*/
+func NewQueue(backend string, dir string) (Queue, error) {
+	switch backend {
+	case QueueMemory, "":
+		return NewMemoryQueue(), nil
+	case QueueWAL:
+		return OpenWALQueue(dir)
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q (use %s or %s)", backend, QueueMemory, QueueWAL)
+	}
+}
+
+/*
+MemoryQueue is a Queue that lives only as long as the process. Idempotency keys still work, but
+nothing survives a restart.
+*/
+type MemoryQueue struct {
+	mu    sync.Mutex
+	jobs  map[string]*QueuedJob
+	keys  map[string]string // idempotency key -> job ID
+	order []string
+}
+
+/*
+NewMemoryQueue creates an empty in-memory queue
+*/
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{
+		jobs: make(map[string]*QueuedJob),
+		keys: make(map[string]string),
+	}
+}
+
+func (q *MemoryQueue) Add(job QueuedJob) (QueuedJob, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if existing, ok := q.lookup(job.Key); ok {
+		return existing, false, nil
+	}
+	q.add(job)
+	return job, true, nil
+}
+
+func (q *MemoryQueue) Finish(id string, data json.RawMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finish(id, data)
+	return nil
+}
+
+func (q *MemoryQueue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.remove(id)
+	return nil
+}
+
+func (q *MemoryQueue) Jobs() []QueuedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]QueuedJob, 0, len(q.jobs))
+	for _, id := range q.order {
+		if job, ok := q.jobs[id]; ok {
+			jobs = append(jobs, *job)
+		}
+	}
+	return jobs
+}
+
+func (q *MemoryQueue) Close() error {
+	return nil
+}
+
+/*
+Get returns a stored job by ID
+*/
+func (q *MemoryQueue) Get(id string) (QueuedJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return QueuedJob{}, false
+	}
+	return *job, true
+}
+
+/*
+Lookup returns the stored job holding an idempotency key
+*/
+func (q *MemoryQueue) Lookup(key string) (QueuedJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lookup(key)
+}
+
+/*
+lookup finds the job holding an idempotency key. Callers hold q.mu.
+*/
+func (q *MemoryQueue) lookup(key string) (QueuedJob, bool) {
+	if key == "" {
+		return QueuedJob{}, false
+	}
+	id, ok := q.keys[key]
+	if !ok {
+		return QueuedJob{}, false
+	}
+	return *q.jobs[id], true
+}
+
+/*
+add, finish and remove apply a change to the queue's state; the WAL backend replays its log through
+them too. Callers hold q.mu.
+*/
+func (q *MemoryQueue) add(job QueuedJob) {
+	if _, exists := q.jobs[job.ID]; !exists {
+		q.order = append(q.order, job.ID)
+	}
+	q.jobs[job.ID] = &job
+	if job.Key != "" {
+		q.keys[job.Key] = job.ID
+	}
+}
+
+func (q *MemoryQueue) finish(id string, data json.RawMessage) {
+	job, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+	job.Data = data
+	job.Done = true
+	job.Body = nil
+}
+
+func (q *MemoryQueue) remove(id string) {
+	job, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+	delete(q.jobs, id)
+	if job.Key != "" && q.keys[job.Key] == id {
+		delete(q.keys, job.Key)
+	}
+	// order is compacted lazily, once most of it is stale
+	if len(q.order) > 64 && len(q.order) > 2*len(q.jobs) {
+		live := q.order[:0]
+		for _, id := range q.order {
+			if _, ok := q.jobs[id]; ok {
+				live = append(live, id)
+			}
+		}
+		q.order = live
+	}
+}
@@ -0,0 +1,167 @@
+package pool
+
+import (
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"gollama/internal"
+)
+
+// Retry tuning
+const (
+	defaultRetryBaseDelay = 200 * time.Millisecond
+	defaultRetryMaxDelay  = 5 * time.Second
+	defaultRetryBudget    = 0.2  // retries allowed per new job
+	maxRetryBurst         = 10.0 // retries that can be saved up while traffic is quiet
+)
+
+// rejectedPrefix starts the reply for a request a worker refused as invalid. It is still an error
+// (see IsError), but one no other worker would accept either, so it is never retried.
+const rejectedPrefix = "Error: request rejected"
+
+/*
+RetryStats reports how many failed jobs were retried and how many were not
+*/
+type RetryStats struct {
+	BudgetPercent   float64 `json:"budget_percent"`
+	Retried         int     `json:"retried"`
+	BudgetExhausted int     `json:"budget_exhausted"`
+	Rejected        int     `json:"rejected"`
+}
+
+/*
+SetRetryPolicy sets how failed jobs are retried. The n-th retry waits about baseDelay * 2^(n-1), capped
+at maxDelay and jittered so retries from one outage don't arrive together. budgetPercent caps retries
+as a share of new jobs, so a failing pool isn't buried under its own retries; 0 turns the budget off.
+Retries already saved up are kept, so changing the policy on reload doesn't refill the budget.
+*/
+func (p *Pool) SetRetryPolicy(baseDelay time.Duration, maxDelay time.Duration, budgetPercent float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retryBaseDelay = baseDelay
+	p.retryMaxDelay = max(maxDelay, baseDelay)
+	p.retryBudget = budgetPercent / 100
+}
+
+/*
+GetRetryStats returns the retry counters
+*/
+func (p *Pool) GetRetryStats() RetryStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return RetryStats{
+		BudgetPercent:   p.retryBudget * 100,
+		Retried:         p.retried,
+		BudgetExhausted: p.retriesDenied,
+		Rejected:        p.rejected,
+	}
+}
+
+/*
+IsRejected reports whether a reply is a worker refusing the request itself (a 4xx such as a malformed
+body or a prompt over the context size), as opposed to the worker failing
+*/
+func IsRejected(result string) bool {
+	return strings.HasPrefix(result, rejectedPrefix)
+}
+
+/*
+isClientError reports whether a worker's status means the request is at fault. 401 and 403 are
+between the hub and that worker, 404 means that worker has no backend for the model, and 408 and
+429 mean it's busy, so another worker may still succeed.
+*/
+func isClientError(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 400 && status < 500
+}
+
+/*
+earnRetry adds one new job's worth of retry budget
+*/
+func (p *Pool) earnRetry() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retryTokens = min(p.retryTokens+p.retryBudget, maxRetryBurst)
+}
+
+/*
+takeRetry spends one retry from the budget, reporting false if none are left
+*/
+func (p *Pool) takeRetry() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retryBudget > 0 && p.retryTokens < 1 {
+		p.retriesDenied++
+		return false
+	}
+	if p.retryBudget > 0 {
+		p.retryTokens--
+	}
+	p.retried++
+	return true
+}
+
+/*
+retryDelay is the backoff before the given retry (1 for the first): exponential, capped, with the
+upper half jittered
+*/
+func (p *Pool) retryDelay(attempt int) time.Duration {
+	p.mu.RLock()
+	delay, ceiling := p.retryBaseDelay, p.retryMaxDelay
+	p.mu.RUnlock()
+
+	for i := 1; i < attempt && delay < ceiling; i++ {
+		delay *= 2
+	}
+	delay = min(delay, ceiling)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+/*
+resubmit waits out a retry's backoff, then queues the job ahead of new work on a worker that hasn't
+failed it yet. If every worker has, the next available one gets another go: after the backoff it
+may have recovered.
+*/
+func (p *Pool) resubmit(job internal.WorkerJob, processorID int, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-job.Ctx.Done():
+		job.ReplyCh <- "Error: request cancelled"
+		return
+	}
+
+	job.WorkerURL = p.nextWorker(job.Request.Model, job.Capability, job.Failed, !job.LocalOnly)
+	if job.WorkerURL == "" {
+		job.WorkerURL = p.nextWorker(job.Request.Model, job.Capability, nil, !job.LocalOnly)
+	}
+	if job.WorkerURL == "" {
+		log.Printf("[Processor %d] No workers available for retry", processorID)
+		job.ReplyCh <- "Error: No available workers for retry"
+		return
+	}
+
+	log.Printf("[Processor %d] Retrying job (attempt %d/%d) with worker %s",
+		processorID, job.RetryCount, job.MaxRetries, job.WorkerURL)
+	queue := p.retries
+	if IsLowPriority(job.Ctx) {
+		queue = p.lowRetries
+	}
+	select {
+	case queue <- job:
+	case <-job.Ctx.Done():
+		p.releaseTrial(job.WorkerURL, time.Now())
+		job.ReplyCh <- "Error: request cancelled"
+	}
+}
@@ -0,0 +1,41 @@
+package pool
+
+import "testing"
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name       string
+		budget     float64
+		tokens     float64
+		earn       int // jobs submitted before the retries
+		takes      []bool
+		wantTokens float64
+		wantDenied int
+	}{
+		{"unlimited budget never runs out", 0, 0, 0, []bool{true, true, true}, 0, 0},
+		{"spends saved tokens", 0.2, 2, 0, []bool{true, true, false}, 0, 1},
+		{"a partial token isn't enough", 0.2, 0.5, 0, []bool{false}, 0.5, 1},
+		{"five jobs earn one retry at 20%", 0.2, 0, 5, []bool{true, false}, 0, 1},
+		{"savings are capped", 0.5, maxRetryBurst - 1, 10, nil, maxRetryBurst, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(1, 1, 3)
+			p.retryBudget, p.retryTokens = tt.budget, tt.tokens
+			for range tt.earn {
+				p.earnRetry()
+			}
+			for i, want := range tt.takes {
+				if got := p.takeRetry(); got != want {
+					t.Fatalf("retry %d: takeRetry returned %v, want %v", i+1, got, want)
+				}
+			}
+			if p.retryTokens < tt.wantTokens-1e-9 || p.retryTokens > tt.wantTokens+1e-9 {
+				t.Fatalf("%v tokens left, want %v", p.retryTokens, tt.wantTokens)
+			}
+			if p.retriesDenied != tt.wantDenied {
+				t.Fatalf("%d retries denied, want %d", p.retriesDenied, tt.wantDenied)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package pool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gollama/internal"
+)
+
+// tunnelScheme marks worker URLs that are reached through a reverse tunnel instead of HTTP
+const tunnelScheme = "tunnel://"
+
+// tunnelTimeout bounds how long the hub waits for a tunneled worker to answer a job
+const tunnelTimeout = 5 * time.Minute
+
+/*
+Tunnel is the hub side of a reverse connection. Workers behind NAT dial out to the hub and hold a
+long-lived stream open; the hub pushes /execute commands down the stream and the worker posts the
+results back, matched by request ID.
+*/
+type Tunnel struct {
+	WorkerURL string
+	requests  chan internal.TunnelMessage
+	pending   map[string]chan internal.TunnelResult
+	mu        sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+	nextID    atomic.Uint64
+}
+
+/*
+TunnelURL returns the pseudo-URL a tunneled worker is registered under in the pool
+*/
+func TunnelURL(workerID string) string {
+	return tunnelScheme + workerID
+}
+
+/*
+isTunnelURL reports whether the worker URL refers to a reverse-connected worker
+*/
+func isTunnelURL(workerURL string) bool {
+	return strings.HasPrefix(workerURL, tunnelScheme)
+}
+
+/*
+OpenTunnel registers a reverse-connected worker with the pool and returns its tunnel. An existing
+tunnel for the same worker is closed first so a reconnecting worker replaces its stale stream.
+*/
+func (p *Pool) OpenTunnel(workerID string, models []internal.ModelInfo) *Tunnel {
+	url := TunnelURL(workerID)
+
+	p.mu.Lock()
+	old := p.tunnels[url]
+	t := &Tunnel{
+		WorkerURL: url,
+		requests:  make(chan internal.TunnelMessage),
+		pending:   make(map[string]chan internal.TunnelResult),
+		closed:    make(chan struct{}),
+	}
+	p.tunnels[url] = t
+	p.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+
+	p.AddWorker(url, workerID, models)
+	log.Printf("Tunnel opened for worker %s", workerID)
+	return t
+}
+
+/*
+CloseTunnel removes a reverse-connected worker from the pool and fails any requests still waiting on it
+*/
+func (p *Pool) CloseTunnel(t *Tunnel) {
+	p.mu.Lock()
+	current := p.tunnels[t.WorkerURL] == t
+	if current {
+		delete(p.tunnels, t.WorkerURL)
+	}
+	p.mu.Unlock()
+
+	t.close()
+	if current {
+		p.RemoveWorker(t.WorkerURL)
+	}
+	log.Printf("Tunnel closed for worker %s", t.WorkerURL)
+}
+
+/*
+DeliverTunnelResult hands a worker's answer back to the job waiting on it
+*/
+func (p *Pool) DeliverTunnelResult(workerID string, result internal.TunnelResult) error {
+	p.mu.RLock()
+	t, exists := p.tunnels[TunnelURL(workerID)]
+	p.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("no tunnel open for worker %s", workerID)
+	}
+
+	t.mu.Lock()
+	replyCh, exists := t.pending[result.ID]
+	delete(t.pending, result.ID)
+	t.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("unknown tunnel request %s", result.ID)
+	}
+
+	replyCh <- result
+	return nil
+}
+
+/*
+Requests returns the stream of commands to push to the worker
+*/
+func (t *Tunnel) Requests() <-chan internal.TunnelMessage {
+	return t.requests
+}
+
+/*
+Closed is closed once the tunnel has been torn down
+*/
+func (t *Tunnel) Closed() <-chan struct{} {
+	return t.closed
+}
+
+/*
+execute pushes an /execute payload down the tunnel and waits for the worker's response
+Returns the raw response body and the status code reported by the worker
+*/
+func (t *Tunnel) execute(ctx context.Context, endpoint string, body json.RawMessage, affinity string) ([]byte, int, error) {
+	id := fmt.Sprintf("%d", t.nextID.Add(1))
+	replyCh := make(chan internal.TunnelResult, 1)
+
+	t.mu.Lock()
+	t.pending[id] = replyCh
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+
+	msg := internal.TunnelMessage{
+		Type:     "execute",
+		ID:       id,
+		Endpoint: endpoint,
+		Body:     body,
+		Affinity: affinity,
+	}
+
+	select {
+	case t.requests <- msg:
+	case <-t.closed:
+		return nil, 0, fmt.Errorf("tunnel closed")
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case <-time.After(tunnelTimeout):
+		return nil, 0, fmt.Errorf("tunnel send timed out")
+	}
+
+	select {
+	case result := <-replyCh:
+		if result.Error != "" {
+			return nil, result.StatusCode, fmt.Errorf("%s", result.Error)
+		}
+		return result.Body, result.StatusCode, nil
+	case <-t.closed:
+		return nil, 0, fmt.Errorf("tunnel closed")
+	case <-ctx.Done():
+		t.cancel(id)
+		return nil, 0, ctx.Err()
+	case <-time.After(tunnelTimeout):
+		t.cancel(id)
+		return nil, 0, fmt.Errorf("tunnel response timed out")
+	}
+}
+
+/*
+cancel tells the worker to stop a job nobody is waiting on any more (a hedge that lost, a client
+that hung up), so it doesn't keep generating
+*/
+func (t *Tunnel) cancel(id string) {
+	go func() {
+		select {
+		case t.requests <- internal.TunnelMessage{Type: "cancel", ID: id}:
+		case <-t.closed:
+		case <-time.After(tunnelTimeout):
+		}
+	}()
+}
+
+func (t *Tunnel) close() {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+}
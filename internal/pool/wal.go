@@ -0,0 +1,246 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// walFile is the log's name inside the queue directory
+const walFile = "queue.wal"
+
+// minCompactRecords is how long the log may grow before stale records are compacted away
+const minCompactRecords = 1000
+
+/*
+walRecord is one line of the log: a job added, finished or removed
+*/
+type walRecord struct {
+	Op   string          `json:"op"`
+	Job  *QueuedJob      `json:"job,omitempty"`
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+/*
+WALQueue is a Queue backed by a write-ahead log on local disk. Every change is appended and synced
+before it takes effect, so a job the hub accepted is never lost to a crash. The log is replayed on
+open and compacted as finished jobs are removed.
+*/
+type WALQueue struct {
+	*MemoryQueue // state as of the last record; its mutex also guards the log
+
+	path    string
+	file    *os.File
+	records int // lines in the log
+}
+
+/*
+OpenWALQueue opens the queue logged in dir, creating it if needed, and restores its jobs
+*/
+func OpenWALQueue(dir string) (*WALQueue, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating queue directory: %w", err)
+	}
+
+	q := &WALQueue{MemoryQueue: NewMemoryQueue(), path: filepath.Join(dir, walFile)}
+	err = q.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	// start from a compact log, which also drops a record torn by a crash mid-write
+	err = q.compact()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Queue: restored %d jobs from %s", len(q.jobs), q.path)
+	return q, nil
+}
+
+func (q *WALQueue) Add(job QueuedJob) (QueuedJob, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if existing, ok := q.lookup(job.Key); ok {
+		return existing, false, nil
+	}
+
+	err := q.append(walRecord{Op: "add", Job: &job})
+	if err != nil {
+		return QueuedJob{}, false, err
+	}
+	q.add(job)
+	return job, true, nil
+}
+
+func (q *WALQueue) Finish(id string, data json.RawMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.jobs[id]; !ok {
+		return nil
+	}
+
+	err := q.append(walRecord{Op: "finish", ID: id, Data: data})
+	if err != nil {
+		return err
+	}
+	q.finish(id, data)
+	return nil
+}
+
+func (q *WALQueue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.jobs[id]; !ok {
+		return nil
+	}
+
+	err := q.append(walRecord{Op: "remove", ID: id})
+	if err != nil {
+		return err
+	}
+	q.remove(id)
+
+	if q.records > minCompactRecords && q.records > 4*len(q.jobs) {
+		err = q.compact()
+		if err != nil {
+			log.Printf("Queue: compacting %s failed: %v", q.path, err)
+		}
+	}
+	return nil
+}
+
+func (q *WALQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
+
+/*
+append writes a record to the log and syncs it. Callers hold q.mu.
+*/
+func (q *WALQueue) append(record walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding queue record: %w", err)
+	}
+	_, err = q.file.Write(append(line, '\n'))
+	if err == nil {
+		err = q.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("writing queue log: %w", err)
+	}
+	q.records++
+	return nil
+}
+
+/*
+replay rebuilds the queue's state from the log. A line that can't be parsed (the tail of a write cut
+off by a crash) is skipped.
+*/
+func (q *WALQueue) replay() error {
+	f, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening queue log: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record walRecord
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				log.Printf("Queue: skipping unreadable record on line %d of %s", n, q.path)
+			} else {
+				q.apply(record)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading queue log: %w", err)
+		}
+	}
+}
+
+func (q *WALQueue) apply(record walRecord) {
+	switch record.Op {
+	case "add":
+		if record.Job != nil {
+			q.add(*record.Job)
+		}
+	case "finish":
+		q.finish(record.ID, record.Data)
+	case "remove":
+		q.remove(record.ID)
+	}
+}
+
+/*
+compact rewrites the log as one record per stored job, then reopens it for appending. The new log
+is written beside the old one and renamed over it, so a crash leaves one or the other intact.
+Callers hold q.mu (or own q exclusively, as OpenWALQueue does).
+*/
+func (q *WALQueue) compact() error {
+	tmpPath := q.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("compacting queue log: %w", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	records := 0
+	for _, id := range q.order {
+		job, ok := q.jobs[id]
+		if !ok {
+			continue
+		}
+		line, err := json.Marshal(walRecord{Op: "add", Job: job})
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("compacting queue log: %w", err)
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+		records++
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, q.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("compacting queue log: %w", err)
+	}
+
+	file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("reopening queue log: %w", err)
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = file
+	q.records = records
+	return nil
+}
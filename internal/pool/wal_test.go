@@ -0,0 +1,70 @@
+package pool
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestWALQueueReplay(t *testing.T) {
+	const records = `{"op":"add","job":{"id":"a","key":"ka","endpoint":"/chat","body":{"n":1}}}
+{"op":"add","job":{"id":"b","endpoint":"/chat","body":{"n":2}}}
+{"op":"finish","id":"a","data":{"status":"completed"}}
+`
+	tests := []struct {
+		name string
+		tail string // written after the records, as a crash mid-append would leave it
+	}{
+		{"clean log", ""},
+		{"torn final record", `{"op":"add","job":{"id":"c","endpo`},
+		{"torn record with its newline", `{"op":"remove","id":` + "\n"},
+		{"unreadable final line", "\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := os.WriteFile(filepath.Join(dir, walFile), []byte(records+tt.tail), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q, err := OpenWALQueue(dir)
+			if err != nil {
+				t.Fatalf("OpenWALQueue: %v", err)
+			}
+			checkJobs(t, q, []string{"a", "b"})
+			if job, ok := q.Lookup("ka"); !ok || job.ID != "a" || !job.Done || job.Body != nil {
+				t.Fatalf("job a restored as %+v, want it done under its key without a body", job)
+			}
+
+			// a record appended after the torn one must replay on its own line
+			_, created, err := q.Add(QueuedJob{ID: "d", Key: "kd", Endpoint: "/chat"})
+			if err != nil || !created {
+				t.Fatalf("Add: created %v, err %v", created, err)
+			}
+			err = q.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q, err = OpenWALQueue(dir)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			defer q.Close()
+			checkJobs(t, q, []string{"a", "b", "d"})
+		})
+	}
+}
+
+func checkJobs(t *testing.T, q Queue, want []string) {
+	t.Helper()
+	var ids []string
+	for _, job := range q.Jobs() {
+		ids = append(ids, job.ID)
+	}
+	if !slices.Equal(ids, want) {
+		t.Fatalf("jobs %v, want %v", ids, want)
+	}
+}
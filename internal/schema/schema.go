@@ -0,0 +1,259 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+Schema is the subset of JSON Schema the hub checks itself: type, properties, required,
+additionalProperties, items, enum, const, min/max length, items and value bounds, and pattern.
+Keywords outside that subset are accepted and ignored, since llama.cpp may still use them to
+constrain generation.
+*/
+type Schema struct {
+	Type                 typeList           `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Const                interface{}        `json:"const,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// typeList accepts both "type": "string" and "type": ["string", "null"]
+type typeList []string
+
+func (t *typeList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = typeList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = list
+	return nil
+}
+
+var knownTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true,
+}
+
+/*
+Parse decodes a schema and checks that the parts we validate with are well formed
+*/
+func Parse(raw json.RawMessage) (*Schema, error) {
+	var s Schema
+	err := json.Unmarshal(raw, &s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	err = s.compile("")
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) compile(path string) error {
+	for _, t := range s.Type {
+		if !knownTypes[t] {
+			return fmt.Errorf("invalid schema at %s: unknown type %q", where(path), t)
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid schema at %s: bad pattern: %w", where(path), err)
+		}
+		s.pattern = re
+	}
+	for name, prop := range s.Properties {
+		if prop == nil {
+			return fmt.Errorf("invalid schema at %s: property %s is null", where(path), name)
+		}
+		if err := prop.compile(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+/*
+Validate checks a decoded JSON value (as produced by json.Unmarshal into interface{}) against the
+schema and returns the first violation found
+*/
+func (s *Schema) Validate(value interface{}) error {
+	return s.validate("", value)
+}
+
+/*
+ValidateJSON decodes data and validates it
+*/
+func (s *Schema) ValidateJSON(data []byte) error {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return fmt.Errorf("not JSON: %w", err)
+	}
+	return s.Validate(value)
+}
+
+func (s *Schema) validate(path string, value interface{}) error {
+	if len(s.Type) > 0 && !s.matchesType(value) {
+		return fmt.Errorf("%s: expected %s, got %s", where(path), strings.Join(s.Type, " or "), typeOf(value))
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if equal(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed values", where(path))
+		}
+	}
+	if s.Const != nil && !equal(s.Const, value) {
+		return fmt.Errorf("%s: value does not match const", where(path))
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d characters", where(path), *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s: longer than %d characters", where(path), *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match pattern %s", where(path), s.Pattern)
+		}
+
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: %v is below the minimum %v", where(path), v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: %v is above the maximum %v", where(path), v, *s.Maximum)
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: fewer than %d items", where(path), *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: more than %d items", where(path), *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required field %s", where(path), name)
+			}
+		}
+
+		// walk fields in a fixed order so the reported error is stable
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected field %s", where(path), name)
+				}
+				continue
+			}
+			if err := prop.validate(path+"."+name, v[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) matchesType(value interface{}) bool {
+	actual := typeOf(value)
+	for _, t := range s.Type {
+		if t == actual {
+			return true
+		}
+		if t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+typeOf names the JSON type of a decoded value. Whole numbers report as integer.
+*/
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+/*
+equal compares two decoded JSON values by their encoding, which is canonical for json.Marshal
+(map keys are sorted)
+*/
+func equal(a interface{}, b interface{}) bool {
+	encA, errA := json.Marshal(a)
+	encB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(encA) == string(encB)
+}
+
+func where(path string) string {
+	if path == "" {
+		return "$"
+	}
+	return "$" + path
+}
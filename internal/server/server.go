@@ -5,8 +5,13 @@ import (
 	"log"
 	"net/http"
 
+	"gollama/internal/batch"
+	"gollama/internal/cluster"
+	"gollama/internal/federation"
 	"gollama/internal/handler"
+	"gollama/internal/jobs"
 	"gollama/internal/pool"
+	"gollama/internal/templates"
 )
 
 /*
@@ -14,21 +19,41 @@ Server manages the HTTP server and routes
 */
 type Server struct {
 	pool             *pool.Pool
+	templates        *templates.Registry
+	jobs             *jobs.Store
+	batches          *batch.Manager
+	node             *cluster.Node          // nil unless the hub runs as one of several replicas
+	federation       *federation.Federation // nil unless peer hubs are configured
 	port             int
 	defaultMaxTokens int
+	tlsCertFile      string // serve HTTPS when set, with tlsKeyFile
+	tlsKeyFile       string
 }
 
 /*
 New creates a new server instance
 */
-func New(p *pool.Pool, port int, defaultMaxTokens int) *Server {
+func New(p *pool.Pool, reg *templates.Registry, store *jobs.Store, batches *batch.Manager, node *cluster.Node, fed *federation.Federation, port int, defaultMaxTokens int) *Server {
 	return &Server{
 		pool:             p,
+		templates:        reg,
+		jobs:             store,
+		batches:          batches,
+		node:             node,
+		federation:       fed,
 		port:             port,
 		defaultMaxTokens: defaultMaxTokens,
 	}
 }
 
+/*
+SetTLS makes the server listen for HTTPS with the given certificate and key files
+*/
+func (s *Server) SetTLS(certFile string, keyFile string) {
+	s.tlsCertFile = certFile
+	s.tlsKeyFile = keyFile
+}
+
 /*
 Setup configures all routes and starts the server
 */
@@ -38,28 +63,79 @@ func (s *Server) Setup() {
 
 	// Register handlers
 	http.HandleFunc("/connectWorker", handler.HandleConnectWorker(s.pool))
-	http.HandleFunc("/chat", handler.HandleChat(s.pool, s.defaultMaxTokens))
+	http.HandleFunc("/tunnel", handler.HandleTunnel(s.pool))
+	http.HandleFunc("/tunnel/result", handler.HandleTunnelResult(s.pool))
+	http.HandleFunc("/chat", handler.TrackCache(handler.HandleChat(s.pool, s.defaultMaxTokens)))
 
 	// Register public handlers
 	http.HandleFunc("/health", handler.HandleHealth(s.pool))
 	http.HandleFunc("/stats", handler.HandleStats(s.pool))
-	http.HandleFunc("/summarize", handler.HandleSummarize(s.pool))
-	http.HandleFunc("/translate", handler.HandleTranslate(s.pool))
-	http.HandleFunc("/sentiment", handler.HandleSentiment(s.pool))
+	http.HandleFunc("/summarize", handler.TrackCache(handler.HandleSummarize(s.pool, s.templates)))
+	http.HandleFunc("/translate", handler.TrackCache(handler.HandleTranslate(s.pool, s.templates)))
+	http.HandleFunc("/sentiment", handler.TrackCache(handler.HandleSentiment(s.pool, s.templates)))
+	http.HandleFunc("/v1/completions", handler.TrackCache(handler.HandleCompletions(s.pool, s.defaultMaxTokens)))
+	http.HandleFunc("/infill", handler.TrackCache(handler.HandleInfill(s.pool, s.defaultMaxTokens)))
+	http.HandleFunc("/v1/embeddings", handler.HandleEmbeddings(s.pool))
+	http.HandleFunc("/templates", handler.HandleTemplates(s.templates))
+	http.HandleFunc("/tasks/{name}", handler.TrackCache(handler.HandleTask(s.pool, s.templates)))
+	http.HandleFunc("/jobs", handler.HandleSubmitJob(s.jobs))
+	if s.node != nil {
+		http.HandleFunc("/jobs/{id}", s.node.ForwardJob(handler.HandleJob(s.jobs)))
+		clusterRoutes := s.node.Handler()
+		http.Handle("/cluster", clusterRoutes)
+		http.Handle("/cluster/", clusterRoutes)
+	} else {
+		http.HandleFunc("/jobs/{id}", handler.HandleJob(s.jobs))
+	}
+	if s.federation != nil {
+		http.HandleFunc("/execute", handler.HandlePeerExecute(s.pool, s.federation))
+		http.HandleFunc("/federation/models", handler.HandlePeerModels(s.pool, s.federation))
+		http.HandleFunc("/federation", handler.HandleFederation(s.federation))
+	}
+	http.HandleFunc("/batches", handler.HandleBatches(s.batches))
+	http.HandleFunc("/batches/{id}", handler.HandleBatch(s.batches))
+	http.HandleFunc("/batches/{id}/items", handler.HandleBatchItems(s.batches))
+	http.HandleFunc("/batches/{id}/results", handler.HandleBatchResults(s.batches))
 
-	log.Printf("GoLlama server running on http://localhost:%d", s.port)
+	scheme := "http"
+	if s.tlsCertFile != "" {
+		scheme = "https"
+	}
+	log.Printf("GoLlama server running on %s://localhost:%d", scheme, s.port)
 	log.Println("Forwarding to llama.cpp workers")
 	log.Printf("  POST /chat - Submit a chat message")
 	log.Printf("  POST /summarize - Summarize text")
 	log.Printf("  POST /translate - Translate text to specified language")
 	log.Printf("  POST /sentiment - Analyze sentiment of text")
+	log.Printf("  POST /v1/completions - Raw text completion (fill-in-the-middle with suffix)")
+	log.Printf("  POST /infill - llama.cpp fill-in-the-middle for code completion")
+	log.Printf("  POST /v1/embeddings - Get embeddings from embedding-capable workers")
+	log.Printf("  POST /tasks/{name} - Run a task template (see GET /templates)")
+	log.Printf("  POST /jobs - Run any of the above asynchronously")
+	log.Printf("  GET  /jobs/{id} - Poll an async job (DELETE cancels it)")
+	log.Printf("  POST /batches - Upload a JSONL batch to run at low priority")
+	log.Printf("  GET  /batches/{id} - Batch progress (DELETE cancels it)")
+	log.Printf("  GET  /batches/{id}/results - Download batch results as JSONL")
 	log.Printf("  POST /connectWorker - Register a new worker")
+	log.Printf("  GET  /tunnel - Open a reverse tunnel for workers behind NAT")
+	log.Printf("  POST /tunnel/result - Return a job result over a reverse tunnel")
 	log.Printf("  GET  /health - Check server health")
 	log.Printf("  GET  /stats - View worker statistics")
+	log.Printf("  GET  /templates - List prompt templates")
+	if s.node != nil {
+		log.Printf("  GET  /cluster - Hub replica status")
+	}
+	if s.federation != nil {
+		log.Printf("  GET  /federation - Peer hubs and their credit balances")
+		log.Printf("  POST /execute - Run overflow from a peer hub")
+	}
 	log.Printf("  POST /auth/token - Get JWT token for worker")
 }
 
 // Start begins listening for requests
 func (s *Server) Start() error {
+	if s.tlsCertFile != "" {
+		return http.ListenAndServeTLS(fmt.Sprintf(":%d", s.port), s.tlsCertFile, s.tlsKeyFile, nil)
+	}
 	return http.ListenAndServe(fmt.Sprintf(":%d", s.port), nil)
 }
@@ -0,0 +1,306 @@
+package templates
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"gollama/internal"
+	"gollama/internal/schema"
+)
+
+//go:embed defaults/*.json
+var defaultFiles embed.FS
+
+/*
+Template is a prompt plus the sampling parameters used to run it. Prompt and System are Go
+text/template strings rendered with the data the calling endpoint provides.
+
+A template with an Input schema is also a task that clients can run through /tasks/{name}: the input
+object is validated against the schema and rendered as the template data. An Output schema
+constrains the model to JSON of that shape, which is validated before it's returned.
+*/
+type Template struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	System      string   `json:"system,omitempty"`
+	Prompt      string   `json:"prompt"`
+	Model       string   `json:"model,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	MaxRetries  int      `json:"max_retries,omitempty"`
+
+	Input  json.RawMessage `json:"input,omitempty"`
+	Output json.RawMessage `json:"output,omitempty"`
+
+	system *template.Template
+	prompt *template.Template
+	input  *schema.Schema
+	output *schema.Schema
+}
+
+/*
+Registry holds the prompt templates used by the task endpoints. Built-in defaults are compiled in;
+files in the templates directory override them by name or add new ones.
+*/
+type Registry struct {
+	dir       string
+	mu        sync.RWMutex
+	templates map[string]*Template
+}
+
+// funcs are available inside every template
+var funcs = template.FuncMap{
+	"join": join,
+}
+
+/*
+join works on both []string (handler data) and []interface{} (decoded task input)
+*/
+func join(items interface{}, sep string) (string, error) {
+	switch v := items.(type) {
+	case []string:
+		return strings.Join(v, sep), nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = fmt.Sprint(item)
+		}
+		return strings.Join(parts, sep), nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("join expects a list, got %T", items)
+}
+
+/*
+NewRegistry loads the built-in templates and then any *.json files in dir. An empty dir or a
+directory that doesn't exist just means no overrides.
+*/
+func NewRegistry(dir string) (*Registry, error) {
+	r := &Registry{dir: dir}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+Reload re-reads the templates directory. On error the previously loaded templates stay in effect.
+*/
+func (r *Registry) Reload() error {
+	loaded := make(map[string]*Template)
+
+	defaults, err := defaultFiles.ReadDir("defaults")
+	if err != nil {
+		return fmt.Errorf("failed to read built-in templates: %w", err)
+	}
+	for _, entry := range defaults {
+		data, err := defaultFiles.ReadFile("defaults/" + entry.Name())
+		if err != nil {
+			return fmt.Errorf("failed to read built-in template %s: %w", entry.Name(), err)
+		}
+		err = addTemplates(loaded, data, "built-in "+entry.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	overrides := 0
+	if r.dir != "" {
+		files, err := filepath.Glob(filepath.Join(r.dir, "*.json"))
+		if err != nil {
+			return fmt.Errorf("failed to list templates in %s: %w", r.dir, err)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("failed to read template file: %w", err)
+			}
+			err = addTemplates(loaded, data, file)
+			if err != nil {
+				return err
+			}
+			overrides++
+		}
+	}
+
+	r.mu.Lock()
+	r.templates = loaded
+	r.mu.Unlock()
+
+	log.Printf("Loaded %d templates (%d files from %q)", len(loaded), overrides, r.dir)
+	return nil
+}
+
+/*
+addTemplates parses a file holding one template object or an array of them
+*/
+func addTemplates(into map[string]*Template, data []byte, source string) error {
+	var list []*Template
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(trimmed, &list)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", source, err)
+		}
+	} else {
+		var t Template
+		err := json.Unmarshal(trimmed, &t)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", source, err)
+		}
+		list = append(list, &t)
+	}
+
+	for _, t := range list {
+		err := t.compile()
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		into[t.Name] = t
+	}
+	return nil
+}
+
+/*
+compile validates the template and parses its text
+*/
+func (t *Template) compile() error {
+	if t.Name == "" {
+		return fmt.Errorf("template is missing a name")
+	}
+	if t.Prompt == "" {
+		return fmt.Errorf("template %s is missing a prompt", t.Name)
+	}
+	if t.MaxTokens < 0 || t.MaxRetries < 0 {
+		return fmt.Errorf("template %s: max_tokens and max_retries must not be negative", t.Name)
+	}
+	if t.Temperature != nil && (*t.Temperature < 0 || *t.Temperature > 2) {
+		return fmt.Errorf("template %s: temperature must be between 0 and 2", t.Name)
+	}
+
+	var err error
+	t.prompt, err = template.New(t.Name).Funcs(funcs).Option("missingkey=error").Parse(t.Prompt)
+	if err != nil {
+		return fmt.Errorf("template %s: invalid prompt: %w", t.Name, err)
+	}
+	if len(t.Input) > 0 {
+		t.input, err = schema.Parse(t.Input)
+		if err != nil {
+			return fmt.Errorf("template %s: input: %w", t.Name, err)
+		}
+		if len(t.input.Type) != 1 || t.input.Type[0] != "object" {
+			return fmt.Errorf("template %s: input schema must be of type object", t.Name)
+		}
+	}
+	if len(t.Output) > 0 {
+		t.output, err = schema.Parse(t.Output)
+		if err != nil {
+			return fmt.Errorf("template %s: output: %w", t.Name, err)
+		}
+	}
+	if t.System != "" {
+		t.system, err = template.New(t.Name + ".system").Funcs(funcs).Option("missingkey=error").Parse(t.System)
+		if err != nil {
+			return fmt.Errorf("template %s: invalid system prompt: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+/*
+IsTask reports whether the template can be run through /tasks/{name}
+*/
+func (t *Template) IsTask() bool {
+	return t.input != nil
+}
+
+/*
+InputSchema returns the parsed input schema, or nil for templates that aren't tasks
+*/
+func (t *Template) InputSchema() *schema.Schema {
+	return t.input
+}
+
+/*
+OutputSchema returns the parsed output schema, or nil when the task returns free text
+*/
+func (t *Template) OutputSchema() *schema.Schema {
+	return t.output
+}
+
+/*
+Get looks up a template by name
+*/
+func (r *Registry) Get(name string) (*Template, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.templates[name]
+	return t, ok
+}
+
+/*
+List returns all templates sorted by name
+*/
+func (r *Registry) List() []*Template {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]*Template, 0, len(r.templates))
+	for _, t := range r.templates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+/*
+Build renders the template with data and returns a llama.cpp request carrying the template's
+model and sampling parameters. Callers may adjust the request (e.g. MaxTokens) afterwards.
+*/
+func (t *Template) Build(data interface{}) (internal.LlamaRequest, error) {
+	var req internal.LlamaRequest
+
+	if t.system != nil {
+		var system bytes.Buffer
+		err := t.system.Execute(&system, data)
+		if err != nil {
+			return req, fmt.Errorf("rendering %s system prompt: %w", t.Name, err)
+		}
+		req.Messages = append(req.Messages, internal.Message{Role: "system", Content: system.String()})
+	}
+
+	var prompt bytes.Buffer
+	err := t.prompt.Execute(&prompt, data)
+	if err != nil {
+		return req, fmt.Errorf("rendering %s prompt: %w", t.Name, err)
+	}
+	req.Messages = append(req.Messages, internal.Message{Role: "user", Content: prompt.String()})
+
+	req.Model = t.Model
+	req.MaxTokens = t.MaxTokens
+	req.Temperature = t.Temperature
+	req.TopP = t.TopP
+	req.TopK = t.TopK
+	req.Seed = t.Seed
+	if t.output != nil {
+		req.ResponseFormat = &internal.ResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: &internal.JSONSchema{Name: t.Name, Schema: t.Output},
+		}
+	}
+	return req, nil
+}
@@ -1,27 +1,93 @@
 package internal
 
-import "time"
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
 
 /*
-Message represents a single message in the conversation
+Message represents a single message in the conversation. Assistant messages may carry ToolCalls
+instead of content; "tool" messages answer one of those calls by ToolCallID.
 */
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
 }
 
 /*
-ChatRequest is what users send to GoLlama which is then passed to GoLlama spokes or workers
+Tool is a function the model may call, in the OpenAI format. Parameters is a JSON schema for the
+call's arguments.
+*/
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+/*
+ToolFunction describes a callable function
+*/
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+/*
+ToolCall is a call the model asked the client to make. Arguments is a JSON-encoded object, as in
+the OpenAI API.
+*/
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+/*
+ToolCallFunction names the function being called and its arguments
+*/
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+/*
+ChatRequest is what users send to GoLlama which is then passed to GoLlama spokes or workers.
+Model is optional; when set the request is only routed to workers serving that model.
+Send either a single Message or a Messages conversation. Tools and ToolChoice enable function
+calling ("auto", "none", "required" or {"type": "function", "function": {"name": ...}}).
+ResponseFormat or a GBNF Grammar constrain the reply. Temperature 0 or a Seed makes the reply
+deterministic, so it can be served from the response cache. CachePrompt (on by default) and IDSlot
+are passed to llama.cpp to control KV cache reuse.
 */
 type ChatRequest struct {
-	Message string `json:"message"`
+	Message    string          `json:"message,omitempty"`
+	Messages   []Message       `json:"messages,omitempty"`
+	Model      string          `json:"model,omitempty"`
+	MaxTokens  int             `json:"max_tokens,omitempty"`
+	Tools      []Tool          `json:"tools,omitempty"`
+	ToolChoice json.RawMessage `json:"tool_choice,omitempty"`
+
+	Temperature *float64 `json:"temperature,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	CachePrompt *bool    `json:"cache_prompt,omitempty"`
+	IDSlot      *int     `json:"id_slot,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Grammar        string          `json:"grammar,omitempty"`
 }
 
 /*
-ChatResponse is what GoLlama returns to clients.
+ChatResponse is what GoLlama returns to clients. ToolCalls is set when the model chose to call
+tools; the client runs them and continues the conversation with "tool" messages.
 */
 type ChatResponse struct {
-	Reply string `json:"reply"`
+	Reply        string     `json:"reply"`
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	FinishReason string     `json:"finish_reason,omitempty"`
 }
 
 /*
@@ -29,8 +95,37 @@ LlamaRequest is what we send to llama.cpp
 TODO: We're not handling chat history yet. But the string of messages is the basic idea I think.
 */
 type LlamaRequest struct {
-	Messages  []Message `json:"messages"`
-	MaxTokens int       `json:"max_tokens"`
+	Model          string          `json:"model,omitempty"`
+	Messages       []Message       `json:"messages"`
+	MaxTokens      int             `json:"max_tokens"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	TopP           *float64        `json:"top_p,omitempty"`
+	TopK           *int            `json:"top_k,omitempty"`
+	Seed           *int            `json:"seed,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Grammar        string          `json:"grammar,omitempty"`
+	Tools          []Tool          `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage `json:"tool_choice,omitempty"`
+	CachePrompt    *bool           `json:"cache_prompt,omitempty"`
+	IDSlot         *int            `json:"id_slot,omitempty"`
+}
+
+/*
+ResponseFormat constrains llama.cpp's output. With Type "json_schema", llama.cpp compiles the schema to
+a grammar so the model can only produce JSON matching it. "json_object" asks for any JSON object and
+"text" for unconstrained output.
+*/
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+/*
+JSONSchema is the OpenAI-style wrapper around a JSON schema in a response_format
+*/
+type JSONSchema struct {
+	Name   string          `json:"name,omitempty"`
+	Schema json.RawMessage `json:"schema"`
 }
 
 /*
@@ -73,9 +168,8 @@ TODO: Right now it's just a stub of the response. Here is a full llama.cpp respo
 */
 type LlamaResponse struct {
 	Choices []struct {
-		Message struct {
-			Content string `json:"content"`
-		} `json:"message"`
+		Message      Message `json:"message"`
+		FinishReason string  `json:"finish_reason"`
 	} `json:"choices"`
 	Error string `json:"error,omitempty"`
 }
@@ -84,67 +178,350 @@ type LlamaResponse struct {
 WorkerStats tracks performance metrics for a worker
 */
 type WorkerStats struct {
-	ID            string    `json:"id"`
-	URL           string    `json:"url"`
-	JobsCompleted int       `json:"jobs_completed"`
-	JobsFailed    int       `json:"jobs_failed"`
-	StartTime     time.Time `json:"start_time"`
-	AvgResponseMS float64   `json:"avg_response_ms"`
-	Requests      int       `json:"requests"`
-	LastActive    time.Time `json:"last_active"`
-	Healthy       bool      `json:"healthy"`
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	URL           string      `json:"url"`
+	JobsCompleted int         `json:"jobs_completed"`
+	JobsFailed    int         `json:"jobs_failed"`
+	StartTime     time.Time   `json:"start_time"`
+	AvgResponseMS float64     `json:"avg_response_ms"`
+	Requests      int         `json:"requests"`
+	LastActive    time.Time   `json:"last_active"`
+	Healthy       bool        `json:"healthy"`
+	Models        []ModelInfo `json:"models"`
+	Peer          bool        `json:"peer,omitempty"` // a peer hub taking overflow, not a worker
+
+	Latency map[string]LatencySummary `json:"latency,omitempty"` // by llama.cpp endpoint
+	Breaker BreakerStatus             `json:"breaker"`
+}
+
+/*
+BreakerStatus is the state of a worker's circuit breaker: "closed" (taking traffic), "open" (kept out
+of rotation until RetryAt) or "half-open" (taking one trial request at a time)
+*/
+type BreakerStatus struct {
+	State     string     `json:"state"`
+	ErrorRate float64    `json:"error_rate"`
+	Trips     int        `json:"trips"`
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+}
+
+/*
+LatencySummary describes a worker's recent call latencies on one endpoint, in milliseconds
+*/
+type LatencySummary struct {
+	P50     float64 `json:"p50_ms"`
+	P95     float64 `json:"p95_ms"`
+	Samples int     `json:"samples"`
 }
 
 /*
-WorkerJob represents a request to be processed by a worker
+ModelInfo is a model a worker can serve, with the number of local llama.cpp backends (slots) serving it
+and the context size they were loaded with. Embeddings is set when at least one of those backends was
+started with embeddings enabled.
+*/
+type ModelInfo struct {
+	Name        string `json:"name"`
+	Slots       int    `json:"slots"`
+	ContextSize int    `json:"context_size,omitempty"`
+	Embeddings  bool   `json:"embeddings,omitempty"`
+}
+
+// WorkerModelsHeader carries a tunneled worker's JSON-encoded []ModelInfo when it opens its tunnel
+const WorkerModelsHeader = "X-Gollama-Models"
+
+// WorkerIDHeader carries the ID a tunneled worker was configured with, which must match its token
+const WorkerIDHeader = "X-Gollama-Worker"
+
+/*
+WorkerJob represents a request to be processed by a worker.
+  - Endpoint: llama.cpp route to call; chat completions when empty
+  - Body: sent verbatim instead of Request, and the worker's raw JSON response is the reply.
+    Request.Model is still what picks the worker.
+  - Capability: only route to workers advertising it (e.g. "embeddings")
+  - Validate: checks a successful reply; a reply that fails is retried on another worker
+  - Ctx: cancels the job; a cancelled job is dropped from the queue or its worker call aborted
+  - Prefixes: hashes of the prompt's leading parts (pool.MessageKeys), routing it to a worker that
+    may still have them in its KV cache
 */
 type WorkerJob struct {
+	Ctx        context.Context
 	Request    LlamaRequest
+	Endpoint   string
+	Body       json.RawMessage
+	Capability string
+	Prefixes   []string
+	Validate   func(reply string) error
 	ReplyCh    chan string
 	WorkerURL  string
 	RetryCount int
 	MaxRetries int
+	Failed     map[string]bool // workers this job already failed on, avoided when retrying
+	LocalOnly  bool            // never sent to a peer hub (set on jobs a peer hub sent us)
 }
 
 /*
 SummarizeRequest is what users send to the /summarize endpoint
+  - TargetWords: approximate length of the final summary (optional)
+  - Style: "prose" (default) or "bullets"
+  - ReturnChunks: also return the summary of each chunk for long documents
 */
 type SummarizeRequest struct {
-	Text string `json:"text"`
+	Text         string `json:"text"`
+	Model        string `json:"model,omitempty"`
+	TargetWords  int    `json:"target_words,omitempty"`
+	Style        string `json:"style,omitempty"`
+	ReturnChunks bool   `json:"return_chunks,omitempty"`
 }
 
 /*
-SummarizeResponse is what /summarize returns to clients
+SummarizeResponse is what /summarize returns to clients. ChunkSummaries is only filled in when the
+document was split and the client asked for them.
 */
 type SummarizeResponse struct {
-	Summary string `json:"summary"`
+	Summary        string   `json:"summary"`
+	Chunks         int      `json:"chunks"`
+	ChunkSummaries []string `json:"chunk_summaries,omitempty"`
 }
 
 /*
 TranslateRequest is what users send to the /translate endpoint
+  - Language: target language as an ISO 639-1 code (English names are still accepted)
+  - SourceLanguage: optional; detected by the model and returned when omitted
+  - Glossary: terms that must be translated a specific way
+  - DoNotTranslate: terms (product names etc.) that must be kept as-is
+  - Format: "text" (default), "markdown" or "html"; markup is preserved
 */
 type TranslateRequest struct {
-	Text     string `json:"text"`
-	Language string `json:"language"`
+	Text           string            `json:"text,omitempty"`
+	Texts          []string          `json:"texts,omitempty"`
+	Language       string            `json:"language"`
+	SourceLanguage string            `json:"source_language,omitempty"`
+	Glossary       map[string]string `json:"glossary,omitempty"`
+	DoNotTranslate []string          `json:"do_not_translate,omitempty"`
+	Format         string            `json:"format,omitempty"`
+	Model          string            `json:"model,omitempty"`
 }
 
 /*
-TranslateResponse is what /translate returns to clients
+TranslateResponse is what /translate returns to clients. Single-text requests fill in Translation and
+SourceLanguage; batch requests fill in Translations in the same order as Texts.
 */
 type TranslateResponse struct {
-	Translation string `json:"translation"`
+	Translation    string              `json:"translation,omitempty"`
+	SourceLanguage string              `json:"source_language,omitempty"`
+	TargetLanguage string              `json:"target_language"`
+	Translations   []TranslationResult `json:"translations,omitempty"`
 }
 
 /*
-SentimentRequest is what users send to the /sentiment endpoint
+TranslationResult is one entry of a batch translation
+*/
+type TranslationResult struct {
+	Translation    string `json:"translation"`
+	SourceLanguage string `json:"source_language"`
+	Error          string `json:"error,omitempty"`
+}
+
+/*
+SentimentRequest is what users send to the /sentiment endpoint. Send either a single Text or a batch
+of Texts; Aspects optionally asks for a separate sentiment per named aspect (e.g. "price", "service").
 */
 type SentimentRequest struct {
-	Text string `json:"text"`
+	Text    string   `json:"text,omitempty"`
+	Texts   []string `json:"texts,omitempty"`
+	Aspects []string `json:"aspects,omitempty"`
+	Model   string   `json:"model,omitempty"`
 }
 
 /*
-SentimentResponse is what /sentiment returns to clients
+SentimentResponse is what /sentiment returns to clients. A single-text request fills in Sentiment
+(the label, as before) and Result; a batch request fills in Results in the same order as Texts.
 */
 type SentimentResponse struct {
-	Sentiment string `json:"sentiment"`
+	Sentiment string            `json:"sentiment,omitempty"`
+	Result    *SentimentResult  `json:"result,omitempty"`
+	Results   []SentimentResult `json:"results,omitempty"`
+}
+
+/*
+SentimentResult is the validated, model-produced sentiment of one text
+*/
+type SentimentResult struct {
+	Label      string            `json:"label"`
+	Confidence float64           `json:"confidence"`
+	Rationale  string            `json:"rationale"`
+	Aspects    []AspectSentiment `json:"aspects,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+/*
+AspectSentiment is the sentiment expressed toward one named aspect of a text
+*/
+type AspectSentiment struct {
+	Aspect     string  `json:"aspect"`
+	Label      string  `json:"label"`
+	Confidence float64 `json:"confidence"`
+	Rationale  string  `json:"rationale"`
+}
+
+/*
+CompletionRequest is what users send to /v1/completions, in the OpenAI format. A Suffix turns the
+request into fill-in-the-middle: it's run on llama.cpp's /infill with Prompt as the prefix.
+*/
+type CompletionRequest struct {
+	Model       string   `json:"model,omitempty"`
+	Prompt      string   `json:"prompt"`
+	Suffix      string   `json:"suffix,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	Stop        StopList `json:"stop,omitempty"`
+	NProbs      int      `json:"n_probs,omitempty"`
+	Stream      bool     `json:"stream,omitempty"`
+	CachePrompt *bool    `json:"cache_prompt,omitempty"`
+	IDSlot      *int     `json:"id_slot,omitempty"`
+}
+
+/*
+InfillRequest is what users send to /infill, in llama.cpp's native format. InputExtra carries other
+files from the project as context for the completion.
+*/
+type InfillRequest struct {
+	Model       string        `json:"model,omitempty"`
+	InputPrefix string        `json:"input_prefix"`
+	InputSuffix string        `json:"input_suffix"`
+	InputExtra  []InfillChunk `json:"input_extra,omitempty"`
+	Prompt      string        `json:"prompt,omitempty"`
+	NPredict    int           `json:"n_predict,omitempty"`
+	Temperature *float64      `json:"temperature,omitempty"`
+	TopP        *float64      `json:"top_p,omitempty"`
+	TopK        *int          `json:"top_k,omitempty"`
+	Seed        *int          `json:"seed,omitempty"`
+	Stop        StopList      `json:"stop,omitempty"`
+	NProbs      int           `json:"n_probs,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+	CachePrompt *bool         `json:"cache_prompt,omitempty"`
+	IDSlot      *int          `json:"id_slot,omitempty"`
+}
+
+/*
+InfillChunk is one extra file of context for an infill request
+*/
+type InfillChunk struct {
+	Filename string `json:"filename,omitempty"`
+	Text     string `json:"text"`
+}
+
+/*
+StopList holds stop sequences. Clients may send a single string or an array of strings.
+*/
+type StopList []string
+
+func (s *StopList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = StopList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+/*
+EmbeddingRequest is what users send to /v1/embeddings, in the OpenAI format. Input is a single string
+or an array of strings.
+*/
+type EmbeddingRequest struct {
+	Input json.RawMessage `json:"input"`
+	Model string          `json:"model,omitempty"`
+}
+
+/*
+EmbeddingResponse is the OpenAI-format list of embeddings /v1/embeddings returns, in input order
+*/
+type EmbeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []EmbeddingData `json:"data"`
+	Model  string          `json:"model,omitempty"`
+	Usage  EmbeddingUsage  `json:"usage"`
+}
+
+/*
+EmbeddingData is one input's embedding. The vector is passed through from llama.cpp untouched.
+*/
+type EmbeddingData struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+/*
+EmbeddingUsage counts the tokens embedded across all batches
+*/
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+/*
+TaskRequest is what users send to /tasks/{name}. Input must match the task's input schema.
+ResponseFormat or Grammar replace the task's own output schema for this request.
+*/
+type TaskRequest struct {
+	Input json.RawMessage `json:"input"`
+	Model string          `json:"model,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Grammar        string          `json:"grammar,omitempty"`
+}
+
+/*
+TaskResponse is what /tasks/{name} returns. Tasks with an output schema return validated JSON in
+Output; the rest return the model's reply as Text.
+*/
+type TaskResponse struct {
+	Task   string          `json:"task"`
+	Output json.RawMessage `json:"output,omitempty"`
+	Text   string          `json:"text,omitempty"`
+}
+
+/*
+JobRequest is what users send to POST /jobs: the hub endpoint to run and the body they would have
+sent it. CallbackURL optionally receives a signed webhook when the job finishes.
+*/
+type JobRequest struct {
+	Endpoint    string          `json:"endpoint"`
+	Body        json.RawMessage `json:"body"`
+	CallbackURL string          `json:"callback_url,omitempty"`
+}
+
+/*
+TunnelMessage is what the hub pushes down a reverse tunnel to a worker. Type is "execute" for a job,
+"cancel" to stop the job with ID once the hub no longer wants its answer, or "ping" to keep idle
+connections from being dropped by NAT gateways. Affinity lets the worker keep a conversation on the
+same local backend.
+*/
+type TunnelMessage struct {
+	Type     string          `json:"type"`
+	ID       string          `json:"id,omitempty"`
+	Endpoint string          `json:"endpoint,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Affinity string          `json:"affinity,omitempty"`
+}
+
+/*
+TunnelResult is what a reverse-connected worker posts back to the hub after running a job
+*/
+type TunnelResult struct {
+	ID         string          `json:"id"`
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Error      string          `json:"error,omitempty"`
 }
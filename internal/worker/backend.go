@@ -0,0 +1,223 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gollama/internal"
+)
+
+/*
+Backend is a single local llama.cpp instance supervised by the worker. A worker can front several
+backends, e.g. different models or one model split across GPUs in separate processes.
+*/
+type Backend struct {
+	Port        int
+	model       string
+	contextSize int
+	embeddings  bool
+	process     *Process     // set when the worker launches llama-server itself
+	inflight    atomic.Int64 // requests currently running on this backend
+	mu          sync.RWMutex
+}
+
+/*
+NewBackend creates a backend for a llama.cpp instance on the given port. An empty model name is
+discovered from llama.cpp when the worker connects to the hub.
+*/
+func NewBackend(port int, model string) *Backend {
+	return &Backend{Port: port, model: model}
+}
+
+/*
+URL returns the base URL of the backend's llama.cpp server
+*/
+func (b *Backend) URL() string {
+	return fmt.Sprintf("http://localhost:%d", b.Port)
+}
+
+/*
+Model returns the name of the model this backend serves
+*/
+func (b *Backend) Model() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.model
+}
+
+/*
+Busy reports whether the backend is currently running a request
+*/
+func (b *Backend) Busy() bool {
+	return b.inflight.Load() > 0
+}
+
+/*
+Healthy pings the backend's llama.cpp /health endpoint
+*/
+func (b *Backend) Healthy() bool {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(b.URL() + "/health")
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+/*
+ContextSize returns the context window reported by llama.cpp, or 0 if unknown
+*/
+func (b *Backend) ContextSize() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.contextSize
+}
+
+/*
+SupportsEmbeddings reports whether the backend answered the embeddings probe, i.e. llama-server was
+started with --embeddings
+*/
+func (b *Backend) SupportsEmbeddings() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.embeddings
+}
+
+/*
+discover asks llama.cpp which model it has loaded and its context size. A configured model name is
+kept as the route key; otherwise the model file name (without extension) is used.
+*/
+func (b *Backend) discover() error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(b.URL() + "/props")
+	if err != nil {
+		return fmt.Errorf("backend on port %d unreachable: %w", b.Port, err)
+	}
+	defer resp.Body.Close()
+
+	var props struct {
+		ModelPath                 string `json:"model_path"`
+		DefaultGenerationSettings struct {
+			NCtx int `json:"n_ctx"`
+		} `json:"default_generation_settings"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&props)
+	if err != nil {
+		return fmt.Errorf("backend on port %d returned invalid props: %w", b.Port, err)
+	}
+
+	embeddings := b.probeEmbeddings(client)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.contextSize = props.DefaultGenerationSettings.NCtx
+	b.embeddings = embeddings
+	if b.model == "" {
+		if props.ModelPath == "" {
+			return fmt.Errorf("backend on port %d did not report a model", b.Port)
+		}
+		b.model = strings.TrimSuffix(filepath.Base(props.ModelPath), filepath.Ext(props.ModelPath))
+	}
+	return nil
+}
+
+/*
+probeEmbeddings embeds a one-word input. llama.cpp doesn't report in /props whether embeddings are
+enabled, and rejects embedding requests with 501 when they aren't.
+*/
+func (b *Backend) probeEmbeddings(client *http.Client) bool {
+	resp, err := client.Post(b.URL()+"/v1/embeddings", "application/json", strings.NewReader(`{"input":"ping"}`))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+/*
+selectBackend picks the least-loaded backend serving the requested model. An empty model matches any
+backend. Embedding endpoints only go to backends with embeddings enabled. Returns nil if no backend
+qualifies.
+
+With an affinity key from the hub, requests for the same conversation go to the same backend
+(rendezvous hashing) so llama.cpp can reuse its KV cache, unless that backend is busier than the
+least-loaded one by more than one request.
+*/
+func (c *Client) selectBackend(model string, endpoint string, affinity string) *Backend {
+	var best, preferred *Backend
+	var preferredScore uint64
+	for _, b := range c.backends {
+		if model != "" && b.Model() != model {
+			continue
+		}
+		if embeddingEndpoints[endpoint] && !b.SupportsEmbeddings() {
+			continue
+		}
+		if best == nil || b.inflight.Load() < best.inflight.Load() {
+			best = b
+		}
+		if affinity != "" {
+			h := fnv.New64a()
+			fmt.Fprintf(h, "%s#%d", affinity, b.Port)
+			if score := h.Sum64(); preferred == nil || score > preferredScore {
+				preferred, preferredScore = b, score
+			}
+		}
+	}
+	if preferred != nil && preferred.inflight.Load() <= best.inflight.Load()+1 {
+		return preferred
+	}
+	return best
+}
+
+/*
+advertisedModels groups the worker's backends by model for registration with the hub. Each backend
+serving a model counts as one slot the hub can route to.
+*/
+func (c *Client) advertisedModels() []internal.ModelInfo {
+	byModel := make(map[string]*internal.ModelInfo)
+	order := make([]string, 0)
+	for _, b := range c.backends {
+		model := b.Model()
+		info, seen := byModel[model]
+		if !seen {
+			info = &internal.ModelInfo{Name: model}
+			byModel[model] = info
+			order = append(order, model)
+		}
+		info.Slots++
+		if b.SupportsEmbeddings() {
+			info.Embeddings = true
+		}
+
+		// Report the smallest window so the hub never sends more than every slot can hold
+		if ctx := b.ContextSize(); ctx > 0 && (info.ContextSize == 0 || ctx < info.ContextSize) {
+			info.ContextSize = ctx
+		}
+	}
+
+	models := make([]internal.ModelInfo, 0, len(order))
+	for _, model := range order {
+		models = append(models, *byModel[model])
+	}
+	return models
+}
+
+/*
+requestModel extracts the "model" field from a request body so it can be routed to the right backend
+*/
+func requestModel(body json.RawMessage) string {
+	var req struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(body, &req)
+	return req.Model
+}
@@ -0,0 +1,137 @@
+package worker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+/*
+DefaultAllowedEndpoints are the llama.cpp inference routes the hub may call through /execute.
+Admin routes such as slot save/restore, LoRA adapters and metrics are deliberately left out.
+*/
+var DefaultAllowedEndpoints = []string{
+	"/v1/chat/completions",
+	"/v1/completions",
+	"/completion",
+	"/v1/embeddings",
+	"/embedding",
+	"/embeddings",
+	"/infill",
+	"/tokenize",
+	"/detokenize",
+}
+
+// tokenLimitFields are the request fields llama.cpp uses to bound generation length
+var tokenLimitFields = []string{"max_tokens", "n_predict"}
+
+// generationEndpoints produce tokens, so they get a max_tokens cap even when the request omits one
+var generationEndpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/completion":          true,
+	"/infill":              true,
+}
+
+// embeddingEndpoints need a backend started with --embeddings
+var embeddingEndpoints = map[string]bool{
+	"/v1/embeddings": true,
+	"/embedding":     true,
+	"/embeddings":    true,
+}
+
+/*
+authorizeHub checks that an /execute request carries the JWT the hub issued to this worker. Only the
+hub and this worker know the token, so a spoofed hub can't drive the local llama.cpp.
+*/
+func (c *Client) authorizeHub(request *http.Request) bool {
+	c.mu.Lock()
+	expected := c.cachedToken
+	c.mu.Unlock()
+
+	if expected == "" {
+		return false // not registered yet, so nobody is entitled to send us work
+	}
+
+	parts := strings.Split(request.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(parts[1]), []byte(expected)) == 1
+}
+
+/*
+validateExecute enforces the endpoint allowlist, request size limit and generation cap on a command
+before it reaches llama.cpp. It returns the (possibly rewritten) body to forward.
+*/
+func (c *Client) validateExecute(endpoint string, body json.RawMessage) (json.RawMessage, error) {
+	if !c.endpointAllowed(endpoint) {
+		return nil, fmt.Errorf("endpoint %s is not allowed", endpoint)
+	}
+
+	if c.cfg.MaxRequestBytes > 0 && int64(len(body)) > c.cfg.MaxRequestBytes {
+		return nil, fmt.Errorf("request body of %d bytes exceeds limit of %d", len(body), c.cfg.MaxRequestBytes)
+	}
+
+	if c.cfg.MaxTokens <= 0 {
+		return body, nil
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("request body must be a JSON object")
+	}
+
+	// Clamp rather than reject so hubs with a larger default still get an answer. llama.cpp treats
+	// a missing or negative limit as unbounded, so those are capped too.
+	clamped := false
+	limited := false
+	for _, field := range tokenLimitFields {
+		raw, exists := fields[field]
+		if !exists {
+			continue
+		}
+		limited = true
+		var value int
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("%s must be an integer", field)
+		}
+		if value <= 0 || value > c.cfg.MaxTokens {
+			fields[field] = json.RawMessage(fmt.Sprintf("%d", c.cfg.MaxTokens))
+			clamped = true
+		}
+	}
+
+	if !limited && generationEndpoints[endpoint] {
+		fields["max_tokens"] = json.RawMessage(fmt.Sprintf("%d", c.cfg.MaxTokens))
+		clamped = true
+	}
+
+	if !clamped {
+		return body, nil
+	}
+
+	log.Printf("Clamped generation length to %d tokens", c.cfg.MaxTokens)
+	return json.Marshal(fields)
+}
+
+/*
+endpointAllowed checks the endpoint against the configured allowlist (exact match only, so query
+strings and path tricks are rejected too)
+*/
+func (c *Client) endpointAllowed(endpoint string) bool {
+	allowed := c.cfg.AllowedEndpoints
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedEndpoints
+	}
+	for _, e := range allowed {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Restart and startup bounds for supervised llama-server processes
+const (
+	healthPollInterval    = 500 * time.Millisecond
+	startupTimeout        = 5 * time.Minute // large models can take a while to load
+	initialRestartBackoff = 1 * time.Second
+	maxRestartBackoff     = 30 * time.Second
+	stableRunDuration     = 1 * time.Minute // a run this long resets the restart backoff
+)
+
+/*
+Process supervises a llama-server binary launched by the worker. It starts the server, waits for its
+/health endpoint, and restarts it with backoff whenever it exits unexpectedly.
+*/
+type Process struct {
+	binary    string
+	modelPath string
+	args      []string
+	port      int
+	ready     chan struct{}
+}
+
+/*
+NewProcess creates a supervisor for llama-server serving modelPath on the given port
+*/
+func NewProcess(binary string, modelPath string, args []string, port int) *Process {
+	return &Process{
+		binary:    binary,
+		modelPath: modelPath,
+		args:      args,
+		port:      port,
+		ready:     make(chan struct{}),
+	}
+}
+
+/*
+Ready is closed the first time llama-server reports healthy
+*/
+func (p *Process) Ready() <-chan struct{} {
+	return p.ready
+}
+
+/*
+Run keeps llama-server running until the context is cancelled. It blocks, so call it in a goroutine.
+restarted is called each time llama-server is healthy again after the first start.
+*/
+func (p *Process) Run(ctx context.Context, restarted func()) {
+	backoff := initialRestartBackoff
+	var readyOnce sync.Once
+
+	for {
+		started := time.Now()
+		err := p.runOnce(ctx, func() {
+			select {
+			case <-p.ready:
+				restarted()
+			default:
+				readyOnce.Do(func() { close(p.ready) })
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > stableRunDuration {
+			backoff = initialRestartBackoff
+		}
+		log.Printf("llama-server on port %d exited: %v - restarting in %v", p.port, err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+/*
+runOnce starts llama-server, waits for it to become healthy, and returns when the process exits
+*/
+func (p *Process) runOnce(ctx context.Context, onReady func()) error {
+	args := append([]string{"-m", p.modelPath, "--port", strconv.Itoa(p.port)}, p.args...)
+	cmd := exec.CommandContext(ctx, p.binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Give llama-server a chance to free GPU memory cleanly before it is killed
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 10 * time.Second
+
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", p.binary, err)
+	}
+	log.Printf("Started llama-server (pid %d) on port %d with model %s", cmd.Process.Pid, p.port, p.modelPath)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	err = p.waitHealthy(ctx, exited)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		<-exited
+		return err
+	}
+	log.Printf("llama-server on port %d is healthy", p.port)
+	onReady()
+
+	return <-exited
+}
+
+/*
+waitHealthy polls llama-server's /health until it answers OK, the process dies, or startup times out
+*/
+func (p *Process) waitHealthy(ctx context.Context, exited chan error) error {
+	client := &http.Client{Timeout: 2 * time.Second}
+	deadline := time.After(startupTimeout)
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			exited <- err // leave it for runOnce to collect
+			return fmt.Errorf("exited during startup: %v", err)
+		case <-deadline:
+			return fmt.Errorf("not healthy after %v", startupTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			resp, err := client.Get(fmt.Sprintf("http://localhost:%d/health", p.port))
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+	}
+}
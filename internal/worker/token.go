@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"log"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"gollama/internal/auth"
+)
+
+// tokenRefreshMargin is how long before its JWT expires the worker fetches a new one
+const tokenRefreshMargin = 10 * time.Minute
+
+/*
+token returns the JWT the worker currently presents to the server
+*/
+func (c *Client) token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cachedToken
+}
+
+/*
+freshToken returns the worker's JWT, renewing it first if it expires within tokenRefreshMargin
+*/
+func (c *Client) freshToken() string {
+	token := c.token()
+	if !expiresWithin(token, tokenRefreshMargin) {
+		return token
+	}
+	renewed, err := c.refreshToken(token)
+	if err != nil {
+		log.Printf("Token renewal failed: %v", err)
+		return token
+	}
+	return renewed
+}
+
+/*
+refreshToken replaces stale with a new JWT, the same way the worker got its first one: from the
+server with the credentials it connected with, or by re-reading the token file. If another caller
+has already replaced stale, its token is returned without asking again.
+*/
+func (c *Client) refreshToken(stale string) (string, error) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	c.mu.Lock()
+	current, username, password := c.cachedToken, c.username, c.password
+	c.mu.Unlock()
+	if current != stale {
+		return current, nil
+	}
+
+	var token string
+	var err error
+	if c.cfg.TokenFile != "" {
+		token, err = c.cfg.ReadToken()
+	} else {
+		token, err = c.requestToken(c.cfg.WorkerID(), c.advertiseURL(), username, password)
+	}
+	if err != nil {
+		return "", err
+	}
+	if token == stale {
+		return token, nil // the token file hasn't been replaced yet
+	}
+
+	c.mu.Lock()
+	c.cachedToken = token
+	c.mu.Unlock()
+	log.Printf("Worker token renewed")
+	return token, nil
+}
+
+/*
+expiresWithin reports whether token's exp claim falls within d from now. The signature isn't
+checked: only the server can do that, and the worker just needs to know when to renew.
+*/
+func expiresWithin(token string, d time.Duration) bool {
+	claims := &jwt.RegisteredClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil || claims.ExpiresAt == nil {
+		return false
+	}
+	return time.Until(claims.ExpiresAt.Time) < d
+}
+
+/*
+tokenWorkerID returns the worker_id claim of token, which is the ID the hub knows the worker by.
+Like expiresWithin, it doesn't check the signature.
+*/
+func tokenWorkerID(token string) string {
+	claims := &auth.Claims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		return ""
+	}
+	return claims.WorkerID
+}
@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gollama/internal"
+)
+
+// tunnelReconnectDelay is how long the worker waits before re-dialing a dropped tunnel
+const tunnelReconnectDelay = 5 * time.Second
+
+// errUnauthorized means the server turned the worker's token down, most likely because it expired
+var errUnauthorized = errors.New("server rejected the worker token")
+
+/*
+startTunnel dials out to the GoLlama server and keeps a reverse tunnel open, reconnecting whenever
+the stream drops. The token is renewed before it expires and whenever the server rejects it.
+Calling it again replaces the running tunnel (e.g. after a fresh token is issued).
+*/
+func (c *Client) startTunnel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tunnelCancel != nil {
+		c.tunnelCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.tunnelCancel = cancel
+
+	go func() {
+		for {
+			token := c.freshToken()
+			err := c.runTunnel(ctx, token)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, errUnauthorized) {
+				_, renewErr := c.refreshToken(token)
+				if renewErr != nil {
+					log.Printf("Token renewal failed: %v", renewErr)
+				}
+			}
+			log.Printf("Tunnel to server dropped: %v - reconnecting in %v", err, tunnelReconnectDelay)
+
+			select {
+			case <-time.After(tunnelReconnectDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+/*
+runTunnel holds a single tunnel connection open, executing each job the server pushes down it
+*/
+func (c *Client) runTunnel(ctx context.Context, token string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/tunnel", c.cfg.ServerURL), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set(internal.WorkerIDHeader, c.cfg.WorkerID())
+
+	// Tunnel workers have no registration call, so their models ride along on the tunnel request
+	models, err := json.Marshal(c.advertisedModels())
+	if err != nil {
+		return err
+	}
+	req.Header.Set(internal.WorkerModelsHeader, string(models))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("server refused the tunnel: token was issued to %q, not %q", tokenWorkerID(token), c.cfg.WorkerID())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	log.Printf("Tunnel to server established")
+
+	// Job IDs are only unique within one tunnel, so each connection tracks its own jobs. The hub
+	// fails a dropped tunnel's jobs, so they're cancelled along with it.
+	var jobsMu sync.Mutex
+	jobs := make(map[string]context.CancelFunc)
+	defer func() {
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		for _, cancel := range jobs {
+			cancel()
+		}
+	}()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // job bodies can carry long prompts
+	for scanner.Scan() {
+		var msg internal.TunnelMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("Ignoring malformed tunnel message: %v", err)
+			continue
+		}
+
+		switch msg.Type {
+		case "execute":
+			jobCtx, cancel := context.WithCancel(ctx)
+			jobsMu.Lock()
+			jobs[msg.ID] = cancel
+			jobsMu.Unlock()
+			go func() {
+				defer func() {
+					jobsMu.Lock()
+					delete(jobs, msg.ID)
+					jobsMu.Unlock()
+					cancel()
+				}()
+				c.handleTunnelJob(jobCtx, msg)
+			}()
+		case "cancel":
+			jobsMu.Lock()
+			cancel, ok := jobs[msg.ID]
+			jobsMu.Unlock()
+			if ok {
+				log.Printf("Server cancelled tunnel job %s", msg.ID)
+				cancel()
+			}
+		}
+		// pings just keep the connection alive
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by server")
+}
+
+/*
+handleTunnelJob runs a pushed job against llama.cpp and posts the result back to the server. A job
+the server cancels stops llama.cpp's generation and sends nothing back. The tunnel may have outlived
+the token it was opened with, so a rejected result is sent again once with a renewed token.
+*/
+func (c *Client) handleTunnelJob(ctx context.Context, msg internal.TunnelMessage) {
+	result := internal.TunnelResult{ID: msg.ID}
+
+	statusCode, body, err := c.executeLocal(ctx, msg.Endpoint, msg.Body, msg.Affinity)
+	if ctx.Err() != nil {
+		return
+	}
+	result.StatusCode = statusCode
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Body = body
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to encode tunnel result: %v", err)
+		return
+	}
+
+	token := c.freshToken()
+	status, err := c.postTunnelResult(payload, token)
+	if err == nil && status == http.StatusUnauthorized {
+		token, err = c.refreshToken(token)
+		if err == nil {
+			status, err = c.postTunnelResult(payload, token)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to return tunnel result: %v", err)
+		return
+	}
+	if status != http.StatusNoContent {
+		log.Printf("Server rejected tunnel result: %d", status)
+	}
+}
+
+/*
+postTunnelResult sends an encoded TunnelResult to the server and returns its status
+*/
+func (c *Client) postTunnelResult(payload []byte, token string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/tunnel/result", c.cfg.ServerURL), bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
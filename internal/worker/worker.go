@@ -2,31 +2,47 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-)
+	"sync"
+	"time"
 
-var clientPort int
-var llamaPort int
-var busyFlag bool
-var cachedToken string // Store the JWT token for reuse
-var serverURL string   // Base URL for the GoLlama server
+	"gollama/internal/config"
+)
 
 /*
-Client manages the HTTP worker that connects to llama.cpp
+Client manages the HTTP worker that connects to one or more local llama.cpp backends
 */
 type Client struct {
-	port int
+	port     int
+	cfg      *config.WorkerConfig
+	backends []*Backend
+	mux      *http.ServeMux
+
+	mu           sync.Mutex
+	cachedToken  string // Store the JWT token for reuse
+	username     string // credentials the worker connected with, to renew its token
+	password     string
+	tunnelCancel context.CancelFunc // Stops the running tunnel loop, if any
+	refreshMu    sync.Mutex         // one token renewal at a time
+
+	ctx    context.Context // cancelled on Shutdown to stop supervised llama-server processes
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 // New initializes the worker object
 func New(port int) *Client {
-	clientPort = port // Store in package variable
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Client{
-		port: port,
+		port:   port,
+		mux:    http.NewServeMux(),
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
@@ -34,164 +50,362 @@ func New(port int) *Client {
 Start to run the worker.
 */
 func (c *Client) Start() error {
-	return http.ListenAndServe(fmt.Sprintf(":%d", c.port), nil)
+	return http.ListenAndServe(fmt.Sprintf(":%d", c.port), c.mux)
+}
+
+/*
+StartBackends launches any llama-server processes the worker manages and waits until each has
+loaded its model, failing if one isn't healthy within startupTimeout. Backends started by hand are
+left alone.
+*/
+func (c *Client) StartBackends() error {
+	for _, b := range c.backends {
+		if b.process == nil {
+			continue
+		}
+		c.wg.Add(1)
+		go func(b *Backend) {
+			defer c.wg.Done()
+			b.process.Run(c.ctx, func() { c.backendRestarted(b) })
+		}(b)
+	}
+
+	deadline := time.After(startupTimeout)
+	for _, b := range c.backends {
+		if b.process == nil {
+			continue
+		}
+		select {
+		case <-b.process.Ready():
+		case <-deadline:
+			return fmt.Errorf("llama-server on port %d not healthy after %v", b.Port, startupTimeout)
+		case <-c.ctx.Done():
+			return nil
+		}
+	}
+	return nil
 }
 
-func (c *Client) Setup(llamaPortArg int, serverURLArg string) {
-	llamaPort = llamaPortArg   // Store in package variable
-	serverURL = serverURLArg   // Store in package variable
+/*
+backendRestarted discovers a backend's model again once its llama-server is back up, and sends the
+hub the worker's models in case they changed. Until the worker has connected there's no hub to tell.
+*/
+func (c *Client) backendRestarted(b *Backend) {
+	err := b.discover()
+	if err != nil {
+		log.Printf("Model discovery failed: %v", err)
+	}
+
+	c.mu.Lock()
+	connected := c.cachedToken != ""
+	c.mu.Unlock()
+	if !connected {
+		return
+	}
+
+	// A tunnel worker's models ride along on the tunnel request, so reopening it re-registers them
+	if c.cfg.Reverse {
+		c.startTunnel()
+		return
+	}
+
+	token := c.freshToken()
+	status, body, err := c.register(token)
+	if err == nil && status == http.StatusUnauthorized {
+		token, err = c.refreshToken(token)
+		if err == nil {
+			status, body, err = c.register(token)
+		}
+	}
+	switch {
+	case err != nil:
+		log.Printf("Re-registering after llama-server restart failed: %v", err)
+	case status != http.StatusOK:
+		log.Printf("Re-registration rejected: %d - %s", status, string(body))
+	default:
+		log.Printf("Re-registered models with the server after llama-server on port %d restarted", b.Port)
+	}
+}
+
+/*
+Shutdown stops the worker's tunnel and any llama-server processes it launched
+*/
+func (c *Client) Shutdown() {
+	c.mu.Lock()
+	if c.tunnelCancel != nil {
+		c.tunnelCancel()
+	}
+	c.mu.Unlock()
+	c.cancel()
+	c.wg.Wait()
+}
+
+func (c *Client) Setup(cfg *config.WorkerConfig) {
+	c.cfg = cfg
+	for _, b := range cfg.BackendList() {
+		backend := NewBackend(b.Port, b.Model)
+		if b.ModelPath != "" {
+			backend.process = NewProcess(cfg.LlamaServer, b.ModelPath, b.Args, b.Port)
+		}
+		c.backends = append(c.backends, backend)
+	}
 
 	// Register handlers
-	http.HandleFunc("/health", handleHealth)
-	http.HandleFunc("/connect", handleConnectToServer)
-	http.HandleFunc("/execute", handleExecute)
+	c.mux.HandleFunc("/health", c.handleHealth)
+	c.mux.HandleFunc("/connect", c.handleConnectToServer)
+	c.mux.HandleFunc("/execute", c.handleExecute)
 
 	log.Printf("GoLlama worker running on http://localhost:%d", c.port)
-	log.Printf("Connecting to llama.cpp on port %d", llamaPort)
-	log.Printf("Connecting to GoLlama server at %s", serverURL)
+	for _, b := range c.backends {
+		log.Printf("Connecting to llama.cpp on port %d", b.Port)
+	}
+	log.Printf("Connecting to GoLlama server at %s", c.cfg.ServerURL)
+	log.Printf("Advertising as %s at %s", c.cfg.WorkerID(), c.advertiseURL())
+	if c.cfg.Reverse {
+		log.Printf("Reverse mode: jobs will arrive over a tunnel to the server")
+	}
 	log.Printf("  GET /health - Check worker health")
 	log.Printf("  GET /connect - Connect to server")
 }
 
-func handleHealth(writer http.ResponseWriter, request *http.Request) {
-	// Ping llama.cpp instance
-	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", llamaPort))
-	if err != nil {
-		http.Error(writer, "llama.cpp unavailable", http.StatusServiceUnavailable)
-		return
+/*
+handleHealth reports the worker healthy if any backend is up, and busy only when every healthy
+backend is already running a request.
+*/
+func (c *Client) handleHealth(writer http.ResponseWriter, request *http.Request) {
+	type backendHealth struct {
+		Port    int    `json:"port"`
+		Model   string `json:"model"`
+		Healthy bool   `json:"healthy"`
+		Busy    bool   `json:"busy"`
+	}
+
+	healthy := false
+	busy := true
+	backends := make([]backendHealth, 0, len(c.backends))
+	for _, b := range c.backends {
+		h := backendHealth{Port: b.Port, Model: b.Model(), Healthy: b.Healthy(), Busy: b.Busy()}
+		if h.Healthy {
+			healthy = true
+			busy = busy && h.Busy
+		}
+		backends = append(backends, h)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		http.Error(writer, "Llama.cpp unhealthy", http.StatusServiceUnavailable)
+	if !healthy {
+		http.Error(writer, "llama.cpp unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
 	log.Printf("  GET /health - OK")
-	fmt.Fprintf(writer, `{"busy":"%v"}`, busyFlag)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"busy":     fmt.Sprintf("%v", busy),
+		"backends": backends,
+	})
 }
 
-func handleConnectToServer(writer http.ResponseWriter, request *http.Request) {
-	// Parse request body for credentials
+func (c *Client) handleConnectToServer(writer http.ResponseWriter, request *http.Request) {
+	// Credentials in the request body override the configured ones. An empty body uses the config.
 	var credentials struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 
 	err := json.NewDecoder(request.Body).Decode(&credentials)
-	if err != nil {
+	if err != nil && err != io.EOF {
 		http.Error(writer, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if credentials.Username == "" && credentials.Password == "" {
+		credentials.Username = c.cfg.Username
+		credentials.Password = c.cfg.Password
+	}
 
 	// Validate credentials are provided
-	if credentials.Username == "" || credentials.Password == "" {
+	if c.cfg.TokenFile == "" && (credentials.Username == "" || credentials.Password == "") {
 		http.Error(writer, "Username and password are required", http.StatusBadRequest)
 		return
 	}
 
 	// Check worker health
-	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", clientPort))
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", c.port))
 	if err != nil || resp.StatusCode != http.StatusOK {
 		http.Error(writer, "Cannot register: worker unhealthy", http.StatusServiceUnavailable)
 		return
 	}
 	defer resp.Body.Close()
 
-	// Step 1: Get JWT token from server
-	workerID := fmt.Sprintf("worker-%d", clientPort)
-	clientURL := fmt.Sprintf("http://localhost:%d", clientPort)
-
-	tokenReq := map[string]string{
-		"worker_id": workerID,
-		"url":       clientURL,
-		"username":  credentials.Username, // Use from request body
-		"password":  credentials.Password, // Use from request body
+	// Step 1: Get JWT token from server (or the pre-issued token file)
+	workerID := c.cfg.WorkerID()
+	clientURL := c.advertiseURL()
+
+	var token string
+	if c.cfg.TokenFile != "" {
+		token, err = c.cfg.ReadToken()
+		if err != nil {
+			log.Printf("Token file unusable: %v", err)
+			http.Error(writer, "Token file unusable", http.StatusInternalServerError)
+			return
+		}
+		// The hub knows a tunneled worker by its token's worker_id, so that has to be this worker
+		if c.cfg.Reverse && tokenWorkerID(token) != workerID {
+			log.Printf("Token file was issued to worker %q, but this worker is %q: set -name to match", tokenWorkerID(token), workerID)
+			http.Error(writer, "Token file was issued to another worker", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		token, err = c.requestToken(workerID, clientURL, credentials.Username, credentials.Password)
+		if err != nil {
+			log.Printf("Token request failed: %v", err)
+			http.Error(writer, "Server rejected token request", http.StatusBadGateway)
+			return
+		}
 	}
 
-	tokenPayload, err := json.Marshal(tokenReq)
-	if err != nil {
-		http.Error(writer, "Token request preparation failed", http.StatusInternalServerError)
-		return
+	// Model names are needed for routing, so discover any that weren't configured
+	for _, b := range c.backends {
+		if err := b.discover(); err != nil {
+			log.Printf("Model discovery failed: %v", err)
+		}
 	}
 
-	tokenResp, err := http.Post(
-		fmt.Sprintf("%s/auth/token", serverURL),
-		"application/json",
-		bytes.NewReader(tokenPayload),
-	)
-	if err != nil {
-		http.Error(writer, "Cannot get token from server", http.StatusBadGateway)
+	// Cache the token for reuse in chat requests, and the credentials to renew it when it expires
+	c.mu.Lock()
+	c.cachedToken = token
+	c.username = credentials.Username
+	c.password = credentials.Password
+	c.mu.Unlock()
+
+	// In reverse mode the worker never receives inbound jobs, so instead of registering a URL
+	// it dials out and holds the tunnel open. The server registers the worker when the tunnel opens.
+	if c.cfg.Reverse {
+		c.startTunnel()
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]string{
+			"status": "tunneling",
+			"url":    clientURL,
+		})
+		log.Printf("Worker %s connected to server over reverse tunnel", workerID)
 		return
 	}
-	defer tokenResp.Body.Close()
 
-	if tokenResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(tokenResp.Body)
-		log.Printf("Token request failed: %d - %s", tokenResp.StatusCode, string(body))
-		http.Error(writer, "Server rejected token request", http.StatusBadGateway)
+	// Step 2: Register with server using JWT token
+	status, body, err := c.register(token)
+	if err != nil {
+		log.Printf("Registration failed: %v", err)
+		http.Error(writer, "Server unreachable", http.StatusBadGateway)
 		return
 	}
-
-	var tokenData struct {
-		Token string `json:"token"`
-	}
-	err = json.NewDecoder(tokenResp.Body).Decode(&tokenData)
-	if err != nil {
-		http.Error(writer, "Invalid token response", http.StatusInternalServerError)
+	if status != http.StatusOK {
+		log.Printf("Registration rejected: %d - %s", status, string(body))
+		http.Error(writer, "Server rejected registration", http.StatusBadGateway)
 		return
 	}
 
-	// Cache the token for reuse in chat requests
-	cachedToken = tokenData.Token
+	// Echo server's response back to caller
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(body)
+	log.Printf("Worker %s registered successfully with token", workerID)
+}
 
-	// Step 2: Register with server using JWT token
-	workerInfo := map[string]string{
-		"url":   clientURL,
-		"model": "test-model", // TODO: Make this based on the llama.cpp actual model
+/*
+register posts the worker's URL and models to the server's /connectWorker with token, returning the
+server's status and reply. Registering again updates the models the hub has for the worker.
+*/
+func (c *Client) register(token string) (int, []byte, error) {
+	workerInfo := map[string]interface{}{
+		"url":    c.advertiseURL(),
+		"name":   c.cfg.WorkerID(),
+		"models": c.advertisedModels(),
 	}
 
 	payload, err := json.Marshal(workerInfo)
 	if err != nil {
-		http.Error(writer, "Registration failed", http.StatusInternalServerError)
-		return
+		return 0, nil, fmt.Errorf("encoding registration: %w", err)
 	}
 
 	// Create request with authorization header
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/connectWorker", serverURL), bytes.NewReader(payload))
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/connectWorker", c.cfg.ServerURL), bytes.NewReader(payload))
 	if err != nil {
-		http.Error(writer, "Request creation failed", http.StatusInternalServerError)
-		return
+		return 0, nil, fmt.Errorf("request creation failed: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tokenData.Token))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
 	client := &http.Client{}
 	serverResp, err := client.Do(req)
 	if err != nil {
-		http.Error(writer, "Server unreachable", http.StatusBadGateway)
-		return
+		return 0, nil, fmt.Errorf("server unreachable: %w", err)
 	}
 	defer serverResp.Body.Close()
 
-	if serverResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(serverResp.Body)
-		log.Printf("Registration rejected: %d - %s", serverResp.StatusCode, string(body))
-		http.Error(writer, "Server rejected registration", http.StatusBadGateway)
-		return
+	body, err := io.ReadAll(serverResp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading server reply: %w", err)
 	}
+	return serverResp.StatusCode, body, nil
+}
 
-	// Echo server's response back to caller
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(http.StatusOK)
-	io.Copy(writer, serverResp.Body)
-	log.Printf("Worker %s registered successfully with token", workerID)
+/*
+advertiseURL returns the URL the hub should use to reach this worker
+*/
+func (c *Client) advertiseURL() string {
+	if c.cfg.Reverse {
+		return fmt.Sprintf("tunnel://%s", c.cfg.WorkerID())
+	}
+	if c.cfg.AdvertiseURL != "" {
+		return c.cfg.AdvertiseURL
+	}
+	return fmt.Sprintf("http://localhost:%d", c.port)
+}
+
+/*
+requestToken exchanges the worker's credentials for a JWT from the GoLlama server
+*/
+func (c *Client) requestToken(workerID, clientURL, username, password string) (string, error) {
+	tokenReq := map[string]string{
+		"worker_id": workerID,
+		"url":       clientURL,
+		"username":  username,
+		"password":  password,
+	}
+
+	tokenPayload, err := json.Marshal(tokenReq)
+	if err != nil {
+		return "", fmt.Errorf("token request preparation failed: %w", err)
+	}
+
+	tokenResp, err := http.Post(
+		fmt.Sprintf("%s/auth/token", c.cfg.ServerURL),
+		"application/json",
+		bytes.NewReader(tokenPayload),
+	)
+	if err != nil {
+		return "", fmt.Errorf("cannot get token from server: %w", err)
+	}
+	defer tokenResp.Body.Close()
+
+	if tokenResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(tokenResp.Body)
+		return "", fmt.Errorf("server returned %d - %s", tokenResp.StatusCode, string(body))
+	}
+
+	var tokenData struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(tokenResp.Body).Decode(&tokenData)
+	if err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	return tokenData.Token, nil
 }
 
-func handleExecute(writer http.ResponseWriter, request *http.Request) {
+func (c *Client) handleExecute(writer http.ResponseWriter, request *http.Request) {
 	//basically just pass the request from the server into llama.cpp. So we don't handle endpoint names etc.
 	//That's all done in the server. This should just pass the request from the server into llama.cpp using
 	//this worker as the middle-man.
@@ -200,8 +414,19 @@ func handleExecute(writer http.ResponseWriter, request *http.Request) {
 	var executeReq struct {
 		Endpoint string          `json:"endpoint"`
 		Body     json.RawMessage `json:"body"`
+		Affinity string          `json:"affinity"`
+	}
+
+	if !c.authorizeHub(request) {
+		log.Printf("Rejected /execute from %s: not authenticated as our hub", request.RemoteAddr)
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if c.cfg.MaxRequestBytes > 0 {
+		// leave room for the endpoint and JSON envelope around the body
+		request.Body = http.MaxBytesReader(writer, request.Body, c.cfg.MaxRequestBytes+1024)
 	}
-	busyFlag = true
 
 	err := json.NewDecoder(request.Body).Decode(&executeReq)
 	if err != nil {
@@ -215,27 +440,56 @@ func handleExecute(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	//dynamically create the endpoint based on the request data from Gollama server
-	resp, err := http.Post(
-		fmt.Sprintf("http://localhost:%d%s", llamaPort, executeReq.Endpoint),
-		"application/json",
-		bytes.NewReader(executeReq.Body),
-	)
+	statusCode, body, err := c.executeLocal(request.Context(), executeReq.Endpoint, executeReq.Body, executeReq.Affinity)
 	if err != nil {
-		http.Error(writer, "llama.cpp unavailable", http.StatusServiceUnavailable)
+		http.Error(writer, err.Error(), statusCode)
 		return
 	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	writer.Write(body)
+}
+
+/*
+executeLocal validates a command and runs it against a local llama.cpp backend serving the requested
+model (see selectBackend). It is shared by the /execute handler and the reverse tunnel so both paths behave identically.
+Cancelling ctx (the hub hung up, e.g. a hedged duplicate lost) stops llama.cpp's generation.
+*/
+func (c *Client) executeLocal(ctx context.Context, endpoint string, reqBody json.RawMessage, affinity string) (int, []byte, error) {
+	reqBody, err := c.validateExecute(endpoint, reqBody)
+	if err != nil {
+		log.Printf("Rejected command for %s: %v", endpoint, err)
+		return http.StatusBadRequest, nil, err
+	}
+
+	model := requestModel(reqBody)
+	backend := c.selectBackend(model, endpoint, affinity)
+	if backend == nil {
+		return http.StatusNotFound, nil, fmt.Errorf("no backend serves model %s on %s", model, endpoint)
+	}
+
+	backend.inflight.Add(1)
+	defer backend.inflight.Add(-1)
+
+	//dynamically create the endpoint based on the request data from Gollama server
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, backend.URL()+endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("error creating llama.cpp request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return http.StatusServiceUnavailable, nil, fmt.Errorf("llama.cpp unavailable")
+	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(writer, "Error reading llama.cpp response", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, nil, fmt.Errorf("error reading llama.cpp response")
 	}
 
-	log.Printf("Executed task at endpoint: %s", executeReq.Endpoint)
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(resp.StatusCode)
-	writer.Write(body)
-	busyFlag = false
+	log.Printf("Executed task at endpoint: %s (backend port %d)", endpoint, backend.Port)
+	return resp.StatusCode, body, nil
 }